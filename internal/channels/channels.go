@@ -20,13 +20,32 @@ type ChannelBundle struct {
 	Mqtt chan *MQTTUpdate
 }
 
+// How many messages are waiting on each channel, for metrics.
+func (cb *ChannelBundle) QueueDepths() map[string]func() int {
+	return map[string]func() int{
+		"control":        func() int { return len(cb.Control) },
+		"ups":            func() int { return len(cb.Ups) },
+		"metrics":        func() int { return len(cb.Metrics) },
+		"mqtt_converter": func() int { return len(cb.MqttConverter) },
+		"mqtt":           func() int { return len(cb.Mqtt) },
+	}
+}
+
 // A control message for the overall process.
 type ControlMessage struct {
 	Operation string
 	Comment   string
+	// For commands that take them, e.g. poll-now <host>.
+	Args []string
+	// Commands from MQTT want an answer, tagged with whatever ID they came with.
+	Reply bool
+	ID    string
 }
 
 func (cm ControlMessage) String() string {
+	if len(cm.Args) > 0 {
+		return fmt.Sprintf("Operation: %s, Args: %v, Comment: %s", cm.Operation, cm.Args, cm.Comment)
+	}
 	return fmt.Sprintf("Operation: %s, Comment: %s", cm.Operation, cm.Comment)
 }
 
@@ -34,13 +53,35 @@ func (cm ControlMessage) String() string {
 // to be consumed by the various goroutines via their channels.
 type UPSVariableUpdate struct {
 	Host    string
+	Port    int
 	UpsName string
+	// Stable identity of the UPS (see UPSInfo.ID) and what to call it in topics and labels.
+	UpsID string
+	Alias string
+	// Per-UPS topic template, if configured.
+	TopicTemplate string
 	// the var name, in nut.dotted.format
 	VarName string
 	// the new value
 	Content string
 	// the previous value, if we have it.
 	OldContent string
+	// Metadata for the variable, set when it's new to us (or only just arrived) so it can be published.
+	Meta *VarMetadata
+	// The variable has gone away, so anything published for it should be cleared. Content is meaningless.
+	Removed bool
+	// The whole UPS has gone away, so drop everything for it. Only sent to Metrics, with no VarName.
+	Forget bool
+	// If set, closed once the update's been dealt with.
+	Done chan struct{}
+}
+
+// What to call the UPS in topics and labels: its alias if it has one, otherwise its name.
+func (up *UPSVariableUpdate) DisplayName() string {
+	if up.Alias != "" {
+		return up.Alias
+	}
+	return up.UpsName
 }
 
 // MQTT
@@ -52,6 +93,23 @@ type MQTTUpdate struct {
 	Content string
 	// The previous version of the content, if we have it.
 	OldContent string
+	// Whether the broker should retain this message.
+	Retain bool
+	// Topic is the whole topic, without --mqtt-topic-base, e.g. for Home Assistant discovery.
+	Absolute bool
+	// About a UPS, rather than the bridge itself, so only the active instance should publish it (see --ha-group).
+	UPSData bool
+
+	// The rest only mean anything over MQTT v5.
+
+	// e.g. text/plain or application/json
+	ContentType string
+	// Sent as user properties, e.g. host, ups, var.
+	Properties map[string]string
+	// A reading that goes stale, so gets --mqtt-message-expiry.
+	Volatile bool
+	// For replies to requests.
+	CorrelationData []byte
 }
 
 // UPS Info
@@ -60,8 +118,49 @@ type UPSInfo struct {
 	Name string
 	// hostname of the connected machine
 	Host string
+	// port of upsd on Host
+	Port int
+	// Stable identity for this UPS, filled in by the controller: host:port/name, or serial:<serial>
+	// if we're identifying UPSes by serial number and it has one.
+	ID string
+	// Friendly name for topics and labels, if configured.
+	Alias string
+	// Per-UPS MQTT topic template, if configured.
+	TopicTemplate string
+	// What to call it on --nut-listen, if configured.
+	NUTName string
 	// Description, as returned by nut
 	Description string
 	// All variable returned by LIST VAR
 	Vars map[string]string
+	// Metadata for each of Vars, where we managed to get it.
+	Meta map[string]*VarMetadata
+}
+
+// What to call the UPS in topics and labels: its alias if it has one, otherwise its name.
+func (u *UPSInfo) DisplayName() string {
+	if u.Alias != "" {
+		return u.Alias
+	}
+	return u.Name
+}
+
+// The serial number the UPS reports, if any.
+func (u *UPSInfo) Serial() string {
+	if s := u.Vars["device.serial"]; s != "" {
+		return s
+	}
+	return u.Vars["ups.serial"]
+}
+
+// What upsd can tell us about a variable beyond its value, from GET DESC and GET TYPE.
+type VarMetadata struct {
+	Description string `json:"description"`
+	// One of STRING, NUMBER, ENUM or RANGE
+	Type     string `json:"type"`
+	Writable bool   `json:"writable"`
+	// For STRING, the maximum length.
+	MaxLength int `json:"max_length,omitempty"`
+	// Our best guess from the variable name, NUT doesn't tell us.
+	Unit string `json:"unit,omitempty"`
 }
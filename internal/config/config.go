@@ -0,0 +1,153 @@
+package config
+
+// The optional config file, for things too fiddly to be flags.
+// This is just the shape of it - each section is validated by whatever package uses it.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type Config struct {
+	// How NUT variables become prometheus metrics. If empty, we use the built-in mappings.
+	Metrics []MetricMapping `json:"metrics,omitempty"`
+	// Per-UPS settings.
+	UPS []UPSConfig `json:"ups,omitempty"`
+	// Which variable changes we pass on to MQTT and metrics.
+	Filters FilterConfig `json:"filters,omitempty"`
+	// Variables worked out from others, published like any other.
+	Derived []DerivedVariable `json:"derived,omitempty"`
+	// MQTT brokers to publish to. If empty, there's just the one from the --mqtt-* flags.
+	// Only read at startup.
+	Outputs []OutputConfig `json:"outputs,omitempty"`
+}
+
+// An MQTT broker to publish to. Anything left out comes from the equivalent --mqtt-* flag, where there is one.
+type OutputConfig struct {
+	// For logs and metrics.
+	Name string `json:"name"`
+	// e.g. tcp://host:1883, ssl://host:8883 or wss://host/mqtt
+	URL  string `json:"url"`
+	User string `json:"user,omitempty"`
+	// Has to be unique on the broker. Defaults to the --mqtt-client-id one, with the output name on the end.
+	ClientID string `json:"client_id,omitempty"`
+	// The environment variable with the password in it, to keep it out of here.
+	PasswordEnv string `json:"password_env,omitempty"`
+
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+
+	// 3 or 5
+	Protocol      int    `json:"protocol,omitempty"`
+	TopicBase     string `json:"topic_base,omitempty"`
+	TopicTemplate string `json:"topic_template,omitempty"`
+	// 0, 1 or 2. Defaults to 0.
+	QoS int `json:"qos,omitempty"`
+	// Retain every message. Defaults to false.
+	Retain bool `json:"retain,omitempty"`
+	// Globs on NUT variable names, for what goes to this broker. An empty include list means everything. Exclude wins.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+
+	QueueSize     int    `json:"queue_size,omitempty"`
+	MessageExpiry string `json:"message_expiry,omitempty"`
+	TopicAliases  int    `json:"topic_aliases,omitempty"`
+
+	// Publish Home Assistant discovery configs for the derived power and energy sensors, under the prefix
+	// (default homeassistant).
+	HADiscovery       bool   `json:"ha_discovery,omitempty"`
+	HADiscoveryPrefix string `json:"ha_discovery_prefix,omitempty"`
+}
+
+// Keeps noisy or uninteresting variables from flooding MQTT.
+type FilterConfig struct {
+	// Globs on NUT variable names. An empty include list means everything. Exclude wins.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// Per-variable rules. The first one matching a variable applies.
+	Rules []FilterRule `json:"rules,omitempty"`
+}
+
+type FilterRule struct {
+	// Glob on NUT variable names, e.g. input.voltage or input.*
+	Variable string `json:"variable"`
+	// Ignore numeric changes smaller than this, from the last value we published.
+	Deadband float64 `json:"deadband,omitempty"`
+	// Ignore numeric changes smaller than this percentage of the last value we published.
+	DeadbandPercent float64 `json:"deadband_percent,omitempty"`
+	// Don't publish the variable more often than this, e.g. "30s". Whatever it settles on gets published later.
+	MinInterval string `json:"min_interval,omitempty"`
+	// Publish every change, regardless of deadbands, intervals and include/exclude lists.
+	Always bool `json:"always,omitempty"`
+}
+
+// A variable worked out from a UPS's other variables.
+type DerivedVariable struct {
+	// e.g. ups.load.watts. If NUT has a variable by the same name, that wins.
+	Name string `json:"name"`
+	// e.g. "ups.load / 100 * ups.realpower.nominal". Can use derived variables defined before this one.
+	Expression string `json:"expression"`
+	// Which UPSes get it, as for ups match strings. Empty means all of them.
+	UPS         []string `json:"ups,omitempty"`
+	Unit        string   `json:"unit,omitempty"`
+	Description string   `json:"description,omitempty"`
+	// Round to this many decimal places. Defaults to as many as it takes.
+	Decimals *int `json:"decimals,omitempty"`
+}
+
+// Settings for a particular UPS.
+type UPSConfig struct {
+	// Which UPS: host:port/name, host/name (any port) or serial:<serial number>
+	Match string `json:"match"`
+	// What to call it in topics and labels, instead of its name.
+	Alias string `json:"alias,omitempty"`
+	// Overrides --mqtt-topic-template for this UPS.
+	TopicTemplate string `json:"topic_template,omitempty"`
+	// What to call it on --nut-listen, instead of its alias or name.
+	NUTName string `json:"nut_name,omitempty"`
+}
+
+// One or more NUT variables, exported as a prometheus metric.
+type MetricMapping struct {
+	// Glob on NUT variable names, e.g. battery.charge or input.*
+	// If it's a glob, the metric gets a "var" label to tell the variables apart.
+	Variable string `json:"variable"`
+	// The metric name. Unit, if set, is appended to this.
+	Name string `json:"name"`
+	// One of gauge, counter, info or enum-state.
+	// info exports the value as a "value" label. enum-state exports a series per state (see States).
+	Type string `json:"type"`
+	Help string `json:"help,omitempty"`
+	// e.g. volts, seconds, ratio
+	Unit string `json:"unit,omitempty"`
+	// Scale numeric values, e.g. 0.01 to turn a percentage into a ratio. Zero means 1.
+	Multiplier float64 `json:"multiplier,omitempty"`
+	// Extra labels, from other variables on the same UPS, e.g. {"model": "device.model"}
+	Labels map[string]string `json:"labels,omitempty"`
+	// For enum-state, the possible states. Each gets a series, which is 1 if the variable is that state
+	// (or, for space-separated things like ups.status, contains it) and 0 if not.
+	States []string `json:"states,omitempty"`
+}
+
+// Read the config file at path. Unknown fields are an error, to catch typos.
+func Load(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(raw)
+}
+
+func Parse(raw []byte) (*Config, error) {
+	ret := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(ret); err != nil {
+		return nil, fmt.Errorf("error parsing config: %v", err)
+	}
+	return ret, nil
+}
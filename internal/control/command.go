@@ -0,0 +1,200 @@
+package control
+
+// Commands sent to <control topic>/cmd, answered on <control topic>/cmd/reply.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	logging "github.com/gerrowadat/nut2mqtt/internal/logging"
+)
+
+// A command as JSON, for when you want your reply tagged with an ID.
+type command struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	ID      string   `json:"id"`
+}
+
+type commandReply struct {
+	InstanceID string      `json:"instance_id"`
+	ID         string      `json:"id,omitempty"`
+	Command    string      `json:"command"`
+	OK         bool        `json:"ok"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func (c Controller) CommandTopic() string {
+	return c.mqtt_topic + "/cmd"
+}
+
+// Turn a message from the command topic into a control message: either "poll-now host1" or
+// {"command": "poll-now", "args": ["host1"], "id": "42"}.
+func ParseCommand(payload []byte) (*channels.ControlMessage, error) {
+	var cmd command
+	text := strings.TrimSpace(string(payload))
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal([]byte(text), &cmd); err != nil {
+			return nil, fmt.Errorf("bad command %q: %v", text, err)
+		}
+	} else {
+		fields := strings.Fields(text)
+		if len(fields) > 0 {
+			cmd.Command, cmd.Args = fields[0], fields[1:]
+		}
+	}
+	if cmd.Command == "" {
+		return nil, errors.New("empty command")
+	}
+	switch cmd.Command {
+	case "startup", "shutdown":
+		// Not for the likes of MQTT.
+		return nil, fmt.Errorf("unknown command %q", cmd.Command)
+	}
+	return &channels.ControlMessage{Operation: cmd.Command, Args: cmd.Args, ID: cmd.ID, Reply: true, Comment: "from MQTT"}, nil
+}
+
+// Handle a message from the command topic, e.g. from an MQTT subscription. Blocks until the control consumer takes it.
+func (c Controller) HandleCommand(payload []byte) {
+	msg, err := ParseCommand(payload)
+	if err != nil {
+		logger.Warn("Ignoring MQTT command", "err", err)
+		// Never gets to ControlMessageConsumer, but it's still a command we've dealt with.
+		c.mr.Metrics().ControlMessagesProcessed.Inc()
+		c.cb.Mqtt <- c.commandReply(&channels.ControlMessage{}, nil, err)
+		return
+	}
+	c.cb.Control <- msg
+}
+
+func (c *Controller) runCommand(msg *channels.ControlMessage) (interface{}, error) {
+	switch msg.Operation {
+	case "reload", "reload-config":
+		if c.reloader == nil {
+			return nil, errors.New("no config file to reload")
+		}
+		if err := c.reloader(); err != nil {
+			return nil, fmt.Errorf("error reloading config, keeping the old one: %v", err)
+		}
+		return "reloaded", nil
+	case "refresh":
+		if !c.publishing() {
+			return nil, errors.New("not publishing, so nothing to refresh")
+		}
+		c.requestResync()
+		return "refreshing", nil
+	case "poll-now":
+		host := ""
+		if len(msg.Args) > 0 {
+			host = msg.Args[0]
+		}
+		return c.requestPoll(host)
+	case "pause":
+		c.paused.Store(true)
+		logger.Info("Publishing paused")
+		return "paused", nil
+	case "resume":
+		if c.paused.Swap(false) {
+			logger.Info("Publishing resumed")
+			// We've missed things, so catch up.
+			c.requestResync()
+		}
+		return "resumed", nil
+	case "set-log-level":
+		if len(msg.Args) != 1 {
+			return nil, errors.New("set-log-level wants a level: debug, info, warn or error")
+		}
+		if err := logging.SetLevel(msg.Args[0]); err != nil {
+			return nil, err
+		}
+		return logging.Level(), nil
+	case "dump-state":
+		return c.dumpState(), nil
+	default:
+		return nil, fmt.Errorf("unknown command %q", msg.Operation)
+	}
+}
+
+func (c Controller) commandReply(msg *channels.ControlMessage, result interface{}, err error) *channels.MQTTUpdate {
+	reply := &commandReply{InstanceID: c.instance.ID, ID: msg.ID, Command: msg.Operation, OK: err == nil, Result: result}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	out, _ := json.Marshal(reply)
+	return &channels.MQTTUpdate{Topic: c.CommandTopic() + "/reply", Content: string(out), ContentType: "application/json"}
+}
+
+// Whether UPS data goes to MQTT: we're not paused, and not on standby.
+func (c Controller) publishing() bool {
+	return c.active.Load() && !c.paused.Load()
+}
+
+func (c Controller) requestResync() {
+	select {
+	case c.resync <- struct{}{}:
+	default:
+		// Already on its way.
+	}
+}
+
+// Ask the producer to poll a host (host or host:port) now, or every host if it's empty.
+func (c Controller) requestPoll(host string) (interface{}, error) {
+	target := ""
+	if host != "" {
+		for _, h := range c.instance.Hosts {
+			if h == host || strings.HasPrefix(h, host+":") {
+				target = h
+				break
+			}
+		}
+		if target == "" {
+			return nil, fmt.Errorf("not polling %v", host)
+		}
+	}
+	select {
+	case c.poll <- target:
+	default:
+		return nil, errors.New("too many polls already waiting")
+	}
+	if target == "" {
+		return "polling all hosts", nil
+	}
+	return "polling " + target, nil
+}
+
+// Hosts (host:port) to poll right now, "" meaning all of them. For the UPS info producer.
+func (c Controller) PollRequests() <-chan string {
+	return c.poll
+}
+
+type upsDump struct {
+	ID          string            `json:"id"`
+	Host        string            `json:"host"`
+	Port        int               `json:"port"`
+	Name        string            `json:"name"`
+	Alias       string            `json:"alias,omitempty"`
+	Description string            `json:"description"`
+	Vars        map[string]string `json:"vars"`
+}
+
+type stateDump struct {
+	Instance *InstanceInfo `json:"instance"`
+	Active   bool          `json:"active"`
+	Paused   bool          `json:"paused"`
+	LogLevel string        `json:"log_level"`
+	UPS      []*upsDump    `json:"ups"`
+}
+
+func (c Controller) dumpState() *stateDump {
+	ret := &stateDump{Instance: c.instance, Active: c.active.Load(), Paused: c.paused.Load(), LogLevel: logging.Level(), UPS: []*upsDump{}}
+	for _, u := range c.state.Snapshot() {
+		ret.UPS = append(ret.UPS, &upsDump{ID: u.ID, Host: u.Host, Port: u.Port, Name: u.Name, Alias: u.Alias, Description: u.Description, Vars: u.Vars})
+	}
+	sort.Slice(ret.UPS, func(i, j int) bool { return ret.UPS[i].ID < ret.UPS[j].ID })
+	return ret
+}
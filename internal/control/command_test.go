@@ -0,0 +1,117 @@
+package control
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gerrowadat/nut2mqtt/internal/channels"
+	"github.com/gerrowadat/nut2mqtt/internal/logging"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    *channels.ControlMessage
+		wantErr bool
+	}{
+		{payload: "refresh\n", want: &channels.ControlMessage{Operation: "refresh", Args: []string{}, Reply: true, Comment: "from MQTT"}},
+		{payload: "poll-now  host1", want: &channels.ControlMessage{Operation: "poll-now", Args: []string{"host1"}, Reply: true, Comment: "from MQTT"}},
+		{payload: `{"command": "set-log-level", "args": ["debug"], "id": "42"}`, want: &channels.ControlMessage{Operation: "set-log-level", Args: []string{"debug"}, ID: "42", Reply: true, Comment: "from MQTT"}},
+		{payload: "", wantErr: true},
+		{payload: `{"command": `, wantErr: true},
+		{payload: `{"id": "42"}`, wantErr: true},
+		{payload: "shutdown", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCommand([]byte(tt.payload))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCommand(%q) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCommand(%q) = %+v, want %+v", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	defer logging.SetLevel("info")
+	c := NewController("bridge", time.Minute)
+	c.SetInstanceInfo(&InstanceInfo{ID: "nas", Hosts: []string{"host1:3493", "host2:3493"}})
+	c.State().Set("host1:3493/ups", &channels.UPSInfo{ID: "host1:3493/ups", Host: "host1", Port: 3493, Name: "ups", Vars: map[string]string{"ups.status": "OL"}})
+	reloads := 0
+	c.SetReloader(func() error { reloads++; return nil })
+
+	run := func(op string, args ...string) (interface{}, error) {
+		return c.runCommand(&channels.ControlMessage{Operation: op, Args: args})
+	}
+
+	if _, err := run("reload-config"); err != nil || reloads != 1 {
+		t.Errorf("reload-config = %v, reloads %d", err, reloads)
+	}
+	if got, err := run("poll-now", "host2"); err != nil || got != "polling host2:3493" {
+		t.Errorf("poll-now host2 = %v, %v", got, err)
+	}
+	if host := <-c.PollRequests(); host != "host2:3493" {
+		t.Errorf("poll request for %q, want host2:3493", host)
+	}
+	if _, err := run("poll-now", "host3"); err == nil {
+		t.Errorf("poll-now for a host we don't poll should fail")
+	}
+	if _, err := run("poll-now"); err != nil || <-c.PollRequests() != "" {
+		t.Errorf("poll-now should poll everything, got %v", err)
+	}
+
+	run("pause")
+	if c.publishing() {
+		t.Errorf("shouldn't be publishing while paused")
+	}
+	if _, err := run("refresh"); err == nil {
+		t.Errorf("refresh while paused should fail")
+	}
+	run("resume")
+	if !c.publishing() {
+		t.Errorf("should be publishing after resume")
+	}
+	select {
+	case <-c.resync:
+	default:
+		t.Errorf("resume should ask for a resync")
+	}
+
+	if got, err := run("set-log-level", "debug"); err != nil || got != "debug" {
+		t.Errorf("set-log-level debug = %v, %v", got, err)
+	}
+	if _, err := run("set-log-level"); err == nil {
+		t.Errorf("set-log-level with no level should fail")
+	}
+	if _, err := run("nope"); err == nil {
+		t.Errorf("unknown commands should fail")
+	}
+
+	got, _ := run("dump-state")
+	reply := c.commandReply(&channels.ControlMessage{Operation: "dump-state", ID: "7"}, got, nil).Content
+	want := `{"instance_id":"nas","id":"7","command":"dump-state","ok":true,"result":{"instance":{"instance_id":"nas","version":"","hostname":"","started":"0001-01-01T00:00:00Z","hosts":["host1:3493","host2:3493"],"client_ids":null},"active":true,"paused":false,"log_level":"debug","ups":[{"id":"host1:3493/ups","host":"host1","port":3493,"name":"ups","description":"","vars":{"ups.status":"OL"}}]}}`
+	if reply != want {
+		t.Errorf("dump-state reply = %v\nwant %v", reply, want)
+	}
+	if u := c.commandReply(&channels.ControlMessage{Operation: "nope"}, nil, errors.New("unknown command")); u.Topic != "bridge/cmd/reply" || u.Content != `{"instance_id":"nas","command":"nope","ok":false,"error":"unknown command"}` {
+		t.Errorf("error reply = %+v", u)
+	}
+}
+
+func TestHandleBadCommand(t *testing.T) {
+	c := NewController("bridge", time.Minute)
+	c.SetInstanceInfo(&InstanceInfo{ID: "nas"})
+	c.HandleCommand([]byte("{not json"))
+	if got := testutil.ToFloat64(c.mr.Metrics().ControlMessagesProcessed); got != 1 {
+		t.Errorf("ControlMessagesProcessed = %v after a bad command, want 1", got)
+	}
+	if reply := <-c.cb.Mqtt; !strings.Contains(reply.Content, `"ok":false`) {
+		t.Errorf("bad command got reply %v, want an error", reply.Content)
+	}
+}
@@ -3,17 +3,24 @@
 package control
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+	journal "github.com/gerrowadat/nut2mqtt/internal/journal"
+	logging "github.com/gerrowadat/nut2mqtt/internal/logging"
 	metrics "github.com/gerrowadat/nut2mqtt/internal/metrics"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
+var logger = logging.Logger("control")
+
 type Controller struct {
 	cb *channels.ChannelBundle
 	mr *metrics.MetricRegistry
@@ -22,24 +29,79 @@ type Controller struct {
 	mqtt_topic string
 	// How long to keep UPS cache entries around for.
 	ups_cache_lifetime time.Duration
+	// What the multiplexer currently knows, for other goroutines to look at.
+	state *UPSState
+	// Re-reads the config file and applies it, if we have one.
+	reloader func() error
+	// Whether to clear a UPS's retained MQTT topics when it drops out of the cache.
+	clear_stale_topics bool
+	// Works out UPS IDs and aliases.
+	ids *UPSIdentifier
+	// Decides which variable changes are worth passing on.
+	filters *VarFilter
+	// Who we are, for telling us apart from other bridges on the same broker.
+	instance *InstanceInfo
+	// Whether we're the one publishing UPS data, rather than a standby (see SetActive).
+	active *atomic.Bool
+	// Poked to get the multiplexer to publish everything again, e.g. on taking over from another instance.
+	resync chan struct{}
+	// Paused by a command, as opposed to being on standby.
+	paused *atomic.Bool
+	// Hosts to poll now, from poll-now commands.
+	poll chan string
+	// Where power events, commands and so on get recorded.
+	journal        *journal.Journal
+	publish_events bool
+	// Variables (globs) to record every change of.
+	journal_vars []string
+	// Power cuts in progress, and reports on the last few.
+	outages *OutageTracker
+	// Energy totals per UPS.
+	energy *EnergyMeter
+	// Variables worked out from expressions in the config file.
+	derived *DerivedVars
 }
 
+// Enough to ride out a slow consumer for a poll or so, and so channel_queue_depth has something to show
+// when one falls behind.
+const channelBufferSize = 100
+
 func NewController(mqtt_topic string, ups_cache_lifetime time.Duration) Controller {
 	var wg sync.WaitGroup
 	// Set to 1, as we want to exit if even 1 subprocess dies.
 	wg.Add(1)
+	cb := &channels.ChannelBundle{
+		Control:       make(chan *channels.ControlMessage, channelBufferSize),
+		Ups:           make(chan *channels.UPSInfo, channelBufferSize),
+		Metrics:       make(chan *channels.UPSVariableUpdate, channelBufferSize),
+		MqttConverter: make(chan *channels.UPSVariableUpdate, channelBufferSize),
+		Mqtt:          make(chan *channels.MQTTUpdate, channelBufferSize),
+	}
+	mr := metrics.NewMetricRegistry()
+	mr.RegisterQueueDepths(cb.QueueDepths())
+	// Memory only, until we're told otherwise.
+	j, _ := journal.Open(journal.Options{})
+	active := &atomic.Bool{}
+	active.Store(true)
+	mr.Metrics().HAActive.Set(1)
 	return Controller{
-		cb: &channels.ChannelBundle{
-			Control:       make(chan *channels.ControlMessage),
-			Ups:           make(chan *channels.UPSInfo),
-			Metrics:       make(chan *channels.UPSVariableUpdate),
-			MqttConverter: make(chan *channels.UPSVariableUpdate),
-			Mqtt:          make(chan *channels.MQTTUpdate),
-		},
-		mr:                 metrics.NewMetricRegistry(),
+		cb:                 cb,
+		mr:                 mr,
 		wg:                 &wg,
 		mqtt_topic:         mqtt_topic,
-		ups_cache_lifetime: ups_cache_lifetime}
+		ups_cache_lifetime: ups_cache_lifetime,
+		state:              NewUPSState(),
+		ids:                NewUPSIdentifier(false),
+		filters:            NewVarFilter(),
+		instance:           &InstanceInfo{ID: "nut2mqtt"},
+		active:             active,
+		resync:             make(chan struct{}, 1),
+		paused:             &atomic.Bool{},
+		poll:               make(chan string, 8),
+		journal:            j,
+		outages:            NewOutageTracker(100),
+		energy:             NewEnergyMeter(ups_cache_lifetime),
+		derived:            NewDerivedVars()}
 }
 
 func (c Controller) Startup(comment string, args ...interface{}) {
@@ -52,6 +114,56 @@ func (c Controller) Shutdown(comment string, args ...interface{}) {
 	c.cb.Control <- &channels.ControlMessage{Operation: "shutdown", Comment: comment}
 }
 
+// Ask for the config to be re-read, e.g. on SIGHUP.
+func (c Controller) Reload(comment string, args ...interface{}) {
+	comment = fmt.Sprintf("Reload: "+comment, args...)
+	c.cb.Control <- &channels.ControlMessage{Operation: "reload", Comment: comment}
+}
+
+// What to do when asked to reload. Set before starting ControlMessageConsumer.
+func (c *Controller) SetReloader(reloader func() error) {
+	c.reloader = reloader
+}
+
+// Key UPSes by serial number, where they report one, rather than host:port/name.
+func (c *Controller) SetIdentifyBySerial(by_serial bool) {
+	c.ids.by_serial = by_serial
+}
+
+// Per-UPS config (aliases and so on). Safe to call at any time.
+func (c Controller) SetUPSConfig(ups []config.UPSConfig) {
+	c.ids.SetUPSConfig(ups)
+}
+
+// Variable filters and deadbands. Safe to call at any time.
+func (c Controller) SetFilters(cfg config.FilterConfig) error {
+	return c.filters.SetConfig(cfg)
+}
+
+// Whether to publish UPS data over MQTT. A standby keeps polling (and exporting metrics), but leaves publishing
+// to the active instance. Becoming active publishes everything we know, as we don't know what the last one got to.
+func (c Controller) SetActive(active bool) {
+	if c.active.Swap(active) == active {
+		return
+	}
+	if active {
+		logger.Info("Now the active instance, publishing UPS data")
+		c.mr.Metrics().HAActive.Set(1)
+		c.requestResync()
+	} else {
+		logger.Info("Now on standby, not publishing UPS data")
+		c.mr.Metrics().HAActive.Set(0)
+	}
+}
+
+func (c Controller) IsActive() bool {
+	return c.active.Load()
+}
+
+func (c *Controller) SetClearStaleTopics(clear bool) {
+	c.clear_stale_topics = clear
+}
+
 // Redirections to other bits, I am a bad programmer man.
 func (c Controller) WaitGroupDone() {
 	c.wg.Done()
@@ -69,95 +181,325 @@ func (c Controller) Channels() *channels.ChannelBundle {
 	return c.cb
 }
 
+func (c Controller) Outages() *OutageTracker {
+	return c.outages
+}
+
+func (c Controller) State() *UPSState {
+	return c.state
+}
+
+// The subtopic for controller messages, e.g. bridge
+func (c Controller) ControlTopic() string {
+	return c.mqtt_topic
+}
+
+// Answer a request from MQTT (on <control topic>/request, over MQTT v5), as JSON.
+func (c Controller) HandleRequest(req string) (string, error) {
+	var ret interface{}
+	switch strings.TrimSpace(req) {
+	case "ping":
+		ret = map[string]string{"status": "ok"}
+	case "instance":
+		ret = c.instance
+	case "ups":
+		ids := []string{}
+		for _, u := range c.state.Snapshot() {
+			ids = append(ids, u.ID)
+		}
+		sort.Strings(ids)
+		ret = ids
+	default:
+		ret = map[string]string{"error": "unknown request"}
+		out, _ := json.Marshal(ret)
+		return string(out), fmt.Errorf("unknown request %q", req)
+	}
+	out, err := json.Marshal(ret)
+	return string(out), err
+}
+
+// A read-only view of the UPS cache, safe to use from outside the multiplexer.
+type UPSState struct {
+	mu    sync.RWMutex
+	upses map[string]*channels.UPSInfo
+	// When each UPS was last polled.
+	seen map[string]time.Time
+}
+
+func NewUPSState() *UPSState {
+	return &UPSState{upses: map[string]*channels.UPSInfo{}, seen: map[string]time.Time{}}
+}
+
+func (s *UPSState) Set(key string, u *channels.UPSInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upses[key] = u
+	s.seen[key] = time.Now()
+}
+
+// When we last got variables for a UPS, or zero if we don't know it.
+func (s *UPSState) LastSeen(key string) time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seen[key]
+}
+
+func (s *UPSState) Get(key string) *channels.UPSInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.upses[key]
+}
+
+func (s *UPSState) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.upses, key)
+	delete(s.seen, key)
+}
+
+// All the UPSes we currently know about. Don't modify what you get back.
+func (s *UPSState) Snapshot() []*channels.UPSInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := []*channels.UPSInfo{}
+	for _, u := range s.upses {
+		ret = append(ret, u)
+	}
+	return ret
+}
+
 func (c *Controller) ControlMessageConsumer() {
 	defer c.wg.Done()
 	for {
 		msg := <-c.cb.Control
 		c.mr.Metrics().ControlMessagesProcessed.Inc()
-		fmt.Println("Processing Control message: ", msg.String())
+		logger.Info("Processing control message", "operation", msg.Operation, "args", msg.Args, "comment", msg.Comment)
 		switch msg.Operation {
 		case "startup":
-			c.cb.Mqtt <- &channels.MQTTUpdate{Topic: c.mqtt_topic + "/state", Content: "online"}
+			// Retained, and the MQTT client sets a will to say offline if we go away unexpectedly.
+			c.cb.Mqtt <- &channels.MQTTUpdate{Topic: c.StateTopic(), Content: "online", Retain: true}
+			c.cb.Mqtt <- c.instanceUpdate(true)
+			c.record(&journal.Event{Type: journal.BridgeStart, Message: msg.Comment})
 		case "shutdown":
-			c.cb.Mqtt <- &channels.MQTTUpdate{Topic: c.mqtt_topic + "/state", Content: "offline"}
+			c.record(&journal.Event{Type: journal.BridgeStop, Message: msg.Comment})
+			c.cb.Mqtt <- &channels.MQTTUpdate{Topic: c.StateTopic(), Content: "offline", Retain: true}
+			c.cb.Mqtt <- c.instanceUpdate(false)
 			// returning will exit the consumer, and process will end.
 			return
 		default:
-			fmt.Println("Unknown operation on control channel: ", msg.Operation)
+			result, err := c.runCommand(msg)
+			c.record(commandEvent(msg, err))
+			if msg.Reply {
+				c.cb.Mqtt <- c.commandReply(msg, result, err)
+			} else if err != nil {
+				logger.Error("Error running control message", "operation", msg.Operation, "err", err)
+			}
 		}
 	}
 }
 
 // A decaying cache of UPS info. If we don't see a UPS for a while, we remove it.
 type DecayingUPSCacheEntry struct {
-	ups       *channels.UPSInfo
+	// What we've published for this UPS, which may lag behind what we've seen if it's filtered.
+	ups *channels.UPSInfo
+	// What we last saw, unfiltered, which is what metrics go by.
+	seen      *channels.UPSInfo
 	last_seen time.Time
 }
 
-func PruneUPSCache(cache map[string]*DecayingUPSCacheEntry, expiry time.Duration) {
+// Drop anything we haven't seen lately from the cache, and return what was dropped.
+func PruneUPSCache(cache map[string]*DecayingUPSCacheEntry, expiry time.Duration) map[string]*channels.UPSInfo {
+	pruned := map[string]*channels.UPSInfo{}
 	expiry_time := time.Now().Add(-expiry)
 	for k, v := range cache {
 		if v.last_seen.Before(expiry_time) {
-			log.Printf("Pruning UPS cache entry: %v ", k)
+			logger.Info("Pruning UPS cache entry", "ups", k)
 			delete(cache, k)
+			pruned[k] = v.ups
 		}
 	}
-
+	return pruned
 }
 
 func (c *Controller) EmitVariableUpdate(chg *channels.UPSVariableUpdate) {
 	// Send to all the channels that care about this.
 	// Remember these are blocking.
+	c.emitMetricsUpdate(chg)
+	c.publishVariableUpdate(chg)
+}
+
+// Metrics get every change, filters or no filters.
+func (c *Controller) emitMetricsUpdate(chg *channels.UPSVariableUpdate) {
 	c.mr.Metrics().UPSVariableUpdatesProcessed.Inc()
 	c.cb.Metrics <- chg
-	c.cb.MqttConverter <- chg
+}
+
+// MQTT only gets what's made it through the filters.
+func (c *Controller) publishVariableUpdate(chg *channels.UPSVariableUpdate) {
+	if c.publishing() {
+		c.cb.MqttConverter <- chg
+	}
+}
+
+// Work out what's changed between two sightings of a UPS, as updates sorted by variable.
+// old is nil for a UPS we've not seen before, in which case everything is new.
+func DiffUPS(old *channels.UPSInfo, u *channels.UPSInfo) []*channels.UPSVariableUpdate {
+	ret := []*channels.UPSVariableUpdate{}
+	if old == nil {
+		old = &channels.UPSInfo{}
+	}
+	for k, v := range u.Vars {
+		old_v, present := old.Vars[k]
+		// Metadata counts as a change if we've only just got it.
+		var meta *channels.VarMetadata
+		if old.Meta[k] == nil {
+			meta = u.Meta[k]
+		}
+		if !present || old_v != v || meta != nil {
+			ret = append(ret, &channels.UPSVariableUpdate{Host: u.Host, Port: u.Port, UpsName: u.Name, UpsID: u.ID, Alias: u.Alias, TopicTemplate: u.TopicTemplate, VarName: k, Content: v, OldContent: old_v, Meta: meta})
+		}
+	}
+	for k, old_v := range old.Vars {
+		if _, present := u.Vars[k]; !present {
+			ret = append(ret, &channels.UPSVariableUpdate{Host: u.Host, Port: u.Port, UpsName: u.Name, UpsID: u.ID, Alias: u.Alias, TopicTemplate: u.TopicTemplate, VarName: k, OldContent: old_v, Removed: true})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].VarName < ret[j].VarName })
+	return ret
+}
+
+// If we're clearing stale topics, clear everything we've published for this UPS.
+func (c *Controller) clearTopics(u *channels.UPSInfo) {
+	if !c.clear_stale_topics || !c.publishing() {
+		return
+	}
+	for v := range u.Vars {
+		c.cb.MqttConverter <- &channels.UPSVariableUpdate{Host: u.Host, Port: u.Port, UpsName: u.Name, UpsID: u.ID, Alias: u.Alias, TopicTemplate: u.TopicTemplate, VarName: v, Removed: true}
+	}
+	c.cb.Mqtt <- &channels.MQTTUpdate{Topic: c.OutageTopic(u.ID), Content: "", Retain: true, UPSData: true}
+}
+
+// Drop UPSes we haven't seen lately, along with their metrics and (optionally) their MQTT topics.
+func (c *Controller) pruneUPSes(ups_info map[string]*DecayingUPSCacheEntry) {
+	for k, u := range PruneUPSCache(ups_info, c.ups_cache_lifetime) {
+		c.state.Delete(k)
+		c.filters.ForgetUPS(k)
+		c.outages.ForgetUPS(k)
+		c.energy.ForgetUPS(k)
+		c.forgetMetrics(u)
+		c.clearTopics(u)
+	}
+	c.mr.Metrics().UPSCached.Set(float64(len(ups_info)))
 }
 
 func (c *Controller) UPSVariableUpdateMultiplexer() {
 	defer c.wg.Done()
 	ups_info := map[string]*DecayingUPSCacheEntry{}
+	// If every host goes quiet nothing turns up on the channel, so prune on a timer too.
+	prune_interval := c.ups_cache_lifetime / 2
+	if prune_interval <= 0 {
+		prune_interval = time.Second
+	}
+	prune_ticker := time.NewTicker(prune_interval)
+	defer prune_ticker.Stop()
 	for {
 		// Get a UPSInfo from the channel
-		u := <-c.cb.Ups
+		var u *channels.UPSInfo
+		select {
+		case u = <-c.cb.Ups:
+		case <-prune_ticker.C:
+			c.pruneUPSes(ups_info)
+			continue
+		case <-c.resync:
+			c.republish(ups_info)
+			continue
+		}
 		// Prune our UPS cache first
-		PruneUPSCache(ups_info, c.ups_cache_lifetime)
-		// If this is a brand new UPS, we need to emit all of its variables.
-		_, present := ups_info[u.Name]
-		if !present {
-			for k, v := range u.Vars {
-				c.EmitVariableUpdate(&channels.UPSVariableUpdate{Host: u.Host, UpsName: u.Name, VarName: k, Content: v, OldContent: ""})
-			}
-		} else {
-			// This is an existing UPS. We need to diff the variables.
-			old := ups_info[u.Name].ups
-			for k, v := range u.Vars {
-				if old.Vars[k] != v {
-					c.EmitVariableUpdate(&channels.UPSVariableUpdate{Host: u.Host, UpsName: u.Name, VarName: k, Content: v, OldContent: old.Vars[k]})
-				}
+		c.pruneUPSes(ups_info)
+		// Key everything by the UPS's identity, not just its name, which may well be "ups" on every host.
+		c.ids.Identify(u)
+		var old, seen *channels.UPSInfo
+		if entry, present := ups_info[u.ID]; present {
+			old, seen = entry.ups, entry.seen
+			if old.Alias != u.Alias || old.TopicTemplate != u.TopicTemplate {
+				// Renamed by a config reload, so start afresh under the new name.
+				c.forgetMetrics(old)
+				c.energy.ForgetUPS(old.ID)
+				c.clearTopics(old)
+				c.filters.ForgetUPS(old.ID)
+				old, seen = nil, nil
 			}
 		}
+		// After forgetting any old name, as a rename might keep the same labels.
+		c.mr.Metrics().UPSUp.WithLabelValues(upsLabels(u)...).Set(1)
+		c.mr.Metrics().UPSLastScrape.WithLabelValues(upsLabels(u)...).SetToCurrentTime()
+		now := time.Now()
+		c.addDerivedVars(u, now)
+		c.derived.Apply(u)
+		for _, chg := range DiffUPS(seen, u) {
+			c.emitMetricsUpdate(chg)
+		}
+		updates, published := c.filters.Filter(old, u, now)
+		for _, chg := range updates {
+			c.publishVariableUpdate(chg)
+		}
+		for _, e := range UPSEvents(c.state.Get(u.ID), u, c.journal_vars) {
+			e.Time = now
+			c.record(e)
+		}
+		if r := c.outages.Observe(u, now); r != nil {
+			c.reportOutage(r)
+		}
 		// Plop this into the cache ragardless.
-		ups_info[u.Name] = &DecayingUPSCacheEntry{ups: u, last_seen: time.Now()}
+		ups_info[u.ID] = &DecayingUPSCacheEntry{ups: published, seen: u, last_seen: now}
+		c.state.Set(u.ID, u)
+		c.mr.Metrics().UPSCached.Set(float64(len(ups_info)))
 	}
 }
 
+// Send everything we've published (or would have, if we'd been active) to MQTT again, as if it were all new.
+func (c *Controller) republish(ups_info map[string]*DecayingUPSCacheEntry) {
+	if !c.publishing() {
+		return
+	}
+	ids := []string{}
+	for id := range ups_info {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, chg := range DiffUPS(nil, ups_info[id].ups) {
+			c.cb.MqttConverter <- chg
+		}
+	}
+}
+
+// Labels for a UPS's own metrics. The port's in there too, as two upsds on one host can have UPSes of the same name.
+func upsLabels(u *channels.UPSInfo) []string {
+	return []string{u.Host, strconv.Itoa(u.Port), u.DisplayName()}
+}
+
+// Drop a UPS's metrics, once MetricsUpdateConsumer has got through any updates already sent for it, so they
+// can't bring its series back. Waits, so anything we export for it afterwards sticks.
+func (c *Controller) forgetMetrics(u *channels.UPSInfo) {
+	done := make(chan struct{})
+	c.cb.Metrics <- &channels.UPSVariableUpdate{Host: u.Host, Port: u.Port, UpsName: u.Name, UpsID: u.ID, Alias: u.Alias, Forget: true, Done: done}
+	<-done
+}
+
 func (c *Controller) MetricsUpdateConsumer() {
 	defer c.wg.Done()
 	for {
 		up := <-c.cb.Metrics
-		for _, m := range metrics.UPSMetricsList {
-			if m.NutVariable == up.VarName {
-				// Emit this metric with the given host and ups.
-				if m.Type == "gaugevec" {
-					met := c.mr.GetUPSMetric(m.Name).(*prometheus.GaugeVec)
-					val, err := strconv.ParseFloat(up.Content, 64)
-					if err != nil {
-						log.Printf("Error parsing float for UPS variable %v: %v", m.Name, err)
-						continue
-					}
-					met.With(prometheus.Labels{"host": up.Host, "ups": up.UpsName}).Set(val)
-				}
-			}
+		if up.Forget {
+			c.mr.ForgetUPS(up.Host, up.Port, up.DisplayName())
+			close(up.Done)
+			continue
+		}
+		if up.Removed {
+			c.mr.RemoveUPSVariable(up.Host, up.Port, up.DisplayName(), up.VarName)
+			continue
 		}
+		c.mr.UpdateUPSVariable(up.Host, up.Port, up.DisplayName(), up.VarName, up.Content)
 	}
 }
@@ -3,10 +3,17 @@
 package control
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gerrowadat/nut2mqtt/internal/channels"
+	"github.com/gerrowadat/nut2mqtt/internal/config"
+	"github.com/gerrowadat/nut2mqtt/internal/journal"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestPruneUPSCache(t *testing.T) {
@@ -77,10 +84,479 @@ func TestPruneUPSCache(t *testing.T) {
 			if err != nil {
 				t.Errorf("PruneUPSCache() error = %v", err)
 			}
-			PruneUPSCache(tt.args.cache, duration)
+			before := len(tt.args.cache)
+			pruned := PruneUPSCache(tt.args.cache, duration)
 			if len(tt.args.cache) != tt.want_len {
 				t.Errorf("PruneUPSCache() = %v, want %v", len(tt.args.cache), tt.want_len)
 			}
+			if len(pruned) != before-tt.want_len {
+				t.Errorf("PruneUPSCache() pruned %v, want %v", len(pruned), before-tt.want_len)
+			}
+		})
+	}
+}
+
+func TestDiffUPS(t *testing.T) {
+	meta := &channels.VarMetadata{Description: "Battery charge"}
+	tests := []struct {
+		name string
+		old  *channels.UPSInfo
+		new  *channels.UPSInfo
+		want []*channels.UPSVariableUpdate
+	}{
+		{
+			name: "BrandNew",
+			old:  nil,
+			new:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"battery.charge": "100"}, Meta: map[string]*channels.VarMetadata{"battery.charge": meta}},
+			want: []*channels.UPSVariableUpdate{{Host: "h", UpsName: "u", VarName: "battery.charge", Content: "100", Meta: meta}},
+		},
+		{
+			name: "NoChanges",
+			old:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"battery.charge": "100"}, Meta: map[string]*channels.VarMetadata{"battery.charge": meta}},
+			new:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"battery.charge": "100"}, Meta: map[string]*channels.VarMetadata{"battery.charge": meta}},
+			want: []*channels.UPSVariableUpdate{},
+		},
+		{
+			name: "Changed",
+			old:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"battery.charge": "100"}},
+			new:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"battery.charge": "90"}},
+			want: []*channels.UPSVariableUpdate{{Host: "h", UpsName: "u", VarName: "battery.charge", Content: "90", OldContent: "100"}},
+		},
+		{
+			name: "MetadataArrives",
+			old:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"battery.charge": "100"}},
+			new:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"battery.charge": "100"}, Meta: map[string]*channels.VarMetadata{"battery.charge": meta}},
+			want: []*channels.UPSVariableUpdate{{Host: "h", UpsName: "u", VarName: "battery.charge", Content: "100", OldContent: "100", Meta: meta}},
+		},
+		{
+			name: "NewEmptyValue",
+			old:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{}},
+			new:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"input.transfer.reason": ""}},
+			want: []*channels.UPSVariableUpdate{{Host: "h", UpsName: "u", VarName: "input.transfer.reason", Content: ""}},
+		},
+		{
+			name: "Removed",
+			old:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"battery.charge": "100", "input.transfer.reason": "input voltage out of range"}},
+			new:  &channels.UPSInfo{Host: "h", Name: "u", Vars: map[string]string{"battery.charge": "100"}},
+			want: []*channels.UPSVariableUpdate{{Host: "h", UpsName: "u", VarName: "input.transfer.reason", OldContent: "input voltage out of range", Removed: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiffUPS(tt.old, tt.new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffUPS() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUPSIdentifier(t *testing.T) {
+	ups_config := []config.UPSConfig{
+		{Match: "host1:3493/ups", Alias: "rack-a"},
+		{Match: "host2/ups", Alias: "rack-b"},
+		{Match: "serial:ABC123", Alias: "desk"},
+	}
+	tests := []struct {
+		name      string
+		by_serial bool
+		u         *channels.UPSInfo
+		wantID    string
+		wantAlias string
+	}{
+		{
+			name:      "ByAddress",
+			u:         &channels.UPSInfo{Host: "host1", Port: 3493, Name: "ups"},
+			wantID:    "host1:3493/ups",
+			wantAlias: "rack-a",
+		},
+		{
+			name:      "SameNameOtherPort",
+			u:         &channels.UPSInfo{Host: "host1", Port: 3494, Name: "ups"},
+			wantID:    "host1:3494/ups",
+			wantAlias: "",
+		},
+		{
+			name:      "AnyPort",
+			u:         &channels.UPSInfo{Host: "host2", Port: 3494, Name: "ups"},
+			wantID:    "host2:3494/ups",
+			wantAlias: "rack-b",
+		},
+		{
+			name:      "SerialAliasButAddressID",
+			u:         &channels.UPSInfo{Host: "host3", Port: 3493, Name: "ups", Vars: map[string]string{"device.serial": "ABC123"}},
+			wantID:    "host3:3493/ups",
+			wantAlias: "desk",
+		},
+		{
+			name:      "BySerial",
+			by_serial: true,
+			u:         &channels.UPSInfo{Host: "host3", Port: 3493, Name: "ups", Vars: map[string]string{"ups.serial": "XYZ"}},
+			wantID:    "serial:XYZ",
+			wantAlias: "",
+		},
+		{
+			name:      "BySerialWithoutOne",
+			by_serial: true,
+			u:         &channels.UPSInfo{Host: "host3", Port: 3493, Name: "ups", Vars: map[string]string{}},
+			wantID:    "host3:3493/ups",
+			wantAlias: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := NewUPSIdentifier(tt.by_serial)
+			ids.SetUPSConfig(ups_config)
+			ids.Identify(tt.u)
+			if tt.u.ID != tt.wantID {
+				t.Errorf("Identify() ID = %v, want %v", tt.u.ID, tt.wantID)
+			}
+			if tt.u.Alias != tt.wantAlias {
+				t.Errorf("Identify() Alias = %v, want %v", tt.u.Alias, tt.wantAlias)
+			}
 		})
 	}
 }
+
+func TestValidateUPSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		ups     []config.UPSConfig
+		wantErr bool
+	}{
+		{
+			name: "DistinctAliases",
+			ups:  []config.UPSConfig{{Match: "host1/ups", Alias: "rack-a"}, {Match: "host2/ups", Alias: "rack-b"}, {Match: "host3/ups"}, {Match: "host4/ups"}},
+		},
+		{
+			name:    "DuplicateAlias",
+			ups:     []config.UPSConfig{{Match: "host1/ups", Alias: "rack-a"}, {Match: "host2/ups", Alias: "rack-a"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateUPSConfig(tt.ups); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateUPSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVarFilter(t *testing.T) {
+	ups := func(vars map[string]string) *channels.UPSInfo {
+		return &channels.UPSInfo{Name: "ups", Host: "host1", ID: "host1:3493/ups", Vars: vars}
+	}
+	changed := func(updates []*channels.UPSVariableUpdate) []string {
+		ret := []string{}
+		for _, u := range updates {
+			if u.Removed {
+				ret = append(ret, "-"+u.VarName)
+			} else {
+				ret = append(ret, u.VarName+"="+u.Content)
+			}
+		}
+		return ret
+	}
+	f := NewVarFilter()
+	err := f.SetConfig(config.FilterConfig{
+		Exclude: []string{"driver.*"},
+		Rules: []config.FilterRule{
+			{Variable: "driver.version", Always: true},
+			{Variable: "input.voltage", Deadband: 1},
+			{Variable: "battery.charge", DeadbandPercent: 10},
+			{Variable: "battery.runtime", MinInterval: "1m"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SetConfig() error = %v", err)
+	}
+	start := time.Now()
+	polls := []struct {
+		vars  map[string]string
+		after time.Duration
+		want  []string
+	}{
+		{
+			vars:  map[string]string{"input.voltage": "230.0", "battery.charge": "50", "battery.runtime": "600", "driver.name": "usbhid-ups", "driver.version": "2.8.0", "ups.status": "OL"},
+			want:  []string{"battery.charge=50", "battery.runtime=600", "driver.version=2.8.0", "input.voltage=230.0", "ups.status=OL"},
+			after: 0,
+		},
+		{
+			// Small wobbles are held back, and the runtime's too soon.
+			vars:  map[string]string{"input.voltage": "230.4", "battery.charge": "54", "battery.runtime": "590", "driver.name": "usbhid-ups", "driver.version": "2.8.0", "ups.status": "OL"},
+			after: 10 * time.Second,
+			want:  []string{},
+		},
+		{
+			// Creeping up counts from what we last published.
+			vars:  map[string]string{"input.voltage": "231.1", "battery.charge": "56", "battery.runtime": "590", "driver.name": "usbhid-ups", "driver.version": "2.8.1", "ups.status": "OB"},
+			after: 20 * time.Second,
+			want:  []string{"battery.charge=56", "driver.version=2.8.1", "input.voltage=231.1", "ups.status=OB"},
+		},
+		{
+			// The interval was up at 60s, but nothing goes out until the next poll after that, when the
+			// runtime it settled on does. Gone is gone, whatever the rules.
+			vars:  map[string]string{"input.voltage": "231.1", "battery.charge": "56", "battery.runtime": "590", "driver.name": "usbhid-ups", "driver.version": "2.8.1"},
+			after: 70 * time.Second,
+			want:  []string{"battery.runtime=590", "-ups.status"},
+		},
+	}
+	var published *channels.UPSInfo
+	for i, p := range polls {
+		var updates []*channels.UPSVariableUpdate
+		updates, published = f.Filter(published, ups(p.vars), start.Add(p.after))
+		if got := changed(updates); !reflect.DeepEqual(got, p.want) {
+			t.Errorf("poll %d: Filter() = %v, want %v", i, got, p.want)
+		}
+		for _, u := range updates {
+			if u.UpsID != "host1:3493/ups" || u.Host != "host1" || u.UpsName != "ups" {
+				t.Errorf("poll %d: update for %v has the wrong UPS: %+v", i, u.VarName, u)
+			}
+		}
+	}
+
+	// Excluding something we've already published clears it.
+	if err := f.SetConfig(config.FilterConfig{Exclude: []string{"input.*"}}); err != nil {
+		t.Fatalf("SetConfig() error = %v", err)
+	}
+	updates, _ := f.Filter(published, ups(polls[3].vars), start.Add(80*time.Second))
+	if got, want := changed(updates), []string{"driver.name=usbhid-ups", "-input.voltage"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after reload: Filter() = %v, want %v", got, want)
+	}
+}
+
+func TestVarFilterBadConfig(t *testing.T) {
+	for _, cfg := range []config.FilterConfig{
+		{Include: []string{"["}},
+		{Rules: []config.FilterRule{{Deadband: 1}}},
+		{Rules: []config.FilterRule{{Variable: "input.voltage", Deadband: -1}}},
+		{Rules: []config.FilterRule{{Variable: "input.voltage", MinInterval: "soon"}}},
+	} {
+		if err := NewVarFilter().SetConfig(cfg); err == nil {
+			t.Errorf("SetConfig(%+v) should have failed", cfg)
+		}
+	}
+}
+
+func TestHandleRequest(t *testing.T) {
+	c := NewController("bridge", time.Minute)
+	c.State().Set("host2:3493/ups", &channels.UPSInfo{ID: "host2:3493/ups"})
+	c.State().Set("host1:3493/ups", &channels.UPSInfo{ID: "host1:3493/ups"})
+	c.SetInstanceInfo(&InstanceInfo{ID: "nas", Version: "dev", Hostname: "nas.local", Started: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Hosts: []string{"localhost:3493"}, ClientIDs: map[string]string{"default": "nut2mqtt-nas"}})
+	tests := []struct {
+		req     string
+		want    string
+		wantErr bool
+	}{
+		{req: "ping", want: `{"status":"ok"}`},
+		{req: "ups\n", want: `["host1:3493/ups","host2:3493/ups"]`},
+		{req: "instance", want: `{"instance_id":"nas","version":"dev","hostname":"nas.local","started":"2024-01-02T03:04:05Z","hosts":["localhost:3493"],"client_ids":{"default":"nut2mqtt-nas"}}`},
+		{req: "nope", want: `{"error":"unknown request"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := c.HandleRequest(tt.req)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("HandleRequest(%q) error = %v, wantErr %v", tt.req, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("HandleRequest(%q) = %v, want %v", tt.req, got, tt.want)
+		}
+	}
+}
+
+func TestInstanceUpdate(t *testing.T) {
+	c := NewController("bridge", time.Minute)
+	c.SetInstanceInfo(&InstanceInfo{ID: "nas", Hosts: []string{}})
+	if got := c.InstanceTopic(); got != "bridge/instances/nas" {
+		t.Errorf("InstanceTopic() = %v, want bridge/instances/nas", got)
+	}
+	if u := c.instanceUpdate(true); !u.Retain || !strings.Contains(u.Content, `"instance_id":"nas"`) {
+		t.Errorf("instanceUpdate(true) = %+v, want retained instance info", u)
+	}
+	// Going away clears the retained message.
+	if u := c.instanceUpdate(false); !u.Retain || u.Content != "" {
+		t.Errorf("instanceUpdate(false) = %+v, want empty retained message", u)
+	}
+}
+
+func TestStandby(t *testing.T) {
+	c := NewController("bridge", time.Minute)
+	c.SetActive(false)
+	go func() {
+		for range c.cb.Metrics {
+		}
+	}()
+	got := []string{}
+	done := make(chan struct{})
+	go func() {
+		for up := range c.cb.MqttConverter {
+			got = append(got, up.VarName+"="+up.Content)
+		}
+		close(done)
+	}()
+
+	// Nothing goes to MQTT on standby.
+	c.EmitVariableUpdate(&channels.UPSVariableUpdate{VarName: "ups.status", Content: "OL"})
+	// Taking over publishes everything, whether it's changed or not.
+	c.SetActive(true)
+	select {
+	case <-c.resync:
+	default:
+		t.Errorf("becoming active should ask for a resync")
+	}
+	cache := map[string]*DecayingUPSCacheEntry{
+		"h:3493/ups": {ups: &channels.UPSInfo{ID: "h:3493/ups", Vars: map[string]string{"ups.status": "OL", "battery.charge": "100"}}},
+	}
+	c.republish(cache)
+	c.EmitVariableUpdate(&channels.UPSVariableUpdate{VarName: "ups.status", Content: "OB"})
+	close(c.cb.MqttConverter)
+	<-done
+	if want := []string{"battery.charge=100", "ups.status=OL", "ups.status=OB"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent to MQTT %v, want %v", got, want)
+	}
+}
+
+func TestUPSEvents(t *testing.T) {
+	ups := func(vars map[string]string) *channels.UPSInfo {
+		return &channels.UPSInfo{Host: "h", Name: "ups", ID: "h:3493/ups", Vars: vars}
+	}
+	summary := func(events []*journal.Event) []string {
+		ret := []string{}
+		for _, e := range events {
+			ret = append(ret, fmt.Sprintf("%v %v %v->%v %v", e.Type, e.Var, e.Old, e.New, e.Message))
+		}
+		return ret
+	}
+	tests := []struct {
+		name string
+		old  *channels.UPSInfo
+		new  *channels.UPSInfo
+		want []string
+	}{
+		{
+			name: "FirstSighting",
+			new:  ups(map[string]string{"ups.status": "OB"}),
+			want: []string{},
+		},
+		{
+			name: "PowerLost",
+			old:  ups(map[string]string{"ups.status": "OL CHRG"}),
+			new:  ups(map[string]string{"ups.status": "OB DISCHRG"}),
+			want: []string{
+				"power_lost ups.status OL CHRG->OB DISCHRG on battery",
+				"status_change ups.status OL CHRG->OB DISCHRG added [OB DISCHRG], removed [OL CHRG]",
+			},
+		},
+		{
+			name: "LowBattery",
+			old:  ups(map[string]string{"ups.status": "OB"}),
+			new:  ups(map[string]string{"ups.status": "OB LB", "ups.alarm": "Replace battery!"}),
+			want: []string{
+				"alert ups.status OB->OB LB status LB",
+				"status_change ups.status OB->OB LB added [LB], removed []",
+				"alert ups.alarm ->Replace battery! Replace battery!",
+			},
+		},
+		{
+			name: "PowerRestored",
+			old:  ups(map[string]string{"ups.status": "OB", "ups.load": "20"}),
+			new:  ups(map[string]string{"ups.status": "OL", "ups.load": "25", "ups.test.result": "Done and passed"}),
+			want: []string{
+				"power_restored ups.status OB->OL back on line power",
+				"status_change ups.status OB->OL added [OL], removed [OB]",
+				"variable_change ups.test.result ->Done and passed ",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := summary(UPSEvents(tt.old, tt.new, []string{"ups.test.*"}))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UPSEvents() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandEvent(t *testing.T) {
+	e := commandEvent(&channels.ControlMessage{Operation: "poll-now", Args: []string{"host1"}, Comment: "from MQTT"}, nil)
+	if e.Type != journal.Command || e.Message != "poll-now host1 (from MQTT): ok" {
+		t.Errorf("commandEvent() = %+v", e)
+	}
+	e = commandEvent(&channels.ControlMessage{Operation: "nope", Comment: "from MQTT"}, errors.New("unknown command"))
+	if e.Message != "nope (from MQTT): failed: unknown command" {
+		t.Errorf("commandEvent() = %+v", e)
+	}
+}
+
+func TestForgetMetrics(t *testing.T) {
+	c := NewController("bridge", time.Minute)
+	c.mr.EnableGenericExporter(nil, nil, false)
+	// Keeps MQTT out of it.
+	c.SetActive(false)
+	go c.MetricsUpdateConsumer()
+	u := &channels.UPSInfo{Host: "h", Port: 3493, Name: "ups", ID: "h:3493/ups"}
+	c.mr.Metrics().UPSUp.WithLabelValues(upsLabels(u)...).Set(1)
+	for i := 0; i < 10; i++ {
+		c.EmitVariableUpdate(&channels.UPSVariableUpdate{Host: "h", Port: 3493, UpsName: "ups", UpsID: u.ID, VarName: "battery.charge", Content: "100"})
+	}
+	c.forgetMetrics(u)
+	if n := testutil.CollectAndCount(c.mr.Registry(), "nut_variable"); n != 0 {
+		t.Errorf("nut_variable has %d series after forgetting the UPS, want 0", n)
+	}
+	if n := testutil.CollectAndCount(c.mr.Registry(), "ups_up"); n != 0 {
+		t.Errorf("ups_up has %d series after forgetting the UPS, want 0", n)
+	}
+}
+
+func TestQueueDepths(t *testing.T) {
+	c := NewController("bridge", time.Minute)
+	c.cb.Mqtt <- &channels.MQTTUpdate{Topic: "a"}
+	c.cb.Mqtt <- &channels.MQTTUpdate{Topic: "b"}
+	c.cb.Ups <- &channels.UPSInfo{}
+	depths := c.cb.QueueDepths()
+	for name, want := range map[string]int{"mqtt": 2, "ups": 1, "metrics": 0} {
+		if got := depths[name](); got != want {
+			t.Errorf("%v queue depth = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestFiltersOnlyApplyToMQTT(t *testing.T) {
+	c := NewController("bridge", time.Minute)
+	if err := c.SetFilters(config.FilterConfig{Rules: []config.FilterRule{{Variable: "input.voltage", Deadband: 1}}}); err != nil {
+		t.Fatalf("SetFilters() error = %v", err)
+	}
+	go c.UPSVariableUpdateMultiplexer()
+	poll := func(voltage, status string) {
+		c.cb.Ups <- &channels.UPSInfo{Name: "ups", Host: "h", Port: 3493, Vars: map[string]string{"input.voltage": voltage, "ups.status": status}}
+	}
+	// Only the variables we poll for; derived ones come along too.
+	wait := func(ch chan *channels.UPSVariableUpdate, want string) []string {
+		got := []string{}
+		for {
+			select {
+			case up := <-ch:
+				if up.VarName != "input.voltage" && up.VarName != "ups.status" {
+					continue
+				}
+				got = append(got, up.VarName+"="+up.Content)
+				if got[len(got)-1] == want {
+					return got
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for %v, got %v", want, got)
+			}
+		}
+	}
+	poll("230.0", "OL")
+	poll("230.4", "OL")
+	poll("230.4", "OB")
+	if got, want := wait(c.cb.Metrics, "ups.status=OB"), []string{"input.voltage=230.0", "ups.status=OL", "input.voltage=230.4", "ups.status=OB"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent to metrics %v, want %v", got, want)
+	}
+	if got, want := wait(c.cb.MqttConverter, "ups.status=OB"), []string{"input.voltage=230.0", "ups.status=OL", "ups.status=OB"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent to MQTT %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package control
+
+// User-defined derived variables, worked out from a UPS's other variables on every poll. They go through
+// filtering and diffing like anything from upsd, so they're only published when they change.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+)
+
+type derivedVar struct {
+	config.DerivedVariable
+	expr *Expression
+	meta *channels.VarMetadata
+}
+
+type DerivedVars struct {
+	mu   sync.RWMutex
+	vars []*derivedVar
+}
+
+func NewDerivedVars() *DerivedVars {
+	return &DerivedVars{}
+}
+
+func validVarName(name string) bool {
+	if name == "" || !isNameStart(name[0]) || name[len(name)-1] == '.' {
+		return false
+	}
+	for i := range name {
+		if !isNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func compileDerivedVars(cfg []config.DerivedVariable) ([]*derivedVar, error) {
+	ret := []*derivedVar{}
+	seen := map[string]bool{}
+	for i, d := range cfg {
+		if !validVarName(d.Name) {
+			return nil, fmt.Errorf("derived variable %d: bad name %q", i, d.Name)
+		}
+		if seen[d.Name] {
+			return nil, fmt.Errorf("derived variable %v: defined twice", d.Name)
+		}
+		seen[d.Name] = true
+		expr, err := ParseExpression(d.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("derived variable %v: %v", d.Name, err)
+		}
+		if d.Decimals != nil && (*d.Decimals < 0 || *d.Decimals > 10) {
+			return nil, fmt.Errorf("derived variable %v: decimals must be between 0 and 10", d.Name)
+		}
+		desc := d.Description
+		if desc == "" {
+			desc = d.Expression
+		}
+		ret = append(ret, &derivedVar{DerivedVariable: d, expr: expr, meta: &channels.VarMetadata{Description: desc, Type: "NUMBER", Unit: d.Unit}})
+	}
+	return ret, nil
+}
+
+// Check derived variables without using them, e.g. before applying a whole config file.
+func ValidateDerivedVariables(cfg []config.DerivedVariable) error {
+	_, err := compileDerivedVars(cfg)
+	return err
+}
+
+// Swap in new derived variables. If they're no good, we keep the old ones.
+func (d *DerivedVars) SetConfig(cfg []config.DerivedVariable) error {
+	vars, err := compileDerivedVars(cfg)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.vars = vars
+	return nil
+}
+
+func (v *derivedVar) appliesTo(u *channels.UPSInfo) bool {
+	if len(v.UPS) == 0 {
+		return true
+	}
+	for _, m := range v.UPS {
+		if UPSMatches(m, u) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *derivedVar) format(f float64) string {
+	if v.Decimals != nil {
+		return strconv.FormatFloat(f, 'f', *v.Decimals, 64)
+	}
+	// Enough to be useful, without 0.30000000000000004.
+	return strconv.FormatFloat(f, 'g', 12, 64)
+}
+
+// Add whichever derived variables we can work out to u. Anything missing an input is left out, so it's
+// cleared like any other variable that goes away.
+func (d *DerivedVars) Apply(u *channels.UPSInfo) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, v := range d.vars {
+		if _, ok := u.Vars[v.Name]; ok || !v.appliesTo(u) {
+			continue
+		}
+		f, err := v.expr.Eval(u.Vars)
+		if err != nil {
+			if !errors.Is(err, errMissingVar) {
+				logger.Debug("Can't work out derived variable", "ups", u.DisplayName(), "var", v.Name, "expression", v.Expression, "err", err)
+			}
+			continue
+		}
+		u.Vars[v.Name] = v.format(f)
+		if u.Meta == nil {
+			u.Meta = map[string]*channels.VarMetadata{}
+		}
+		u.Meta[v.Name] = v.meta
+	}
+}
+
+// Derived variables from the config file. Safe to call at any time.
+func (c Controller) SetDerivedVariables(cfg []config.DerivedVariable) error {
+	return c.derived.SetConfig(cfg)
+}
@@ -0,0 +1,67 @@
+package control
+
+import (
+	"testing"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+)
+
+func TestDerivedVars(t *testing.T) {
+	one := 1
+	d := NewDerivedVars()
+	err := d.SetConfig([]config.DerivedVariable{
+		{Name: "ups.load.watts", Expression: "ups.load / 100 * ups.realpower.nominal", Unit: "W"},
+		{Name: "battery.runtime.minutes", Expression: "battery.runtime / 60", Decimals: &one},
+		// Using one from above.
+		{Name: "ups.load.kw", Expression: "ups.load.watts / 1000"},
+		{Name: "input.watts", Expression: "input.voltage * input.current"},
+		{Name: "ups.status", Expression: "1"},
+		{Name: "rack.only", Expression: "2", UPS: []string{"rack/ups"}},
+	})
+	if err != nil {
+		t.Fatalf("SetConfig(): %v", err)
+	}
+	u := &channels.UPSInfo{Host: "nas", Port: 3493, Name: "ups", Vars: map[string]string{
+		"ups.load": "30", "ups.realpower.nominal": "900", "battery.runtime": "1000", "ups.status": "OL",
+	}}
+	d.Apply(u)
+	want := map[string]string{
+		"ups.load": "30", "ups.realpower.nominal": "900", "battery.runtime": "1000", "ups.status": "OL",
+		"ups.load.watts": "270", "battery.runtime.minutes": "16.7", "ups.load.kw": "0.27",
+	}
+	if len(u.Vars) != len(want) {
+		t.Errorf("Apply() vars = %v, want %v", u.Vars, want)
+	}
+	for k, v := range want {
+		if u.Vars[k] != v {
+			t.Errorf("%v = %q, want %q", k, u.Vars[k], v)
+		}
+	}
+	if m := u.Meta["ups.load.watts"]; m == nil || m.Unit != "W" || m.Description == "" {
+		t.Errorf("ups.load.watts metadata = %+v", m)
+	}
+	if _, ok := u.Meta["ups.status"]; ok {
+		t.Errorf("NUT's own ups.status shouldn't have been overridden")
+	}
+}
+
+func TestDerivedVarsConfig(t *testing.T) {
+	eleven := 11
+	for _, cfg := range [][]config.DerivedVariable{
+		{{Name: "", Expression: "1"}},
+		{{Name: "bad name", Expression: "1"}},
+		{{Name: "trailing.", Expression: "1"}},
+		{{Name: "x", Expression: "1 +"}},
+		{{Name: "x", Expression: "1"}, {Name: "x", Expression: "2"}},
+		{{Name: "x", Expression: "1", Decimals: &eleven}},
+	} {
+		d := NewDerivedVars()
+		if err := d.SetConfig(cfg); err == nil {
+			t.Errorf("SetConfig(%+v) should fail", cfg)
+		}
+		if err := ValidateDerivedVariables(cfg); err == nil {
+			t.Errorf("ValidateDerivedVariables(%+v) should fail", cfg)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package control
+
+// Working out how much power each UPS is putting out, when it doesn't just tell us, and adding that up into
+// energy over time. Energy totals are saved to a file, so they keep going up across restarts.
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+)
+
+// The variables we add to each UPS, alongside what upsd tells us.
+const (
+	DerivedRealPowerVar     = "derived.realpower"
+	DerivedApparentPowerVar = "derived.power"
+	DerivedEnergyVar        = "derived.energy"
+)
+
+var derivedMeta = map[string]*channels.VarMetadata{
+	DerivedRealPowerVar:     {Description: "Real power output (derived)", Type: "NUMBER", Unit: "W"},
+	DerivedApparentPowerVar: {Description: "Apparent power output (derived)", Type: "NUMBER", Unit: "VA"},
+	DerivedEnergyVar:        {Description: "Energy output since we started counting (derived)", Type: "NUMBER", Unit: "kWh"},
+}
+
+func varFloat(vars map[string]string, name string) (float64, bool) {
+	v, ok := vars[name]
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return f, err == nil
+}
+
+type Power struct {
+	Watts     float64
+	HaveWatts bool
+	VA        float64
+	HaveVA    bool
+}
+
+// Power output, from whatever the UPS reports, best first:
+//   - W: ups.realpower, ups.load of ups.realpower.nominal, or VA scaled by ups.realpower.nominal/ups.power.nominal
+//   - VA: ups.power, ups.load of ups.power.nominal, or output.voltage * output.current
+func UPSPower(vars map[string]string) Power {
+	var p Power
+	load, have_load := varFloat(vars, "ups.load")
+	real_nominal, have_real_nominal := varFloat(vars, "ups.realpower.nominal")
+	nominal, have_nominal := varFloat(vars, "ups.power.nominal")
+
+	if va, ok := varFloat(vars, "ups.power"); ok {
+		p.VA, p.HaveVA = va, true
+	} else if have_load && have_nominal {
+		p.VA, p.HaveVA = load*nominal/100, true
+	} else if v, ok := varFloat(vars, "output.voltage"); ok {
+		if i, ok := varFloat(vars, "output.current"); ok {
+			p.VA, p.HaveVA = v*i, true
+		}
+	}
+
+	if w, ok := varFloat(vars, "ups.realpower"); ok {
+		p.Watts, p.HaveWatts = w, true
+	} else if have_load && have_real_nominal {
+		p.Watts, p.HaveWatts = load*real_nominal/100, true
+	} else if p.HaveVA && have_real_nominal && have_nominal && nominal > 0 {
+		p.Watts, p.HaveWatts = p.VA*real_nominal/nominal, true
+	}
+	return p
+}
+
+type energyTotal struct {
+	Host string `json:"host"`
+	UPS  string `json:"ups"`
+	// kWh
+	Energy float64 `json:"energy_kwh"`
+
+	last_watts float64
+	last_time  time.Time
+	// Whether we've added it to the prometheus counter yet, this run.
+	exported bool
+}
+
+// Adds up energy per UPS, from power readings at each poll.
+type EnergyMeter struct {
+	mu     sync.Mutex
+	totals map[string]*energyTotal
+	// Don't count across gaps in readings longer than this, as we've no idea what happened.
+	max_gap time.Duration
+	// Where to save totals. Empty for nowhere.
+	path       string
+	last_saved time.Time
+}
+
+func NewEnergyMeter(max_gap time.Duration) *EnergyMeter {
+	return &EnergyMeter{totals: map[string]*energyTotal{}, max_gap: max_gap}
+}
+
+// Save totals to path, and pick up where we left off if it's already there.
+func (m *EnergyMeter) Load(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.path = path
+	in, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(in, &m.totals)
+}
+
+// Write totals out, if we've somewhere to put them. Written to a temporary file first, so a crash
+// part way through doesn't lose everything.
+func (m *EnergyMeter) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.save(time.Now())
+}
+
+func (m *EnergyMeter) save(now time.Time) error {
+	if m.path == "" {
+		return nil
+	}
+	out, err := json.MarshalIndent(m.totals, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	m.last_saved = now
+	return os.Rename(tmp.Name(), m.path)
+}
+
+// Take in a power reading for a UPS, returning its total (kWh) and how much that's gone up by since we last
+// said (which, the first time, is the whole saved total). Going by the average of this reading and the last.
+func (m *EnergyMeter) Observe(u *channels.UPSInfo, watts float64, now time.Time) (total float64, added float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totals[u.ID]
+	if !ok {
+		t = &energyTotal{}
+		m.totals[u.ID] = t
+	}
+	t.Host, t.UPS = u.Host, u.DisplayName()
+	if !t.last_time.IsZero() {
+		if gap := now.Sub(t.last_time); gap > 0 && (m.max_gap <= 0 || gap <= m.max_gap) {
+			added = (t.last_watts + watts) / 2 * gap.Hours() / 1000
+			t.Energy += added
+		}
+	}
+	if !t.exported {
+		added = t.Energy
+		t.exported = true
+	}
+	t.last_watts, t.last_time = watts, now
+	// Every minute's plenty.
+	if now.Sub(m.last_saved) > time.Minute {
+		if err := m.save(now); err != nil {
+			logger.Error("Error saving energy totals", "file", m.path, "err", err)
+		}
+	}
+	return t.Energy, added
+}
+
+// Stop counting for a UPS that's gone away, without losing its total. If it comes back, its counter starts
+// again from the saved total, as the old series will have been deleted.
+func (m *EnergyMeter) ForgetUPS(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.totals[id]; ok {
+		t.last_time = time.Time{}
+		t.exported = false
+	}
+}
+
+// Total energy (kWh) for a UPS, if we've been counting it.
+func (m *EnergyMeter) Total(id string) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totals[id]
+	if !ok {
+		return 0, false
+	}
+	return t.Energy, true
+}
+
+// Keep energy totals in path, carrying on from whatever's there already. Set before starting the multiplexer.
+func (c Controller) SetEnergyStateFile(path string) error {
+	return c.energy.Load(path)
+}
+
+// Save energy totals now, e.g. on the way out.
+func (c Controller) SaveEnergy() error {
+	return c.energy.Save()
+}
+
+// Add derived power and energy variables to a UPS, where we can work them out.
+func (c Controller) addDerivedVars(u *channels.UPSInfo, now time.Time) {
+	p := UPSPower(u.Vars)
+	add := func(name string, value string) {
+		u.Vars[name] = value
+		if u.Meta == nil {
+			u.Meta = map[string]*channels.VarMetadata{}
+		}
+		u.Meta[name] = derivedMeta[name]
+	}
+	if p.HaveVA {
+		add(DerivedApparentPowerVar, strconv.FormatFloat(p.VA, 'f', 1, 64))
+		c.mr.Metrics().UPSPowerVA.WithLabelValues(upsLabels(u)...).Set(p.VA)
+	}
+	if !p.HaveWatts {
+		return
+	}
+	add(DerivedRealPowerVar, strconv.FormatFloat(p.Watts, 'f', 1, 64))
+	c.mr.Metrics().UPSPowerWatts.WithLabelValues(upsLabels(u)...).Set(p.Watts)
+	total, added := c.energy.Observe(u, p.Watts, now)
+	add(DerivedEnergyVar, strconv.FormatFloat(total, 'f', 4, 64))
+	c.mr.Metrics().UPSEnergy.WithLabelValues(upsLabels(u)...).Add(added)
+}
@@ -0,0 +1,115 @@
+package control
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+)
+
+func TestUPSPower(t *testing.T) {
+	for _, tt := range []struct {
+		vars map[string]string
+		want Power
+	}{
+		{
+			vars: map[string]string{"ups.realpower": "150", "ups.power": "200", "ups.load": "50", "ups.realpower.nominal": "1000"},
+			want: Power{Watts: 150, HaveWatts: true, VA: 200, HaveVA: true},
+		},
+		{
+			vars: map[string]string{"ups.load": "50", "ups.realpower.nominal": "1000", "ups.power.nominal": "1500"},
+			want: Power{Watts: 500, HaveWatts: true, VA: 750, HaveVA: true},
+		},
+		// VA from the output, then scaled down to W by the nominal power factor.
+		{
+			vars: map[string]string{"output.voltage": "230", "output.current": "2", "ups.realpower.nominal": "900", "ups.power.nominal": "1500"},
+			want: Power{Watts: 276, HaveWatts: true, VA: 460, HaveVA: true},
+		},
+		{
+			vars: map[string]string{"output.voltage": "230", "output.current": "2"},
+			want: Power{VA: 460, HaveVA: true},
+		},
+		{vars: map[string]string{"ups.load": "50"}},
+		{vars: map[string]string{"ups.realpower": "lots"}},
+	} {
+		if got := UPSPower(tt.vars); got != tt.want {
+			t.Errorf("UPSPower(%v) = %+v, want %+v", tt.vars, got, tt.want)
+		}
+	}
+}
+
+func TestEnergyMeter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "energy.json")
+	u := &channels.UPSInfo{ID: "h:3493/ups", Host: "h", Name: "ups"}
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	m := NewEnergyMeter(2 * time.Minute)
+	if err := m.Load(path); err != nil {
+		t.Fatalf("Load() of a missing file: %v", err)
+	}
+	steps := []struct {
+		after      time.Duration
+		watts      float64
+		want_total float64
+		want_added float64
+	}{
+		{after: 0, watts: 100},
+		// 100W to 200W over a minute averages 150W, i.e. 2.5Wh.
+		{after: time.Minute, watts: 200, want_total: 0.0025, want_added: 0.0025},
+		{after: 2 * time.Minute, watts: 200, want_total: 0.0025 + 200.0/60/1000, want_added: 200.0 / 60 / 1000},
+		// Too long a gap to guess about.
+		{after: 10 * time.Minute, watts: 200, want_total: 0.0025 + 200.0/60/1000},
+	}
+	for i, s := range steps {
+		total, added := m.Observe(u, s.watts, start.Add(s.after))
+		if math.Abs(total-s.want_total) > 1e-9 || math.Abs(added-s.want_added) > 1e-9 {
+			t.Errorf("step %d: Observe() = %v, %v, want %v, %v", i, total, added, s.want_total, s.want_added)
+		}
+	}
+	if err := m.Save(); err != nil {
+		t.Fatalf("Save(): %v", err)
+	}
+
+	// Carrying on after a restart, the whole total gets added to the (new) counter the first time round.
+	want := steps[len(steps)-1].want_total
+	m = NewEnergyMeter(2 * time.Minute)
+	if err := m.Load(path); err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	if got, ok := m.Total(u.ID); !ok || math.Abs(got-want) > 1e-9 {
+		t.Errorf("Total() after Load() = %v, %v, want %v", got, ok, want)
+	}
+	if total, added := m.Observe(u, 200, start.Add(time.Hour)); math.Abs(total-want) > 1e-9 || math.Abs(added-want) > 1e-9 {
+		t.Errorf("first Observe() after Load() = %v, %v, want %v, %v", total, added, want, want)
+	}
+	if _, added := m.Observe(u, 200, start.Add(time.Hour+time.Minute)); math.Abs(added-200.0/60/1000) > 1e-9 {
+		t.Errorf("second Observe() after Load() added %v", added)
+	}
+
+	// Forgetting a UPS keeps its total, but starts its counter again.
+	m.ForgetUPS(u.ID)
+	total, _ := m.Total(u.ID)
+	if _, added := m.Observe(u, 200, start.Add(time.Hour+2*time.Minute)); added != total {
+		t.Errorf("Observe() after ForgetUPS() added %v, want %v", added, total)
+	}
+}
+
+func TestAddDerivedVars(t *testing.T) {
+	c := NewController("bridge", time.Minute)
+	u := &channels.UPSInfo{ID: "h:3493/ups", Host: "h", Name: "ups", Vars: map[string]string{"ups.load": "25", "ups.realpower.nominal": "800"}}
+	c.addDerivedVars(u, time.Now())
+	if got := u.Vars[DerivedRealPowerVar]; got != "200.0" {
+		t.Errorf("%v = %q, want 200.0", DerivedRealPowerVar, got)
+	}
+	if got := u.Vars[DerivedEnergyVar]; got != "0.0000" {
+		t.Errorf("%v = %q, want 0.0000", DerivedEnergyVar, got)
+	}
+	if _, ok := u.Vars[DerivedApparentPowerVar]; ok {
+		t.Errorf("got %v without anything to work it out from", DerivedApparentPowerVar)
+	}
+	if m := u.Meta[DerivedEnergyVar]; m == nil || m.Unit != "kWh" {
+		t.Errorf("%v metadata = %+v, want kWh", DerivedEnergyVar, m)
+	}
+}
@@ -0,0 +1,131 @@
+package control
+
+// Spotting the things worth putting in the journal: power going and coming back, status flags changing, alerts.
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	journal "github.com/gerrowadat/nut2mqtt/internal/journal"
+)
+
+// Status flags that are worth shouting about when they turn up.
+var alertFlags = map[string]bool{"LB": true, "RB": true, "OVER": true, "FSD": true, "ALARM": true}
+
+// Where to record events, and whether to publish them on <control topic>/events too. Set before starting anything.
+func (c *Controller) SetJournal(j *journal.Journal, publish bool) {
+	c.journal = j
+	c.publish_events = publish
+}
+
+// Variables (globs) whose every change goes in the journal, on top of status and alarms.
+func (c *Controller) SetJournalVariables(vars []string) {
+	c.journal_vars = vars
+}
+
+func (c Controller) Journal() *journal.Journal {
+	return c.journal
+}
+
+func (c Controller) EventsTopic() string {
+	return c.mqtt_topic + "/events"
+}
+
+func (c Controller) record(e *journal.Event) {
+	if err := c.journal.Add(e); err != nil {
+		logger.Error("Error writing to journal", "type", e.Type, "err", err)
+	}
+	if c.publish_events && c.publishing() {
+		out, _ := json.Marshal(e)
+		c.cb.Mqtt <- &channels.MQTTUpdate{Topic: c.EventsTopic(), Content: string(out), ContentType: "application/json"}
+	}
+}
+
+func statusFlags(status string) map[string]bool {
+	ret := map[string]bool{}
+	for _, f := range strings.Fields(status) {
+		ret[f] = true
+	}
+	return ret
+}
+
+// What's happened between two sightings of a UPS. Nothing for a UPS we've not seen before, as we don't know
+// what it was doing.
+func UPSEvents(old *channels.UPSInfo, u *channels.UPSInfo, vars []string) []*journal.Event {
+	ret := []*journal.Event{}
+	if old == nil {
+		return ret
+	}
+	event := func(t string, varname string, message string) *journal.Event {
+		return &journal.Event{Type: t, Host: u.Host, UPS: u.DisplayName(), UPSID: u.ID, Var: varname, Old: old.Vars[varname], New: u.Vars[varname], Message: message}
+	}
+	if old_status, status := old.Vars["ups.status"], u.Vars["ups.status"]; old_status != status {
+		was, is := statusFlags(old_status), statusFlags(status)
+		if is["OB"] && !was["OB"] {
+			ret = append(ret, event(journal.PowerLost, "ups.status", "on battery"))
+		}
+		if was["OB"] && !is["OB"] && is["OL"] {
+			ret = append(ret, event(journal.PowerRestored, "ups.status", "back on line power"))
+		}
+		added, removed := []string{}, []string{}
+		for _, f := range strings.Fields(status) {
+			if !was[f] {
+				added = append(added, f)
+				if alertFlags[f] {
+					ret = append(ret, event(journal.Alert, "ups.status", fmt.Sprintf("status %v", f)))
+				}
+			}
+		}
+		for _, f := range strings.Fields(old_status) {
+			if !is[f] {
+				removed = append(removed, f)
+			}
+		}
+		ret = append(ret, event(journal.StatusChange, "ups.status", fmt.Sprintf("added %v, removed %v", added, removed)))
+	}
+	if alarm := u.Vars["ups.alarm"]; alarm != "" && alarm != old.Vars["ups.alarm"] {
+		ret = append(ret, event(journal.Alert, "ups.alarm", alarm))
+	}
+	for _, k := range sortedKeys(u.Vars, old.Vars) {
+		if u.Vars[k] == old.Vars[k] || k == "ups.status" || k == "ups.alarm" {
+			continue
+		}
+		for _, pat := range vars {
+			if ok, _ := path.Match(pat, k); ok {
+				ret = append(ret, event(journal.VariableChange, k, ""))
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// Every key in any of the maps, sorted.
+func sortedKeys(maps ...map[string]string) []string {
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, m := range maps {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				ret = append(ret, k)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// What to say in the journal about a control message.
+func commandEvent(msg *channels.ControlMessage, err error) *journal.Event {
+	cmd := strings.TrimSpace(msg.Operation + " " + strings.Join(msg.Args, " "))
+	result := "ok"
+	if err != nil {
+		result = "failed: " + err.Error()
+	}
+	return &journal.Event{Type: journal.Command, Message: fmt.Sprintf("%v (%v): %v", cmd, msg.Comment, result)}
+}
@@ -0,0 +1,321 @@
+package control
+
+// A very small expression language for derived variables, e.g. ups.load / 100 * ups.realpower.nominal.
+// Numbers, NUT variable names, + - * / %, brackets and a few functions. Everything's a float.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	// An input isn't there, or isn't a number. Not worth logging about, as plenty of UPSes don't report everything.
+	errMissingVar   = errors.New("missing variable")
+	errDivideByZero = errors.New("division by zero")
+)
+
+type exprFunc struct {
+	min_args, max_args int
+	f                  func(args []float64) float64
+}
+
+var exprFuncs = map[string]exprFunc{
+	"abs":   {1, 1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"ceil":  {1, 1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"floor": {1, 1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"min":   {1, -1, func(a []float64) float64 { return minMax(a, math.Min) }},
+	"max":   {1, -1, func(a []float64) float64 { return minMax(a, math.Max) }},
+	// round(x) or round(x, decimal places)
+	"round": {1, 2, func(a []float64) float64 {
+		if len(a) == 1 {
+			return math.Round(a[0])
+		}
+		p := math.Pow(10, math.Round(a[1]))
+		return math.Round(a[0]*p) / p
+	}},
+}
+
+func minMax(a []float64, f func(float64, float64) float64) float64 {
+	ret := a[0]
+	for _, v := range a[1:] {
+		ret = f(ret, v)
+	}
+	return ret
+}
+
+type exprNode interface {
+	eval(vars map[string]string) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(vars map[string]string) (float64, error) {
+	return float64(n), nil
+}
+
+type varNode string
+
+func (n varNode) eval(vars map[string]string) (float64, error) {
+	v, ok := varFloat(vars, string(n))
+	if !ok {
+		return 0, errMissingVar
+	}
+	return v, nil
+}
+
+type negNode struct{ x exprNode }
+
+func (n negNode) eval(vars map[string]string) (float64, error) {
+	v, err := n.x.eval(vars)
+	return -v, err
+}
+
+type binaryNode struct {
+	op   byte
+	l, r exprNode
+}
+
+func (n binaryNode) eval(vars map[string]string) (float64, error) {
+	l, err := n.l.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.r.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	case '/':
+		if r == 0 {
+			return 0, errDivideByZero
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return 0, errDivideByZero
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+type callNode struct {
+	f    exprFunc
+	args []exprNode
+}
+
+func (n callNode) eval(vars map[string]string) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return n.f.f(args), nil
+}
+
+type Expression struct {
+	src  string
+	root exprNode
+	vars []string
+}
+
+func (e *Expression) String() string {
+	return e.src
+}
+
+// The variables the expression uses.
+func (e *Expression) Vars() []string {
+	return e.vars
+}
+
+// Work it out from a UPS's variables.
+func (e *Expression) Eval(vars map[string]string) (float64, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+	return v, nil
+}
+
+type exprParser struct {
+	src  string
+	pos  int
+	vars []string
+}
+
+func ParseExpression(src string) (*Expression, error) {
+	p := &exprParser{src: src}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return &Expression{src: src, root: root, vars: p.vars}, nil
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("bad expression %q at %d: %v", p.src, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) space() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// The next character, after any spaces, or 0 at the end.
+func (p *exprParser) peek() byte {
+	p.space()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) expr() (exprNode, error) {
+	l, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) term() (exprNode, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/' || op == '%'; op = p.peek() {
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negNode{x}, nil
+	}
+	return p.primary()
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || c == '.' || (c >= '0' && c <= '9')
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return x, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("bad number")
+		}
+		return numberNode(f), nil
+	case isNameStart(c):
+		start := p.pos
+		for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() == '(' {
+			return p.call(name)
+		}
+		if strings.HasSuffix(name, ".") {
+			p.pos = start
+			return nil, p.errorf("bad variable name %q", name)
+		}
+		p.vars = append(p.vars, name)
+		return varNode(name), nil
+	case c == 0:
+		return nil, p.errorf("unexpected end")
+	default:
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+func (p *exprParser) call(name string) (exprNode, error) {
+	f, ok := exprFuncs[name]
+	if !ok {
+		return nil, p.errorf("no function %v", name)
+	}
+	// Past the (
+	p.pos++
+	args := []exprNode{}
+	if p.peek() != ')' {
+		for {
+			a, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+	}
+	if p.peek() != ')' {
+		return nil, p.errorf("missing ) after %v arguments", name)
+	}
+	p.pos++
+	if len(args) < f.min_args || (f.max_args >= 0 && len(args) > f.max_args) {
+		return nil, p.errorf("wrong number of arguments to %v", name)
+	}
+	return callNode{f: f, args: args}, nil
+}
@@ -0,0 +1,69 @@
+package control
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExpression(t *testing.T) {
+	vars := map[string]string{
+		"ups.load":              "25",
+		"ups.realpower.nominal": "800",
+		"battery.runtime":       "1830",
+		"outlet.1.status":       "on",
+		"zero":                  "0",
+	}
+	for _, tt := range []struct {
+		src      string
+		want     float64
+		want_err error
+		uses     []string
+	}{
+		{src: "ups.load / 100 * ups.realpower.nominal", want: 200, uses: []string{"ups.load", "ups.realpower.nominal"}},
+		{src: "battery.runtime / 60", want: 30.5, uses: []string{"battery.runtime"}},
+		{src: "floor(battery.runtime / 60)", want: 30, uses: []string{"battery.runtime"}},
+		{src: "round(battery.runtime / 7, 2)", want: 261.43, uses: []string{"battery.runtime"}},
+		{src: "1 + 2 * 3", want: 7},
+		{src: "(1 + 2) * 3", want: 9},
+		{src: "-ups.load - -5", want: -20, uses: []string{"ups.load"}},
+		{src: "10 % 4", want: 2},
+		{src: "max(1, ups.load, 3) + min(4, 5)", want: 29, uses: []string{"ups.load"}},
+		{src: "abs(-.5)", want: 0.5},
+		{src: "input.voltage * 2", want_err: errMissingVar, uses: []string{"input.voltage"}},
+		{src: "outlet.1.status + 1", want_err: errMissingVar, uses: []string{"outlet.1.status"}},
+		{src: "ups.load / zero", want_err: errDivideByZero, uses: []string{"ups.load", "zero"}},
+	} {
+		e, err := ParseExpression(tt.src)
+		if err != nil {
+			t.Errorf("ParseExpression(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := e.Eval(vars)
+		if !errors.Is(err, tt.want_err) || got != tt.want {
+			t.Errorf("%q = %v, %v, want %v, %v", tt.src, got, err, tt.want, tt.want_err)
+		}
+		if len(tt.uses) > 0 && !reflect.DeepEqual(e.Vars(), tt.uses) {
+			t.Errorf("%q uses %v, want %v", tt.src, e.Vars(), tt.uses)
+		}
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"ups.load ups.power",
+		"nope(1)",
+		"round()",
+		"round(1, 2, 3)",
+		"ups.load.",
+		"1.2.3",
+		"ups.load $ 2",
+	} {
+		if _, err := ParseExpression(src); err == nil {
+			t.Errorf("ParseExpression(%q) should fail", src)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package control
+
+// Deciding which variable changes are worth passing on.
+// We keep what we last published for each UPS, and diff against that rather than the last poll,
+// so a value creeping up 0.1V at a time still gets published once it's gone far enough, and a
+// value held back by a minimum interval gets published once the interval is up.
+// There's no timer for that: it goes out with the first poll after the interval's up.
+// This only decides what goes to MQTT. Metrics get every change regardless.
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+)
+
+type filterRule struct {
+	config.FilterRule
+	min_interval time.Duration
+}
+
+type VarFilter struct {
+	mu      sync.Mutex
+	include []string
+	exclude []string
+	rules   []*filterRule
+	// When we last published each variable, by UPS ID and variable.
+	last_published map[[2]string]time.Time
+}
+
+func NewVarFilter() *VarFilter {
+	return &VarFilter{last_published: map[[2]string]time.Time{}}
+}
+
+func compileFilterRules(cfg config.FilterConfig) ([]*filterRule, error) {
+	ret := []*filterRule{}
+	for _, pat := range append(append([]string{}, cfg.Include...), cfg.Exclude...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return nil, fmt.Errorf("bad variable glob %v: %v", pat, err)
+		}
+	}
+	for i, r := range cfg.Rules {
+		fr := &filterRule{FilterRule: r}
+		if r.Variable == "" {
+			return nil, fmt.Errorf("filter rule %d: no variable", i)
+		}
+		if _, err := path.Match(r.Variable, ""); err != nil {
+			return nil, fmt.Errorf("filter rule %d: bad variable glob %v: %v", i, r.Variable, err)
+		}
+		if r.Deadband < 0 || r.DeadbandPercent < 0 {
+			return nil, fmt.Errorf("filter rule %d: negative deadband", i)
+		}
+		if r.MinInterval != "" {
+			d, err := time.ParseDuration(r.MinInterval)
+			if err != nil {
+				return nil, fmt.Errorf("filter rule %d: bad min_interval: %v", i, err)
+			}
+			fr.min_interval = d
+		}
+		ret = append(ret, fr)
+	}
+	return ret, nil
+}
+
+// Check filters without using them, e.g. before applying a whole config file.
+func ValidateFilters(cfg config.FilterConfig) error {
+	_, err := compileFilterRules(cfg)
+	return err
+}
+
+// Swap in new filters. If they're no good, we keep the old ones.
+func (f *VarFilter) SetConfig(cfg config.FilterConfig) error {
+	rules, err := compileFilterRules(cfg)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.include = cfg.Include
+	f.exclude = cfg.Exclude
+	f.rules = rules
+	return nil
+}
+
+func matchesAny(pats []string, varname string) bool {
+	for _, pat := range pats {
+		if ok, _ := path.Match(pat, varname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *VarFilter) rule(varname string) *filterRule {
+	for _, r := range f.rules {
+		if ok, _ := path.Match(r.Variable, varname); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// Whether we want this variable at all.
+func (f *VarFilter) wants(varname string, r *filterRule) bool {
+	if r != nil && r.Always {
+		return true
+	}
+	if matchesAny(f.exclude, varname) {
+		return false
+	}
+	return len(f.include) == 0 || matchesAny(f.include, varname)
+}
+
+// Whether a change from the last published value is within the rule's deadbands.
+func withinDeadband(r *filterRule, published string, current string) bool {
+	if r.Deadband == 0 && r.DeadbandPercent == 0 {
+		return false
+	}
+	old_f, err := strconv.ParseFloat(published, 64)
+	if err != nil {
+		return false
+	}
+	new_f, err := strconv.ParseFloat(current, 64)
+	if err != nil {
+		return false
+	}
+	delta := math.Abs(new_f - old_f)
+	// A change has to get past every deadband that's set.
+	if r.Deadband > 0 && delta < r.Deadband {
+		return true
+	}
+	if r.DeadbandPercent > 0 && delta < math.Abs(old_f)*r.DeadbandPercent/100 {
+		return true
+	}
+	return false
+}
+
+// Work out what to publish for u, given what we published last time (nil if nothing).
+// Returns the updates to emit, and the new published view of the UPS to pass in next time.
+func (f *VarFilter) Filter(published *channels.UPSInfo, u *channels.UPSInfo, now time.Time) ([]*channels.UPSVariableUpdate, *channels.UPSInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	next := &channels.UPSInfo{Name: u.Name, Host: u.Host, Port: u.Port, ID: u.ID, Alias: u.Alias, TopicTemplate: u.TopicTemplate, Description: u.Description, Vars: map[string]string{}, Meta: map[string]*channels.VarMetadata{}}
+	if published != nil {
+		for k, v := range published.Vars {
+			next.Vars[k] = v
+		}
+		for k, v := range published.Meta {
+			next.Meta[k] = v
+		}
+	}
+	ret := []*channels.UPSVariableUpdate{}
+	// Anything excluded since we published it gets cleared, as if it had gone away.
+	wanted := &channels.UPSInfo{Name: u.Name, Host: u.Host, Port: u.Port, ID: u.ID, Alias: u.Alias, TopicTemplate: u.TopicTemplate, Vars: map[string]string{}, Meta: u.Meta}
+	for k, v := range u.Vars {
+		if f.wants(k, f.rule(k)) {
+			wanted.Vars[k] = v
+		}
+	}
+	for _, chg := range DiffUPS(published, wanted) {
+		key := [2]string{u.ID, chg.VarName}
+		_, was_published := next.Vars[chg.VarName]
+		r := f.rule(chg.VarName)
+		if chg.Removed {
+			delete(next.Vars, chg.VarName)
+			delete(next.Meta, chg.VarName)
+			delete(f.last_published, key)
+			ret = append(ret, chg)
+			continue
+		}
+		// New variables and new metadata always go out. Otherwise, it's up to the rule.
+		if was_published && chg.Content != chg.OldContent && r != nil && !r.Always {
+			if r.min_interval > 0 && now.Sub(f.last_published[key]) < r.min_interval {
+				continue
+			}
+			if withinDeadband(r, chg.OldContent, chg.Content) {
+				continue
+			}
+		}
+		next.Vars[chg.VarName] = chg.Content
+		if chg.Meta != nil {
+			next.Meta[chg.VarName] = chg.Meta
+		}
+		f.last_published[key] = now
+		ret = append(ret, chg)
+	}
+	return ret, next
+}
+
+// Drop what we know about a UPS, e.g. once it's dropped out of the cache.
+func (f *VarFilter) ForgetUPS(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k := range f.last_published {
+		if k[0] == id {
+			delete(f.last_published, k)
+		}
+	}
+}
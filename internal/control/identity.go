@@ -0,0 +1,90 @@
+package control
+
+// Working out which UPS is which, and what to call it.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+)
+
+type UPSIdentifier struct {
+	mu sync.RWMutex
+	// Key UPSes by serial number where they have one, so they survive being renamed or moved between hosts.
+	by_serial bool
+	ups       []config.UPSConfig
+}
+
+func NewUPSIdentifier(by_serial bool) *UPSIdentifier {
+	return &UPSIdentifier{by_serial: by_serial}
+}
+
+// Swap in new per-UPS config, e.g. on reload.
+func (i *UPSIdentifier) SetUPSConfig(ups []config.UPSConfig) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.ups = ups
+}
+
+// Check per-UPS config. Two UPSes with the same alias would share topics and metric series, so that's not allowed.
+func ValidateUPSConfig(ups []config.UPSConfig) error {
+	aliases := map[string]string{}
+	for _, u := range ups {
+		if u.Alias == "" {
+			continue
+		}
+		if other, ok := aliases[u.Alias]; ok {
+			return fmt.Errorf("ups %v: alias %q is already used by %v", u.Match, u.Alias, other)
+		}
+		aliases[u.Alias] = u.Match
+	}
+	return nil
+}
+
+// host:port/name
+func UPSAddress(u *channels.UPSInfo) string {
+	return fmt.Sprintf("%v:%v/%v", u.Host, u.Port, u.Name)
+}
+
+// Whether a config match string (host:port/name, host/name or serial:<serial>) refers to this UPS.
+func UPSMatches(match string, u *channels.UPSInfo) bool {
+	if serial, ok := strings.CutPrefix(match, "serial:"); ok {
+		return serial != "" && serial == u.Serial()
+	}
+	if match == UPSAddress(u) {
+		return true
+	}
+	return match == u.Host+"/"+u.Name
+}
+
+// The config for this UPS, if there is any.
+func (i *UPSIdentifier) Config(u *channels.UPSInfo) *config.UPSConfig {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for n := range i.ups {
+		if UPSMatches(i.ups[n].Match, u) {
+			ret := i.ups[n]
+			return &ret
+		}
+	}
+	return nil
+}
+
+// Fill in ID, Alias, TopicTemplate and NUTName.
+func (i *UPSIdentifier) Identify(u *channels.UPSInfo) {
+	u.ID = UPSAddress(u)
+	if serial := u.Serial(); i.by_serial && serial != "" {
+		u.ID = "serial:" + serial
+	}
+	u.Alias = ""
+	u.TopicTemplate = ""
+	u.NUTName = ""
+	if cfg := i.Config(u); cfg != nil {
+		u.Alias = cfg.Alias
+		u.TopicTemplate = cfg.TopicTemplate
+		u.NUTName = cfg.NUTName
+	}
+}
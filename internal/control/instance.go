@@ -0,0 +1,58 @@
+package control
+
+// Telling apart several bridges publishing to the same broker.
+
+import (
+	"encoding/json"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+)
+
+// What we publish (retained) on <control topic>/instances/<ID>. Cleared on a clean shutdown only, as our will
+// is StateTopic, so if we die this stays put until we're back.
+type InstanceInfo struct {
+	ID       string    `json:"instance_id"`
+	Version  string    `json:"version"`
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
+	// upsd host:port we poll.
+	Hosts []string `json:"hosts"`
+	// MQTT client ID, by output.
+	ClientIDs map[string]string `json:"client_ids"`
+	// Active/standby group, if we're in one.
+	HAGroup string `json:"ha_group,omitempty"`
+}
+
+// Set before starting ControlMessageConsumer.
+func (c *Controller) SetInstanceInfo(info *InstanceInfo) {
+	c.instance = info
+}
+
+func (c Controller) InstanceInfo() *InstanceInfo {
+	return c.instance
+}
+
+func (c Controller) InstanceTopic() string {
+	return c.mqtt_topic + "/instances/" + c.instance.ID
+}
+
+// Where an instance says it's online, and its will says offline. Each instance has its own, so one going away
+// doesn't make the others look dead.
+func StateTopic(control_topic string, instance_id string) string {
+	return control_topic + "/instances/" + instance_id + "/state"
+}
+
+func (c Controller) StateTopic() string {
+	return StateTopic(c.mqtt_topic, c.instance.ID)
+}
+
+// The retained message saying we're here, or clearing it if we're not.
+func (c Controller) instanceUpdate(online bool) *channels.MQTTUpdate {
+	ret := &channels.MQTTUpdate{Topic: c.InstanceTopic(), Retain: true, ContentType: "application/json"}
+	if online {
+		out, _ := json.Marshal(c.instance)
+		ret.Content = string(out)
+	}
+	return ret
+}
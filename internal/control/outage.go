@@ -0,0 +1,177 @@
+package control
+
+// Keeping track of power cuts, so we can say what happened once the power's back.
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+)
+
+// What happened during an outage, i.e. from a UPS going on battery to it coming back on line.
+// Anything the UPS doesn't report is left out.
+type OutageReport struct {
+	Host    string    `json:"host"`
+	UPS     string    `json:"ups"`
+	UPSID   string    `json:"ups_id"`
+	Started time.Time `json:"started"`
+	// Nil until it's over.
+	Ended           *time.Time `json:"ended,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	// input.transfer.reason when we went on battery.
+	TransferReason string `json:"transfer_reason,omitempty"`
+	// battery.charge (%) when it started and at its lowest.
+	StartCharge *float64 `json:"start_charge,omitempty"`
+	MinCharge   *float64 `json:"min_charge,omitempty"`
+	// battery.runtime (seconds) at its lowest.
+	MinRuntime *float64 `json:"min_runtime,omitempty"`
+	// ups.load (%) and power (W) at their highest.
+	PeakLoad  *float64 `json:"peak_load,omitempty"`
+	PeakPower *float64 `json:"peak_power,omitempty"`
+	// Roughly how much energy came out of the battery, from the power readings we got.
+	EnergyWh *float64 `json:"energy_wh,omitempty"`
+	// Whether the battery got low (LB) at any point.
+	LowBattery bool `json:"low_battery"`
+}
+
+// A copy that's safe to hand out while we carry on updating the original.
+func (r *OutageReport) clone() *OutageReport {
+	ret := *r
+	for _, f := range []**float64{&ret.StartCharge, &ret.MinCharge, &ret.MinRuntime, &ret.PeakLoad, &ret.PeakPower, &ret.EnergyWh} {
+		if *f != nil {
+			v := **f
+			*f = &v
+		}
+	}
+	return &ret
+}
+
+type outage struct {
+	report *OutageReport
+	// The last power reading, for working out energy.
+	last_watts float64
+	last_time  time.Time
+	have_watts bool
+}
+
+type OutageTracker struct {
+	mu sync.Mutex
+	// Outages in progress, by UPS ID.
+	current map[string]*outage
+	// Finished ones, oldest first.
+	reports []*OutageReport
+	keep    int
+}
+
+func NewOutageTracker(keep int) *OutageTracker {
+	return &OutageTracker{current: map[string]*outage{}, keep: keep}
+}
+
+// Keep the lower (or higher) of a reading and what we've got so far.
+func track(current **float64, vars map[string]string, name string, lower bool) {
+	v, ok := varFloat(vars, name)
+	if !ok {
+		return
+	}
+	if *current == nil || (lower && v < **current) || (!lower && v > **current) {
+		*current = &v
+	}
+}
+
+// Take in a sighting of a UPS. Returns the report if this is the end of an outage.
+func (t *OutageTracker) Observe(u *channels.UPSInfo, now time.Time) *OutageReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	flags := statusFlags(u.Vars["ups.status"])
+	o, ok := t.current[u.ID]
+	if !ok {
+		if !flags["OB"] {
+			return nil
+		}
+		o = &outage{report: &OutageReport{Host: u.Host, UPS: u.DisplayName(), UPSID: u.ID, Started: now, TransferReason: u.Vars["input.transfer.reason"]}}
+		track(&o.report.StartCharge, u.Vars, "battery.charge", true)
+		t.current[u.ID] = o
+	}
+	r := o.report
+	// Energy since the last reading, assuming the power stayed where it was.
+	if o.have_watts {
+		e := o.last_watts * now.Sub(o.last_time).Hours()
+		if r.EnergyWh == nil {
+			r.EnergyWh = new(float64)
+		}
+		*r.EnergyWh += e
+	}
+	p := UPSPower(u.Vars)
+	o.last_watts, o.have_watts = p.Watts, p.HaveWatts
+	o.last_time = now
+	if o.have_watts {
+		w := o.last_watts
+		if r.PeakPower == nil || w > *r.PeakPower {
+			r.PeakPower = &w
+		}
+	}
+	track(&r.MinCharge, u.Vars, "battery.charge", true)
+	track(&r.MinRuntime, u.Vars, "battery.runtime", true)
+	track(&r.PeakLoad, u.Vars, "ups.load", false)
+	if flags["LB"] {
+		r.LowBattery = true
+	}
+	r.DurationSeconds = now.Sub(r.Started).Seconds()
+	if flags["OB"] || !flags["OL"] {
+		return nil
+	}
+	// Back on line, so that's it.
+	r.Ended = &now
+	delete(t.current, u.ID)
+	t.reports = append(t.reports, r)
+	if len(t.reports) > t.keep {
+		t.reports = t.reports[len(t.reports)-t.keep:]
+	}
+	return r
+}
+
+// Stop tracking a UPS we've lost sight of. Whatever outage it was in, we'll never know how it ended.
+func (t *OutageTracker) ForgetUPS(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.current, id)
+}
+
+// Outages still going on, and the last few finished ones, oldest first.
+func (t *OutageTracker) Reports() (current []*OutageReport, finished []*OutageReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current = []*OutageReport{}
+	for _, o := range t.current {
+		current = append(current, o.report.clone())
+	}
+	sort.Slice(current, func(i, j int) bool { return current[i].UPSID < current[j].UPSID })
+	return current, append([]*OutageReport{}, t.reports...)
+}
+
+func (c Controller) OutagesTopic() string {
+	return c.mqtt_topic + "/outages"
+}
+
+// UPS IDs have slashes in (host:3493/ups), and could have wildcards, none of which belong in one topic level.
+var topicLevelChars = regexp.MustCompile(`[/+#\x00]`)
+
+// Where a UPS's outage reports go, e.g. <control topic>/outages/nas:3493_ups
+func (c Controller) OutageTopic(id string) string {
+	return c.OutagesTopic() + "/" + topicLevelChars.ReplaceAllString(id, "_")
+}
+
+// Tell the world about an outage that's just ended. Retained, one topic per UPS, so the last one for each is
+// always there to look at.
+func (c Controller) reportOutage(r *OutageReport) {
+	logger.Info("Outage over", "host", r.Host, "ups", r.UPS, "duration_seconds", r.DurationSeconds, "low_battery", r.LowBattery)
+	if !c.publishing() {
+		return
+	}
+	out, _ := json.Marshal(r)
+	c.cb.Mqtt <- &channels.MQTTUpdate{Topic: c.OutageTopic(r.UPSID), Content: string(out), Retain: true, ContentType: "application/json", UPSData: true}
+}
@@ -0,0 +1,86 @@
+package control
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gerrowadat/nut2mqtt/internal/channels"
+)
+
+func TestOutageTracker(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ups := func(vars map[string]string) *channels.UPSInfo {
+		return &channels.UPSInfo{Host: "h", Name: "ups", Alias: "rack", ID: "h:3493/ups", Vars: vars}
+	}
+	tr := NewOutageTracker(10)
+	sightings := []map[string]string{
+		{"ups.status": "OL", "battery.charge": "100", "ups.load": "20", "ups.realpower.nominal": "1000"},
+		{"ups.status": "OB DISCHRG", "battery.charge": "100", "ups.load": "20", "ups.realpower.nominal": "1000", "battery.runtime": "1200", "input.transfer.reason": "input voltage out of range"},
+		{"ups.status": "OB DISCHRG", "battery.charge": "80", "ups.load": "40", "ups.realpower.nominal": "1000", "battery.runtime": "600"},
+		{"ups.status": "OB LB", "battery.charge": "30", "ups.load": "30", "ups.realpower.nominal": "1000", "battery.runtime": "300"},
+		{"ups.status": "OL CHRG", "battery.charge": "35", "ups.load": "20", "ups.realpower.nominal": "1000", "battery.runtime": "400"},
+	}
+	var report *OutageReport
+	for i, vars := range sightings {
+		r := tr.Observe(ups(vars), start.Add(time.Duration(i)*30*time.Minute))
+		if i == 2 {
+			current, finished := tr.Reports()
+			if len(current) != 1 || len(finished) != 0 || current[0].Ended != nil {
+				t.Errorf("mid-outage Reports() = %v, %v", current, finished)
+			}
+		}
+		if r != nil && i != len(sightings)-1 {
+			t.Errorf("outage reported early, at sighting %d", i)
+		}
+		report = r
+	}
+	if report == nil {
+		t.Fatalf("no outage report")
+	}
+	check := func(name string, got *float64, want float64) {
+		if got == nil || *got != want {
+			t.Errorf("%v = %v, want %v", name, got, want)
+		}
+	}
+	if !report.Started.Equal(start.Add(30*time.Minute)) || report.Ended == nil || !report.Ended.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("outage from %v to %v", report.Started, report.Ended)
+	}
+	if report.DurationSeconds != 5400 {
+		t.Errorf("DurationSeconds = %v, want 5400", report.DurationSeconds)
+	}
+	if report.TransferReason != "input voltage out of range" || !report.LowBattery || report.UPS != "rack" {
+		t.Errorf("report = %+v", report)
+	}
+	check("StartCharge", report.StartCharge, 100)
+	check("MinCharge", report.MinCharge, 30)
+	check("MinRuntime", report.MinRuntime, 300)
+	check("PeakLoad", report.PeakLoad, 40)
+	check("PeakPower", report.PeakPower, 400)
+	// Half an hour each at 200W, 400W and 300W.
+	check("EnergyWh", report.EnergyWh, 450)
+
+	current, finished := tr.Reports()
+	if len(current) != 0 || len(finished) != 1 {
+		t.Errorf("Reports() = %v, %v, want just the one finished", current, finished)
+	}
+
+	// Losing sight of a UPS mid-outage forgets about it.
+	tr.Observe(ups(map[string]string{"ups.status": "OB"}), start)
+	tr.ForgetUPS("h:3493/ups")
+	if r := tr.Observe(ups(map[string]string{"ups.status": "OL"}), start.Add(time.Minute)); r != nil {
+		t.Errorf("got a report for a forgotten outage: %+v", r)
+	}
+}
+
+func TestReportOutage(t *testing.T) {
+	c := NewController("bridge", time.Minute)
+	c.SetActive(true)
+	c.reportOutage(&OutageReport{Host: "nas", UPS: "rack", UPSID: "nas:3493/ups"})
+	c.reportOutage(&OutageReport{Host: "nas", UPS: "desk", UPSID: "serial:AB/1+2#"})
+	for _, want := range []string{"bridge/outages/nas:3493_ups", "bridge/outages/serial:AB_1_2_"} {
+		u := <-c.cb.Mqtt
+		if u.Topic != want || !u.Retain || !u.UPSData {
+			t.Errorf("reportOutage() sent %+v, want retained UPS data on %v", u, want)
+		}
+	}
+}
@@ -1,20 +1,122 @@
 package http
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
 	control "github.com/gerrowadat/nut2mqtt/internal/control"
+	journal "github.com/gerrowadat/nut2mqtt/internal/journal"
+	logging "github.com/gerrowadat/nut2mqtt/internal/logging"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var logger = logging.Logger("http")
+
 func HTTPServer(c *control.Controller, listen *string) {
 	defer c.WaitGroupDone()
 	http.HandleFunc("/", RootHandler)
 	http.Handle("/metrics", promhttp.HandlerFor(c.MetricRegistry().Registry(), promhttp.HandlerOpts{Registry: c.MetricRegistry().Registry()}))
+	http.HandleFunc("/api/v1/ups", func(w http.ResponseWriter, r *http.Request) { UPSHandler(c, w, r) })
+	http.HandleFunc("/api/v1/outages", func(w http.ResponseWriter, r *http.Request) { OutagesHandler(c, w, r) })
+	http.HandleFunc("/api/v1/events", func(w http.ResponseWriter, r *http.Request) { EventsHandler(c.Journal(), w, r) })
 
 	http.ListenAndServe(*listen, nil)
 }
 
 func RootHandler(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("<a href=\"/metrics\">/metrics</a>"))
+	w.Write([]byte("<a href=\"/metrics\">/metrics</a><br/><a href=\"/api/v1/ups\">/api/v1/ups</a><br/><a href=\"/api/v1/events\">/api/v1/events</a><br/><a href=\"/api/v1/outages\">/api/v1/outages</a>"))
+}
+
+// What we say about each variable over the API.
+type apiVar struct {
+	Value string `json:"value"`
+	*channels.VarMetadata
+}
+
+type apiUPS struct {
+	ID          string             `json:"id"`
+	Host        string             `json:"host"`
+	Port        int                `json:"port"`
+	Name        string             `json:"name"`
+	Alias       string             `json:"alias,omitempty"`
+	Description string             `json:"description"`
+	Vars        map[string]*apiVar `json:"vars"`
+}
+
+// All the UPSes we know about, their variables and whatever metadata we have for them.
+func UPSHandler(c *control.Controller, w http.ResponseWriter, r *http.Request) {
+	ret := []*apiUPS{}
+	for _, u := range c.State().Snapshot() {
+		a := &apiUPS{ID: u.ID, Host: u.Host, Port: u.Port, Name: u.Name, Alias: u.Alias, Description: u.Description, Vars: map[string]*apiVar{}}
+		for k, v := range u.Vars {
+			a.Vars[k] = &apiVar{Value: v, VarMetadata: u.Meta[k]}
+		}
+		ret = append(ret, a)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	writeJSON(w, ret)
+}
+
+// Outages in progress, and reports on the last few finished ones.
+func OutagesHandler(c *control.Controller, w http.ResponseWriter, r *http.Request) {
+	current, finished := c.Outages().Reports()
+	writeJSON(w, map[string][]*control.OutageReport{"current": current, "finished": finished})
+}
+
+// Journal entries, filtered by ?type=a,b, ?ups=, ?since= and ?until= (RFC 3339 times, or durations
+// meaning that long ago) and ?limit=.
+func EventsHandler(j *journal.Journal, w http.ResponseWriter, r *http.Request) {
+	q, err := parseEventsQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, j.Query(q))
+}
+
+func parseEventsQuery(v url.Values, now time.Time) (journal.Query, error) {
+	q := journal.Query{UPS: v.Get("ups")}
+	for _, t := range strings.Split(v.Get("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			q.Types = append(q.Types, t)
+		}
+	}
+	var err error
+	if q.Since, err = parseTime(v.Get("since"), now); err != nil {
+		return q, fmt.Errorf("bad since: %v", err)
+	}
+	if q.Until, err = parseTime(v.Get("until"), now); err != nil {
+		return q, fmt.Errorf("bad until: %v", err)
+	}
+	if l := v.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("bad limit %q", l)
+		}
+	}
+	return q, nil
+}
+
+// An RFC 3339 time, or a duration meaning that long before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Error writing JSON response", "err", err)
+	}
 }
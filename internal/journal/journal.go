@@ -0,0 +1,254 @@
+package journal
+
+// A record of what's happened (power events, status changes, commands and so on) for looking back on after
+// an incident. Kept in memory for querying, and optionally as JSON lines in a file that gets rotated.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	PowerLost      = "power_lost"
+	PowerRestored  = "power_restored"
+	StatusChange   = "status_change"
+	Alert          = "alert"
+	VariableChange = "variable_change"
+	Command        = "command"
+	BridgeStart    = "bridge_start"
+	BridgeStop     = "bridge_stop"
+)
+
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Which UPS, if it's about one. UPS is the alias or name, UPSID the stable ID.
+	Host  string `json:"host,omitempty"`
+	UPS   string `json:"ups,omitempty"`
+	UPSID string `json:"ups_id,omitempty"`
+	// For variable and status changes.
+	Var string `json:"var,omitempty"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+	// Anything else worth saying, e.g. the command and how it went.
+	Message string `json:"message,omitempty"`
+}
+
+type Options struct {
+	// Where to write events, as JSON lines. Empty means memory only.
+	Path string
+	// Rotate the file once it gets this big, keeping this many old ones (Path.1 being the newest).
+	MaxSize  int64
+	MaxFiles int
+	// How many events to keep in memory for queries.
+	Keep int
+}
+
+type Journal struct {
+	opts Options
+
+	mu sync.Mutex
+	// A ring of the last opts.Keep events. Until it's full, oldest first; after that, oldest at next.
+	events []*Event
+	next   int
+	// Nil if we're memory only, closed, or couldn't reopen the file after rotating it.
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// Open a journal, reading back whatever's in its files so queries cover more than just this run.
+func Open(opts Options) (*Journal, error) {
+	if opts.Keep <= 0 {
+		opts.Keep = 10000
+	}
+	j := &Journal{opts: opts}
+	if opts.Path == "" {
+		return j, nil
+	}
+	if opts.MaxSize <= 0 {
+		return nil, errors.New("journal max size must be positive")
+	}
+	for i := opts.MaxFiles; i >= 0; i-- {
+		if err := j.load(j.path(i)); err != nil {
+			return nil, err
+		}
+	}
+	if err := j.openFile(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// The nth file: 0 is the current one, then oldest last.
+func (j *Journal) path(n int) string {
+	if n == 0 {
+		return j.opts.Path
+	}
+	return fmt.Sprintf("%v.%d", j.opts.Path, n)
+}
+
+func (j *Journal) load(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Probably cut off by a crash. Not worth refusing to start over.
+			continue
+		}
+		j.remember(&e)
+	}
+	return scanner.Err()
+}
+
+func (j *Journal) openFile() error {
+	f, err := os.OpenFile(j.opts.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.f, j.size = f, st.Size()
+	return nil
+}
+
+func (j *Journal) remember(e *Event) {
+	if len(j.events) < j.opts.Keep {
+		j.events = append(j.events, e)
+		return
+	}
+	j.events[j.next] = e
+	j.next = (j.next + 1) % len(j.events)
+}
+
+// Record an event, filling in the time if it hasn't got one.
+func (j *Journal) Add(e *Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.remember(e)
+	if j.opts.Path == "" || j.closed {
+		return nil
+	}
+	if j.f == nil {
+		// Rotating didn't manage to open a new file, so have another go rather than quietly dropping events.
+		if err := j.openFile(); err != nil {
+			return fmt.Errorf("journal file isn't open: %v", err)
+		}
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if j.size > 0 && j.size+int64(len(line)) > j.opts.MaxSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := j.f.Write(line)
+	j.size += int64(n)
+	return err
+}
+
+// Shuffle the files along, dropping the oldest, and start a new one.
+func (j *Journal) rotate() error {
+	j.f.Close()
+	j.f = nil
+	if j.opts.MaxFiles <= 0 {
+		os.Remove(j.opts.Path)
+	}
+	for i := j.opts.MaxFiles; i > 0; i-- {
+		if err := os.Rename(j.path(i-1), j.path(i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return j.openFile()
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closed = true
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+type Query struct {
+	// Any of these types. Empty means all of them.
+	Types []string
+	// Matches the host, the UPS's name or alias, or its ID.
+	UPS string
+	// Zero means no limit.
+	Since time.Time
+	Until time.Time
+	// Only the latest this many. Zero means all of them.
+	Limit int
+}
+
+// Events matching q, oldest first.
+func (j *Journal) Query(q Query) []*Event {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ret := []*Event{}
+	for i := range j.events {
+		e := j.events[(j.next+i)%len(j.events)]
+		if q.matches(e) {
+			ret = append(ret, e)
+		}
+	}
+	if q.Limit > 0 && len(ret) > q.Limit {
+		ret = ret[len(ret)-q.Limit:]
+	}
+	return ret
+}
+
+func (q Query) matches(e *Event) bool {
+	if len(q.Types) > 0 {
+		found := false
+		for _, t := range q.Types {
+			if strings.EqualFold(t, e.Type) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.UPS != "" && q.UPS != e.UPS && q.UPS != e.UPSID && q.UPS != e.Host {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournalRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	j, err := Open(Options{Path: path, MaxSize: 200, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := j.Add(&Event{Time: start.Add(time.Duration(i) * time.Minute), Type: Command, Message: strings.Repeat("x", 50)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		st, err := os.Stat(p)
+		if err != nil {
+			t.Errorf("%v should exist: %v", p, err)
+			continue
+		}
+		if st.Size() > 200 {
+			t.Errorf("%v is %d bytes, should have been rotated at 200", p, st.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("should only keep 2 old files")
+	}
+
+	// Reopening reads back what's left, oldest first.
+	j, err = Open(Options{Path: path, MaxSize: 200, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	got := j.Query(Query{})
+	if len(got) < 3 || len(got) >= 10 {
+		t.Fatalf("got %d events back, want some but not all of them", len(got))
+	}
+	if !got[len(got)-1].Time.Equal(start.Add(9 * time.Minute)) {
+		t.Errorf("latest event is from %v, want %v", got[len(got)-1].Time, start.Add(9*time.Minute))
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].Time.Before(got[i-1].Time) {
+			t.Errorf("events out of order: %v before %v", got[i-1].Time, got[i].Time)
+		}
+	}
+}
+
+func TestJournalReopensAfterFailedRotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "journal")
+	os.Mkdir(dir, 0755)
+	path := filepath.Join(dir, "events.jsonl")
+	j, err := Open(Options{Path: path, MaxSize: 100, MaxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	e := func() *Event { return &Event{Type: Command, Message: strings.Repeat("x", 60)} }
+	if err := j.Add(e()); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the directory gone, rotating can't open a new file, and every Add after that should say so.
+	os.RemoveAll(dir)
+	for i := 0; i < 2; i++ {
+		if err := j.Add(e()); err == nil {
+			t.Errorf("Add() %d with nowhere to write, error = nil", i)
+		}
+	}
+
+	// Once it's back, we pick up where we left off.
+	os.Mkdir(dir, 0755)
+	if err := j.Add(e()); err != nil {
+		t.Fatalf("Add() once the directory's back, error = %v", err)
+	}
+	if st, err := os.Stat(path); err != nil || st.Size() == 0 {
+		t.Errorf("%v should have the latest event in it: %v", path, err)
+	}
+	if got := len(j.Query(Query{})); got != 4 {
+		t.Errorf("Query() got %d events, want all 4 in memory", got)
+	}
+}
+
+func TestJournalQuery(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	j, _ := Open(Options{Keep: 4})
+	for i, e := range []*Event{
+		{Type: BridgeStart},
+		{Type: PowerLost, Host: "h1", UPS: "rack", UPSID: "h1:3493/ups"},
+		{Type: StatusChange, Host: "h1", UPS: "rack", UPSID: "h1:3493/ups"},
+		{Type: PowerLost, Host: "h2", UPS: "ups", UPSID: "h2:3493/ups"},
+		{Type: PowerRestored, Host: "h1", UPS: "rack", UPSID: "h1:3493/ups"},
+	} {
+		e.Time = start.Add(time.Duration(i) * time.Minute)
+		j.Add(e)
+	}
+	types := func(events []*Event) []string {
+		ret := []string{}
+		for _, e := range events {
+			ret = append(ret, e.Type+"@"+e.Host)
+		}
+		return ret
+	}
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		// Only keeping 4, so the start's gone.
+		{name: "All", q: Query{}, want: []string{"power_lost@h1", "status_change@h1", "power_lost@h2", "power_restored@h1"}},
+		{name: "Types", q: Query{Types: []string{"power_lost", "POWER_RESTORED"}}, want: []string{"power_lost@h1", "power_lost@h2", "power_restored@h1"}},
+		{name: "ByAlias", q: Query{UPS: "rack"}, want: []string{"power_lost@h1", "status_change@h1", "power_restored@h1"}},
+		{name: "ByID", q: Query{UPS: "h2:3493/ups"}, want: []string{"power_lost@h2"}},
+		{name: "Between", q: Query{Since: start.Add(2 * time.Minute), Until: start.Add(3 * time.Minute)}, want: []string{"status_change@h1", "power_lost@h2"}},
+		{name: "Limit", q: Query{Limit: 1}, want: []string{"power_restored@h1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := types(j.Query(tt.q)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Query() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package logging
+
+// Structured logging, with a logger per subsystem whose level can be changed at runtime, e.g. to see every
+// MQTT update without drowning in everything else.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Everything that gets its own logger, and so its own level.
+var Subsystems = []string{"control", "http", "main", "metrics", "mqtt", "nutserver", "upsc"}
+
+var (
+	mu sync.Mutex
+	// The level for anything without its own.
+	default_level slog.Level
+	// Per-subsystem overrides.
+	overrides = map[string]slog.Level{}
+	// What each subsystem's logger actually checks.
+	levels = map[string]*slog.LevelVar{}
+	// Where log records end up. Swapped by Setup, so loggers made before then still work.
+	output atomic.Pointer[slog.Handler]
+)
+
+func init() {
+	for _, s := range Subsystems {
+		levels[s] = &slog.LevelVar{}
+	}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	output.Store(&h)
+}
+
+// Log as text or json to w. Also sends anything using the log package (ours or a library's) through here.
+func Setup(format string, w io.Writer) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (use text or json)", format)
+	}
+	output.Store(&h)
+	slog.SetDefault(Logger("main"))
+	return nil
+}
+
+// The logger for a subsystem. Fine to call before Setup, e.g. for package-level loggers.
+func Logger(subsystem string) *slog.Logger {
+	mu.Lock()
+	l, ok := levels[subsystem]
+	if !ok {
+		// Not one we know about, so it just follows the default.
+		l = &slog.LevelVar{}
+		l.Set(default_level)
+		levels[subsystem] = l
+	}
+	mu.Unlock()
+	return slog.New(&handler{level: l}).With("subsystem", subsystem)
+}
+
+func parseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+		return l, fmt.Errorf("unknown log level %q (use debug, info, warn or error)", name)
+	}
+	return l, nil
+}
+
+// Set levels from something like "info" (for everything), "mqtt=debug" (just for mqtt), or a comma-separated
+// list of them, applied in order. A bare level also clears any per-subsystem ones. Nothing changes on error.
+func SetLevel(spec string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	new_default := default_level
+	new_overrides := map[string]slog.Level{}
+	for k, v := range overrides {
+		new_overrides[k] = v
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, level_name, found := strings.Cut(part, "=")
+		if !found {
+			l, err := parseLevel(part)
+			if err != nil {
+				return err
+			}
+			new_default = l
+			new_overrides = map[string]slog.Level{}
+			continue
+		}
+		subsystem = strings.TrimSpace(subsystem)
+		if !isSubsystem(subsystem) {
+			return fmt.Errorf("unknown subsystem %q (use one of %v)", subsystem, strings.Join(Subsystems, ", "))
+		}
+		l, err := parseLevel(level_name)
+		if err != nil {
+			return err
+		}
+		new_overrides[subsystem] = l
+	}
+	default_level, overrides = new_default, new_overrides
+	for s, l := range levels {
+		if o, ok := overrides[s]; ok {
+			l.Set(o)
+		} else {
+			l.Set(default_level)
+		}
+	}
+	return nil
+}
+
+func isSubsystem(s string) bool {
+	for _, known := range Subsystems {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
+
+// The current levels, in the form SetLevel takes, e.g. "info,mqtt=debug".
+func Level() string {
+	mu.Lock()
+	defer mu.Unlock()
+	parts := []string{levelName(default_level)}
+	subsystems := []string{}
+	for s := range overrides {
+		subsystems = append(subsystems, s)
+	}
+	sort.Strings(subsystems)
+	for _, s := range subsystems {
+		parts = append(parts, s+"="+levelName(overrides[s]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func levelName(l slog.Level) string {
+	return strings.ToLower(l.String())
+}
+
+// Checks the subsystem's level, then hands off to whatever the output is now, with any attributes and groups
+// the logger's picked up along the way.
+type handler struct {
+	level *slog.LevelVar
+	ops   []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	out := *output.Load()
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := append(append([]func(slog.Handler) slog.Handler{}, h.ops...), op)
+	return &handler{level: h.level, ops: ops}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetLevel(t *testing.T) {
+	defer SetLevel("info")
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "debug", want: "debug"},
+		{spec: "WARN", want: "warn"},
+		{spec: " error\n", want: "error"},
+		{spec: "info,mqtt=debug", want: "info,mqtt=debug"},
+		{spec: "upsc=warn", want: "info,mqtt=debug,upsc=warn"},
+		{spec: "error", want: "error"},
+		{spec: "chatty", want: "error", wantErr: true},
+		{spec: "info,nope=debug", want: "error", wantErr: true},
+		{spec: "mqtt=chatty", want: "error", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := SetLevel(tt.spec); (err != nil) != tt.wantErr {
+			t.Errorf("SetLevel(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+		}
+		if got := Level(); got != tt.want {
+			t.Errorf("after SetLevel(%q), Level() = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	defer SetLevel("info")
+	defer Setup("text", os.Stderr)
+	// Made before Setup, like package-level loggers.
+	mqtt := Logger("mqtt").With("output", "default")
+	upsc := Logger("upsc")
+
+	var buf bytes.Buffer
+	if err := Setup("json", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLevel("info,mqtt=debug"); err != nil {
+		t.Fatal(err)
+	}
+	mqtt.Debug("MQTT change", "topic", "nut/bridge/state")
+	upsc.Debug("not this")
+	upsc.Info("polled", "host", "localhost")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2: %v", len(lines), buf.String())
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["subsystem"] != "mqtt" || rec["output"] != "default" || rec["topic"] != "nut/bridge/state" || rec["level"] != "DEBUG" {
+		t.Errorf("got log record %v", rec)
+	}
+	if !strings.Contains(lines[1], `"subsystem":"upsc"`) {
+		t.Errorf("got log line %v", lines[1])
+	}
+	if err := Setup("xml", &buf); err == nil {
+		t.Errorf("Setup(xml) should have failed")
+	}
+}
@@ -0,0 +1,259 @@
+package metrics
+
+// Exporting every NUT variable, rather than just the ones in UPSMetricsList.
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Every ups.status flag in the NUT docs, so we can report the ones that aren't set as 0.
+var KnownStatusFlags = []string{"OL", "OB", "LB", "HB", "RB", "CHRG", "DISCHRG", "BYPASS", "CAL", "OFF", "OVER", "TRIM", "BOOST", "FSD", "ALARM", "TEST"}
+
+type GenericExporter struct {
+	reg prometheus.Registerer
+	// Globs on NUT variable names. An empty include list means everything.
+	include []string
+	exclude []string
+	// If set, each numeric variable gets its own metric (nut_battery_charge{host,port,ups})
+	// rather than one big nut_variable{host,port,ups,var}.
+	named bool
+
+	// Guards everything below, as ForgetUPS can come from another goroutine.
+	mu        sync.Mutex
+	variables *prometheus.GaugeVec
+	// Whether variables is registered. In named mode, it's only for variables whose own metric name was taken.
+	variables_registered bool
+	named_variables      map[string]*prometheus.GaugeVec
+	// Which variable each of named_variables is for.
+	named_for map[string]string
+	// Variables whose metric name we couldn't have (e.g. ups_load next to ups.load), so they go in nut_variable.
+	clashes map[string]bool
+	status  *prometheus.GaugeVec
+	info    *prometheus.GaugeVec
+	// The value label we last exported per host/port/ups/var info series, so we can drop it when it changes.
+	info_values map[[4]string]string
+	// Status flags we've seen per host/port/ups, beyond the known ones.
+	seen_flags map[[3]string]map[string]bool
+}
+
+func NewGenericExporter(reg prometheus.Registerer, include []string, exclude []string, named bool) *GenericExporter {
+	g := &GenericExporter{
+		reg:     reg,
+		include: include,
+		exclude: exclude,
+		named:   named,
+		variables: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nut_variable",
+			Help: "Value of a numeric NUT variable.",
+		}, []string{"host", "port", "ups", "var"}),
+		named_variables: map[string]*prometheus.GaugeVec{},
+		named_for:       map[string]string{},
+		clashes:         map[string]bool{},
+		status: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nut_status",
+			Help: "Whether a ups.status flag is set (1) or not (0).",
+		}, []string{"host", "port", "ups", "flag"}),
+		info: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nut_info",
+			Help: "Value of a non-numeric NUT variable, as a label. Always 1.",
+		}, []string{"host", "port", "ups", "var", "value"}),
+		info_values: map[[4]string]string{},
+		seen_flags:  map[[3]string]map[string]bool{},
+	}
+	if !named {
+		reg.MustRegister(g.variables)
+		g.variables_registered = true
+	}
+	reg.MustRegister(g.status)
+	reg.MustRegister(g.info)
+	return g
+}
+
+// Whether we should export this variable at all.
+func (g *GenericExporter) Wants(varname string) bool {
+	for _, pat := range g.exclude {
+		if ok, _ := path.Match(pat, varname); ok {
+			return false
+		}
+	}
+	if len(g.include) == 0 {
+		return true
+	}
+	for _, pat := range g.include {
+		if ok, _ := path.Match(pat, varname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// battery.charge -> nut_battery_charge
+func MetricNameForVariable(varname string) string {
+	return "nut_" + invalidMetricChars.ReplaceAllString(varname, "_")
+}
+
+// The named metric for a variable, or nil if its name's taken by something else.
+func (g *GenericExporter) numericGauge(varname string) *prometheus.GaugeVec {
+	name := MetricNameForVariable(varname)
+	if g.clashes[varname] {
+		return nil
+	}
+	if owner, ok := g.named_for[name]; ok && owner != varname {
+		logger.Warn("Can't export variable under its own name, as another variable has it. Putting it in nut_variable instead", "var", varname, "metric", name, "taken_by", owner)
+		g.clashes[varname] = true
+		return nil
+	}
+	v, ok := g.named_variables[name]
+	if !ok {
+		v = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: "Value of NUT variable " + varname,
+		}, []string{"host", "port", "ups"})
+		if err := g.reg.Register(v); err != nil {
+			logger.Warn("Can't export variable under its own name, putting it in nut_variable instead", "var", varname, "metric", name, "err", err)
+			g.clashes[varname] = true
+			return nil
+		}
+		g.named_variables[name] = v
+		g.named_for[name] = varname
+	}
+	return v
+}
+
+// nut_variable, registering it if we have to. False if we can't.
+func (g *GenericExporter) labelledGauge() bool {
+	if !g.variables_registered {
+		if err := g.reg.Register(g.variables); err != nil {
+			logger.Warn("Can't register nut_variable", "err", err)
+			return false
+		}
+		g.variables_registered = true
+	}
+	return true
+}
+
+func (g *GenericExporter) setNumeric(host string, port string, ups string, varname string, val float64) {
+	if g.named {
+		if v := g.numericGauge(varname); v != nil {
+			v.WithLabelValues(host, port, ups).Set(val)
+			return
+		}
+	}
+	if g.labelledGauge() {
+		g.variables.WithLabelValues(host, port, ups, varname).Set(val)
+	}
+}
+
+func (g *GenericExporter) deleteNumeric(host string, port string, ups string, varname string) {
+	name := MetricNameForVariable(varname)
+	if v, ok := g.named_variables[name]; ok && g.named_for[name] == varname {
+		v.DeleteLabelValues(host, port, ups)
+	}
+	g.variables.DeleteLabelValues(host, port, ups, varname)
+}
+
+func (g *GenericExporter) setInfo(host string, port string, ups string, varname string, value string) {
+	key := [4]string{host, port, ups, varname}
+	if old, ok := g.info_values[key]; ok {
+		if old == value {
+			return
+		}
+		g.info.DeleteLabelValues(host, port, ups, varname, old)
+	}
+	g.info.WithLabelValues(host, port, ups, varname, value).Set(1)
+	g.info_values[key] = value
+}
+
+func (g *GenericExporter) deleteInfo(host string, port string, ups string, varname string) {
+	key := [4]string{host, port, ups, varname}
+	if old, ok := g.info_values[key]; ok {
+		g.info.DeleteLabelValues(host, port, ups, varname, old)
+		delete(g.info_values, key)
+	}
+}
+
+func (g *GenericExporter) setStatus(host string, port string, ups string, status string) {
+	key := [3]string{host, port, ups}
+	seen, ok := g.seen_flags[key]
+	if !ok {
+		seen = map[string]bool{}
+		for _, f := range KnownStatusFlags {
+			seen[f] = true
+		}
+		g.seen_flags[key] = seen
+	}
+	set := map[string]bool{}
+	for _, f := range strings.Fields(status) {
+		set[f] = true
+		seen[f] = true
+	}
+	for f := range seen {
+		if set[f] {
+			g.status.WithLabelValues(host, port, ups, f).Set(1)
+		} else {
+			g.status.WithLabelValues(host, port, ups, f).Set(0)
+		}
+	}
+}
+
+// Export a variable's new value: numbers as gauges, ups.status as flags, and anything else as info.
+func (g *GenericExporter) Update(host string, port_num int, ups string, varname string, value string) {
+	if !g.Wants(varname) {
+		return
+	}
+	port := strconv.Itoa(port_num)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if varname == "ups.status" {
+		g.setStatus(host, port, ups, value)
+		return
+	}
+	val, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		g.deleteInfo(host, port, ups, varname)
+		g.setNumeric(host, port, ups, varname, val)
+	} else {
+		g.deleteNumeric(host, port, ups, varname)
+		g.setInfo(host, port, ups, varname, value)
+	}
+}
+
+func (g *GenericExporter) Remove(host string, port_num int, ups string, varname string) {
+	port := strconv.Itoa(port_num)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if varname == "ups.status" {
+		g.status.DeletePartialMatch(prometheus.Labels{"host": host, "port": port, "ups": ups})
+		delete(g.seen_flags, [3]string{host, port, ups})
+		return
+	}
+	g.deleteNumeric(host, port, ups, varname)
+	g.deleteInfo(host, port, ups, varname)
+}
+
+func (g *GenericExporter) ForgetUPS(host string, port_num int, ups string) {
+	port := strconv.Itoa(port_num)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	labels := prometheus.Labels{"host": host, "port": port, "ups": ups}
+	g.variables.DeletePartialMatch(labels)
+	for _, v := range g.named_variables {
+		v.DeletePartialMatch(labels)
+	}
+	g.status.DeletePartialMatch(labels)
+	g.info.DeletePartialMatch(labels)
+	for k := range g.info_values {
+		if k[0] == host && k[1] == port && k[2] == ups {
+			delete(g.info_values, k)
+		}
+	}
+	delete(g.seen_flags, [3]string{host, port, ups})
+}
@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Gather everything from reg into name{label=value,...} -> value, for easy comparison.
+func gatherValues(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	ret := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			key := mf.GetName() + "{"
+			for i, l := range m.GetLabel() {
+				if i > 0 {
+					key += ","
+				}
+				key += l.GetName() + "=" + l.GetValue()
+			}
+			key += "}"
+			if m.GetCounter() != nil {
+				ret[key] = m.GetCounter().GetValue()
+			} else {
+				ret[key] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	return ret
+}
+
+func TestGenericExporter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := NewGenericExporter(reg, []string{}, []string{"driver.*"}, false)
+
+	g.Update("host1", 3493, "ups1", "battery.charge", "100")
+	g.Update("host1", 3493, "ups1", "ups.model", "Smart-UPS 1500")
+	g.Update("host1", 3493, "ups1", "ups.status", "OL CHRG")
+	g.Update("host1", 3493, "ups1", "driver.version", "2.8.0")
+	// Info series follow the value rather than piling up.
+	g.Update("host1", 3493, "ups1", "ups.model", "Smart-UPS 1000")
+
+	got := gatherValues(t, reg)
+	want := map[string]float64{
+		"nut_variable{host=host1,port=3493,ups=ups1,var=battery.charge}":             100,
+		"nut_info{host=host1,port=3493,ups=ups1,value=Smart-UPS 1000,var=ups.model}": 1,
+		"nut_status{flag=OL,host=host1,port=3493,ups=ups1}":                          1,
+		"nut_status{flag=CHRG,host=host1,port=3493,ups=ups1}":                        1,
+		"nut_status{flag=OB,host=host1,port=3493,ups=ups1}":                          0,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%v = %v, want %v", k, got[k], v)
+		}
+	}
+	if _, ok := got["nut_info{host=host1,port=3493,ups=ups1,value=Smart-UPS 1500,var=ups.model}"]; ok {
+		t.Errorf("stale info series for old ups.model still exported")
+	}
+	for k := range got {
+		if k == "nut_info{host=host1,port=3493,ups=ups1,value=2.8.0,var=driver.version}" {
+			t.Errorf("excluded variable driver.version exported")
+		}
+	}
+}
+
+func TestGenericExporterNamed(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := NewGenericExporter(reg, []string{"battery.*"}, []string{}, true)
+
+	g.Update("host1", 3493, "ups1", "battery.charge", "100")
+	g.Update("host1", 3493, "ups1", "input.voltage", "230")
+
+	got := gatherValues(t, reg)
+	if got["nut_battery_charge{host=host1,port=3493,ups=ups1}"] != 100 {
+		t.Errorf("nut_battery_charge = %v, want 100", got["nut_battery_charge{host=host1,port=3493,ups=ups1}"])
+	}
+	if _, ok := got["nut_input_voltage{host=host1,port=3493,ups=ups1}"]; ok {
+		t.Errorf("input.voltage exported but not included")
+	}
+}
+
+func TestGenericExporterForgetUPS(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := NewGenericExporter(reg, []string{}, []string{}, false)
+
+	g.Update("host1", 3493, "ups1", "battery.charge", "100")
+	g.Update("host1", 3493, "ups1", "ups.status", "OL")
+	g.Update("host1", 3493, "ups1", "ups.model", "Back-UPS")
+	g.Update("host1", 3493, "ups2", "battery.charge", "90")
+	// Same name, but on another upsd on the same host.
+	g.Update("host1", 3494, "ups1", "battery.charge", "80")
+	g.ForgetUPS("host1", 3493, "ups1")
+
+	got := gatherValues(t, reg)
+	if len(got) != 2 || got["nut_variable{host=host1,port=3493,ups=ups2,var=battery.charge}"] != 90 || got["nut_variable{host=host1,port=3494,ups=ups1,var=battery.charge}"] != 80 {
+		t.Errorf("after ForgetUPS() got %v", got)
+	}
+}
+
+// Variables whose metric name is taken go in nut_variable, rather than taking the process down.
+func TestGenericExporterNameClashes(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := NewGenericExporter(reg, []string{}, []string{}, true)
+
+	g.Update("host1", 3493, "ups1", "ups.load", "10")
+	g.Update("host1", 3493, "ups1", "ups_load", "20")
+	// Would be nut_status, which is the ups.status flags.
+	g.Update("host1", 3493, "ups1", "status", "1")
+
+	got := gatherValues(t, reg)
+	for k, v := range map[string]float64{
+		"nut_ups_load{host=host1,port=3493,ups=ups1}":              10,
+		"nut_variable{host=host1,port=3493,ups=ups1,var=ups_load}": 20,
+		"nut_variable{host=host1,port=3493,ups=ups1,var=status}":   1,
+	} {
+		if got[k] != v {
+			t.Errorf("%v = %v, want %v (got %v)", k, got[k], v, got)
+		}
+	}
+
+	g.Remove("host1", 3493, "ups1", "ups_load")
+	got = gatherValues(t, reg)
+	if _, ok := got["nut_variable{host=host1,port=3493,ups=ups1,var=ups_load}"]; ok {
+		t.Errorf("ups_load still exported after Remove()")
+	}
+	if got["nut_ups_load{host=host1,port=3493,ups=ups1}"] != 10 {
+		t.Errorf("removing ups_load took ups.load with it")
+	}
+}
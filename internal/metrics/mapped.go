@@ -0,0 +1,250 @@
+package metrics
+
+// Exporting NUT variables according to a list of mappings, either the built-in UPSMetricsList or from the config file.
+// We keep the latest value of every variable and build the metrics at scrape time, so swapping the mappings
+// on reload is just a matter of swapping the list.
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Labels we set ourselves, so mappings can't use them for extra labels.
+var reservedLabels = map[string]bool{"host": true, "port": true, "ups": true, "var": true, "value": true, "state": true}
+
+// A validated mapping, ready to produce metrics.
+type mapping struct {
+	config.MetricMapping
+	// Name with the unit on the end.
+	full_name string
+	// Whether Variable is a glob, so we need a var label.
+	glob bool
+	// Extra label names, sorted so label values always line up.
+	extra_labels []string
+	desc         *prometheus.Desc
+}
+
+// Check a set of mappings and get them ready for use.
+func compileMappings(mappings []config.MetricMapping) ([]*mapping, error) {
+	ret := []*mapping{}
+	names := map[string]bool{}
+	for i, mm := range mappings {
+		m := &mapping{MetricMapping: mm}
+		if m.Variable == "" {
+			return nil, fmt.Errorf("metric mapping %d: no variable", i)
+		}
+		if _, err := path.Match(m.Variable, ""); err != nil {
+			return nil, fmt.Errorf("metric mapping %d: bad variable glob %v: %v", i, m.Variable, err)
+		}
+		m.glob = strings.ContainsAny(m.Variable, "*?[")
+		m.full_name = m.Name
+		if m.Unit != "" && !strings.HasSuffix(m.full_name, "_"+m.Unit) {
+			m.full_name += "_" + m.Unit
+		}
+		if !metricNameRegexp.MatchString(m.full_name) {
+			return nil, fmt.Errorf("metric mapping %d: bad metric name %q", i, m.full_name)
+		}
+		if names[m.full_name] {
+			return nil, fmt.Errorf("metric mapping %d: metric %v is defined more than once", i, m.full_name)
+		}
+		names[m.full_name] = true
+		switch m.Type {
+		case "gauge", "counter", "info":
+		case "enum-state":
+			if len(m.States) == 0 {
+				return nil, fmt.Errorf("metric mapping %d: enum-state metric %v has no states", i, m.full_name)
+			}
+		default:
+			return nil, fmt.Errorf("metric mapping %d: unknown metric type %q", i, m.Type)
+		}
+		if m.Multiplier == 0 {
+			m.Multiplier = 1
+		}
+		if m.Help == "" {
+			m.Help = "NUT variable " + m.Variable
+		}
+		for l := range m.Labels {
+			if !labelNameRegexp.MatchString(l) || reservedLabels[l] {
+				return nil, fmt.Errorf("metric mapping %d: bad or reserved label name %q", i, l)
+			}
+			m.extra_labels = append(m.extra_labels, l)
+		}
+		sort.Strings(m.extra_labels)
+
+		labels := []string{"host", "port", "ups"}
+		if m.glob {
+			labels = append(labels, "var")
+		}
+		labels = append(labels, m.extra_labels...)
+		switch m.Type {
+		case "info":
+			labels = append(labels, "value")
+		case "enum-state":
+			labels = append(labels, "state")
+		}
+		m.desc = prometheus.NewDesc(m.full_name, m.Help, labels, nil)
+		ret = append(ret, m)
+	}
+	if err := checkNameClashes(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Just the one mapping's metric, so a registry can tell us whether it clashes with anything.
+type describedMapping struct {
+	m *mapping
+}
+
+func (d describedMapping) Describe(ch chan<- *prometheus.Desc) { ch <- d.m.desc }
+func (d describedMapping) Collect(ch chan<- prometheus.Metric) {}
+
+// We're an unchecked collector, so nothing stops a mapping reusing the name of one of our other metrics until
+// /metrics falls over. Catch it up front instead. nut_ is left to the generic exporter, whose names come and go.
+func checkNameClashes(mappings []*mapping) error {
+	reg := prometheus.NewRegistry()
+	NewMetrics(reg)
+	reg.MustRegister(queueDepthGauge("", func() int { return 0 }))
+	for _, m := range mappings {
+		if strings.HasPrefix(m.full_name, "nut_") {
+			return fmt.Errorf("metric %v: names starting nut_ are kept for --metrics-mode=generic", m.full_name)
+		}
+		if err := reg.Register(describedMapping{m}); err != nil {
+			return fmt.Errorf("metric %v clashes with one of our own: %v", m.full_name, err)
+		}
+	}
+	return nil
+}
+
+func ValidateMappings(mappings []config.MetricMapping) error {
+	_, err := compileMappings(mappings)
+	return err
+}
+
+type MappedExporter struct {
+	mu       sync.Mutex
+	mappings []*mapping
+	// Latest value of every variable, by host/port/ups.
+	values map[[3]string]map[string]string
+}
+
+func NewMappedExporter(mappings []config.MetricMapping) (*MappedExporter, error) {
+	compiled, err := compileMappings(mappings)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedExporter{mappings: compiled, values: map[[3]string]map[string]string{}}, nil
+}
+
+// Swap in a new set of mappings. If they're no good, we keep the old ones.
+func (e *MappedExporter) SetMappings(mappings []config.MetricMapping) error {
+	compiled, err := compileMappings(mappings)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.mappings = compiled
+	return nil
+}
+
+func (e *MappedExporter) Update(host string, port int, ups string, varname string, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key := [3]string{host, strconv.Itoa(port), ups}
+	if _, ok := e.values[key]; !ok {
+		e.values[key] = map[string]string{}
+	}
+	e.values[key][varname] = value
+	// Complain now, rather than on every scrape. Globs are bound to pick up the odd non-numeric variable, so
+	// those just get skipped.
+	for _, m := range e.mappings {
+		if (m.Type != "gauge" && m.Type != "counter") || m.glob {
+			continue
+		}
+		if ok, _ := path.Match(m.Variable, varname); ok {
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				logger.Warn("Error parsing float for UPS variable", "host", host, "port", port, "ups", ups, "var", varname, "metric", m.full_name, "err", err)
+			}
+		}
+	}
+}
+
+func (e *MappedExporter) Remove(host string, port int, ups string, varname string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.values[[3]string{host, strconv.Itoa(port), ups}], varname)
+}
+
+func (e *MappedExporter) ForgetUPS(host string, port int, ups string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.values, [3]string{host, strconv.Itoa(port), ups})
+}
+
+// We don't know our metrics up front, so we're an unchecked collector and describe nothing.
+func (e *MappedExporter) Describe(ch chan<- *prometheus.Desc) {}
+
+func (e *MappedExporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, vars := range e.values {
+		for _, m := range e.mappings {
+			extra := []string{}
+			for _, l := range m.extra_labels {
+				extra = append(extra, vars[m.Labels[l]])
+			}
+			for varname, value := range vars {
+				if ok, _ := path.Match(m.Variable, varname); !ok {
+					continue
+				}
+				labels := []string{key[0], key[1], key[2]}
+				if m.glob {
+					labels = append(labels, varname)
+				}
+				labels = append(labels, extra...)
+				m.collect(ch, labels, value)
+			}
+		}
+	}
+}
+
+func (m *mapping) collect(ch chan<- prometheus.Metric, labels []string, value string) {
+	switch m.Type {
+	case "gauge", "counter":
+		val, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return
+		}
+		vt := prometheus.GaugeValue
+		if m.Type == "counter" {
+			vt = prometheus.CounterValue
+		}
+		ch <- prometheus.MustNewConstMetric(m.desc, vt, val*m.Multiplier, labels...)
+	case "info":
+		ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, 1, append(labels, value)...)
+	case "enum-state":
+		current := map[string]bool{value: true}
+		for _, f := range strings.Fields(value) {
+			current[f] = true
+		}
+		for _, s := range m.States {
+			val := 0.0
+			if current[s] {
+				val = 1
+			}
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, val, append(labels, s)...)
+		}
+	}
+}
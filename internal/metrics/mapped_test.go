@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"testing"
+
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestValidateMappings(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings []config.MetricMapping
+		wantErr  bool
+	}{
+		{
+			name:     "BuiltIn",
+			mappings: UPSMetricsList,
+			wantErr:  false,
+		},
+		{
+			name:     "NoVariable",
+			mappings: []config.MetricMapping{{Name: "ups_thing", Type: "gauge"}},
+			wantErr:  true,
+		},
+		{
+			name:     "BadName",
+			mappings: []config.MetricMapping{{Variable: "battery.charge", Name: "ups-battery-charge", Type: "gauge"}},
+			wantErr:  true,
+		},
+		{
+			name:     "BadType",
+			mappings: []config.MetricMapping{{Variable: "battery.charge", Name: "ups_battery_charge", Type: "histogram"}},
+			wantErr:  true,
+		},
+		{
+			name:     "EnumWithoutStates",
+			mappings: []config.MetricMapping{{Variable: "ups.status", Name: "ups_status", Type: "enum-state"}},
+			wantErr:  true,
+		},
+		{
+			name:     "ReservedLabel",
+			mappings: []config.MetricMapping{{Variable: "battery.charge", Name: "ups_battery_charge", Type: "gauge", Labels: map[string]string{"host": "device.model"}}},
+			wantErr:  true,
+		},
+		{
+			name: "DuplicateAfterUnit",
+			mappings: []config.MetricMapping{
+				{Variable: "input.voltage", Name: "ups_input_voltage", Unit: "volts", Type: "gauge"},
+				{Variable: "output.voltage", Name: "ups_input_voltage_volts", Type: "gauge"},
+			},
+			wantErr: true,
+		},
+		{
+			name:     "ClashesWithOwnMetric",
+			mappings: []config.MetricMapping{{Variable: "ups.status", Name: "ups_up", Type: "gauge"}},
+			wantErr:  true,
+		},
+		{
+			name:     "ClashesWithQueueDepth",
+			mappings: []config.MetricMapping{{Variable: "ups.load", Name: "channel_queue_depth", Type: "gauge"}},
+			wantErr:  true,
+		},
+		{
+			name:     "GenericPrefix",
+			mappings: []config.MetricMapping{{Variable: "battery.charge", Name: "nut_battery_charge", Type: "gauge"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateMappings(tt.mappings); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateMappings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMappedExporter(t *testing.T) {
+	e, err := NewMappedExporter([]config.MetricMapping{
+		{Variable: "battery.charge", Name: "ups_battery", Unit: "ratio", Type: "gauge", Multiplier: 0.01, Labels: map[string]string{"model": "device.model"}},
+		{Variable: "input.*", Name: "ups_input", Type: "gauge"},
+		{Variable: "device.model", Name: "ups_model", Type: "info"},
+		{Variable: "ups.status", Name: "ups_status", Type: "enum-state", States: []string{"OL", "OB", "CHRG"}},
+		{Variable: "ups.counter", Name: "ups_counter", Type: "counter"},
+	})
+	if err != nil {
+		t.Fatalf("NewMappedExporter() error = %v", err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+
+	e.Update("host1", 3493, "ups1", "battery.charge", "50")
+	e.Update("host1", 3493, "ups1", "device.model", "Back-UPS")
+	e.Update("host1", 3493, "ups1", "input.voltage", "230")
+	e.Update("host1", 3493, "ups1", "input.frequency", "50")
+	e.Update("host1", 3493, "ups1", "ups.status", "OL CHRG")
+	e.Update("host1", 3493, "ups1", "ups.counter", "7")
+
+	got := gatherValues(t, reg)
+	want := map[string]float64{
+		"ups_battery_ratio{host=host1,model=Back-UPS,port=3493,ups=ups1}": 0.5,
+		"ups_input{host=host1,port=3493,ups=ups1,var=input.voltage}":      230,
+		"ups_input{host=host1,port=3493,ups=ups1,var=input.frequency}":    50,
+		"ups_model{host=host1,port=3493,ups=ups1,value=Back-UPS}":         1,
+		"ups_status{host=host1,port=3493,state=OL,ups=ups1}":              1,
+		"ups_status{host=host1,port=3493,state=OB,ups=ups1}":              0,
+		"ups_status{host=host1,port=3493,state=CHRG,ups=ups1}":            1,
+		"ups_counter{host=host1,port=3493,ups=ups1}":                      7,
+	}
+	for k, v := range want {
+		if val, ok := got[k]; !ok || val != v {
+			t.Errorf("%v = %v (present %v), want %v", k, val, ok, v)
+		}
+	}
+
+	// Swapping mappings takes effect on the next scrape, and bad ones are refused.
+	if err := e.SetMappings([]config.MetricMapping{{Variable: "input.voltage", Name: "ups_input_voltage", Type: "gauge"}}); err != nil {
+		t.Fatalf("SetMappings() error = %v", err)
+	}
+	if err := e.SetMappings([]config.MetricMapping{{Variable: "input.voltage", Name: "ups input voltage", Type: "gauge"}}); err == nil {
+		t.Errorf("SetMappings() with bad name, error = nil")
+	}
+	got = gatherValues(t, reg)
+	if len(got) != 1 || got["ups_input_voltage{host=host1,port=3493,ups=ups1}"] != 230 {
+		t.Errorf("after SetMappings() got %v", got)
+	}
+}
@@ -1,16 +1,41 @@
 package metrics
 
 import (
+	"errors"
+	"strconv"
+	"time"
+
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+	logging "github.com/gerrowadat/nut2mqtt/internal/logging"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+var logger = logging.Logger("metrics")
+
 // Nicked form the example at https://pkg.go.dev/github.com/prometheus/client_golang/prometheus
 
 type metrics struct {
 	ControlMessagesProcessed    prometheus.Counter
 	UPSScrapesCount             prometheus.Counter
 	UPSVariableUpdatesProcessed prometheus.Counter
-	MQTTUpdatesProcessed        prometheus.Counter
+	MQTTUpdatesProcessed        *prometheus.CounterVec
+	UPSDRequestErrors           *prometheus.CounterVec
+	UPSDRequestDuration         *prometheus.HistogramVec
+	MQTTPublishFailures         *prometheus.CounterVec
+	UPSLastScrape               *prometheus.GaugeVec
+	UPSCached                   prometheus.Gauge
+	UPSUp                       *prometheus.GaugeVec
+	MQTTConnected               *prometheus.GaugeVec
+	MQTTConnectionLosses        *prometheus.CounterVec
+	MQTTSessionTakeovers        *prometheus.CounterVec
+	HAActive                    prometheus.Gauge
+	MQTTQueued                  *prometheus.GaugeVec
+	MQTTQueueDropped            *prometheus.CounterVec
+	UPSPowerWatts               *prometheus.GaugeVec
+	UPSPowerVA                  *prometheus.GaugeVec
+	UPSEnergy                   *prometheus.CounterVec
+	NUTServerClients            prometheus.Gauge
+	NUTServerRequests           *prometheus.CounterVec
 }
 
 func NewMetrics(reg prometheus.Registerer) *metrics {
@@ -29,45 +54,160 @@ func NewMetrics(reg prometheus.Registerer) *metrics {
 				Help: "Number of UPS variable updates processed.",
 			},
 		),
-		MQTTUpdatesProcessed: prometheus.NewCounter(
+		MQTTUpdatesProcessed: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "mqtt_updates_processed",
-				Help: "Number of MQTT updates processed.",
+				Help: "Number of MQTT updates processed, by output.",
+			}, []string{"output"},
+		),
+		UPSDRequestErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "upsd_request_errors",
+				Help: "Number of failed upsd requests, by host, command and type (timeout, network, upsd or protocol).",
+			}, []string{"host", "command", "type"},
+		),
+		UPSDRequestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "upsd_request_duration_seconds",
+				Help:    "How long upsd requests take, by host and command.",
+				Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+			}, []string{"host", "command"},
+		),
+		MQTTPublishFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "mqtt_publish_failures",
+				Help: "Number of MQTT messages we failed to publish, by output.",
+			}, []string{"output"},
+		),
+		UPSLastScrape: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "ups_last_scrape_timestamp_seconds",
+				Help: "When we last successfully got variables for a UPS, by host, port and ups.",
+			}, []string{"host", "port", "ups"},
+		),
+		UPSCached: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "ups_cached",
+				Help: "Number of UPSes currently in the cache.",
+			},
+		),
+		UPSUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "ups_up",
+				Help: "Whether a UPS is being seen (1) or has dropped out of the cache (0), by host, port and ups.",
+			}, []string{"host", "port", "ups"},
+		),
+		MQTTConnected: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "mqtt_connected",
+				Help: "Whether we're connected to the MQTT broker (1) or not (0), by output.",
+			}, []string{"output"},
+		),
+		MQTTConnectionLosses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "mqtt_connection_losses",
+				Help: "Number of times we've lost our connection to the MQTT broker, by output.",
+			}, []string{"output"},
+		),
+		MQTTSessionTakeovers: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "mqtt_session_takeovers",
+				Help: "Number of times it looks like another client with our client ID kicked us off the MQTT broker, by output.",
+			}, []string{"output"},
+		),
+		HAActive: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "ha_active",
+				Help: "1 if we're the instance publishing UPS data, 0 if we're on standby.",
+			},
+		),
+		MQTTQueued: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "mqtt_queued_updates",
+				Help: "Number of topics with updates waiting to go to the MQTT broker, by output.",
+			}, []string{"output"},
+		),
+		MQTTQueueDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "mqtt_queue_dropped",
+				Help: "Number of queued MQTT updates dropped because the queue was full, by output.",
+			}, []string{"output"},
+		),
+		UPSPowerWatts: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "ups_power_watts",
+				Help: "Real power output, as reported or worked out from load and nominal power, by host, port and ups.",
+			}, []string{"host", "port", "ups"},
+		),
+		UPSPowerVA: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "ups_power_va",
+				Help: "Apparent power output, as reported or worked out from load and nominal power, by host, port and ups.",
+			}, []string{"host", "port", "ups"},
+		),
+		UPSEnergy: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ups_energy_kilowatt_hours_total",
+				Help: "Energy output, added up from power readings (and kept across restarts), by host, port and ups.",
+			}, []string{"host", "port", "ups"},
+		),
+		NUTServerClients: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "nut_server_clients",
+				Help: "Number of NUT clients connected to --nut-listen.",
 			},
 		),
+		NUTServerRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "nut_server_requests",
+				Help: "Number of requests from NUT clients, by command (e.g. LIST VAR) and whether they got an error.",
+			}, []string{"command", "error"},
+		),
 	}
 	reg.MustRegister(m.ControlMessagesProcessed)
 	reg.MustRegister(m.UPSScrapesCount)
+	reg.MustRegister(m.UPSVariableUpdatesProcessed)
 	reg.MustRegister(m.MQTTUpdatesProcessed)
+	reg.MustRegister(m.UPSDRequestErrors)
+	reg.MustRegister(m.UPSDRequestDuration)
+	reg.MustRegister(m.MQTTPublishFailures)
+	reg.MustRegister(m.UPSLastScrape)
+	reg.MustRegister(m.UPSCached)
+	reg.MustRegister(m.UPSUp)
+	reg.MustRegister(m.MQTTConnected)
+	reg.MustRegister(m.MQTTConnectionLosses)
+	reg.MustRegister(m.MQTTSessionTakeovers)
+	reg.MustRegister(m.HAActive)
+	reg.MustRegister(m.MQTTQueued)
+	reg.MustRegister(m.MQTTQueueDropped)
+	reg.MustRegister(m.UPSPowerWatts)
+	reg.MustRegister(m.UPSPowerVA)
+	reg.MustRegister(m.UPSEnergy)
+	reg.MustRegister(m.NUTServerClients)
+	reg.MustRegister(m.NUTServerRequests)
 
 	return m
 }
 
-func NewUPSMetrics(reg prometheus.Registerer) map[string]prometheus.Collector {
-	u := map[string]prometheus.Collector{}
-	for _, v := range UPSMetricsList {
-		if v.Type == "gaugevec" {
-			u[v.Name] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Name: v.Name,
-				Help: v.Help,
-			}, []string{"host", "ups"})
-			reg.MustRegister(u[v.Name])
-		}
-	}
-	return u
-}
-
 type MetricRegistry struct {
-	registry    *prometheus.Registry
-	metrics     *metrics
-	ups_metrics *map[string]prometheus.Collector
+	registry *prometheus.Registry
+	metrics  *metrics
+	// Exports UPS variables according to UPSMetricsList or the config file. Nil if turned off.
+	mapped *MappedExporter
+	// Exports everything, if enabled.
+	generic *GenericExporter
 }
 
 func NewMetricRegistry() *MetricRegistry {
 	var registry *prometheus.Registry = prometheus.NewRegistry()
 	m := NewMetrics(registry)
-	u := NewUPSMetrics(registry)
-	return &MetricRegistry{registry, m, &u}
+	mapped, err := NewMappedExporter(UPSMetricsList)
+	if err != nil {
+		// Only if someone's broken the built-in list.
+		panic(err)
+	}
+	registry.MustRegister(mapped)
+	return &MetricRegistry{registry: registry, metrics: m, mapped: mapped}
 }
 
 func (m *MetricRegistry) Metrics() *metrics {
@@ -78,74 +218,143 @@ func (m *MetricRegistry) Registry() *prometheus.Registry {
 	return m.registry
 }
 
-func (m *MetricRegistry) UPSMetrics() *map[string]prometheus.Collector {
-	return m.ups_metrics
+// Record how a upsd request went. err_type is empty if it succeeded.
+func (m *MetricRegistry) ObserveUPSDRequest(host string, command string, took time.Duration, err_type string) {
+	m.metrics.UPSDRequestDuration.WithLabelValues(host, command).Observe(took.Seconds())
+	if err_type != "" {
+		m.metrics.UPSDRequestErrors.WithLabelValues(host, command, err_type).Inc()
+	}
+}
+
+// Export the backlog of each of the given channels as channel_queue_depth{channel=...}
+func (m *MetricRegistry) RegisterQueueDepths(depths map[string]func() int) {
+	for name, depth := range depths {
+		m.registry.MustRegister(queueDepthGauge(name, depth))
+	}
+}
+
+func queueDepthGauge(name string, depth func() int) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "channel_queue_depth",
+		Help:        "Number of messages waiting in each internal channel.",
+		ConstLabels: prometheus.Labels{"channel": name},
+	}, func() float64 { return float64(depth()) })
 }
 
-func (m *MetricRegistry) GetUPSMetric(name string) prometheus.Collector {
-	return (*m.ups_metrics)[name]
+// Stop exporting the mapped per-variable metrics, e.g. if the generic exporter is all you want.
+func (m *MetricRegistry) DisableMappedMetrics() {
+	if m.mapped != nil {
+		m.registry.Unregister(m.mapped)
+		m.mapped = nil
+	}
 }
 
-type UPSMetrics struct {
-	Name        string
-	Help        string
-	NutVariable string
-	Type        string
+// Replace the mappings from NUT variables to metrics. Empty means go back to the built-in ones.
+func (m *MetricRegistry) SetMetricMappings(mappings []config.MetricMapping) error {
+	if m.mapped == nil {
+		return errors.New("mapped metrics are disabled")
+	}
+	if len(mappings) == 0 {
+		mappings = UPSMetricsList
+	}
+	return m.mapped.SetMappings(mappings)
+}
+
+// A variable has gone away, so drop its series.
+func (m *MetricRegistry) RemoveUPSVariable(host string, port int, ups string, varname string) {
+	if m.mapped != nil {
+		m.mapped.Remove(host, port, ups, varname)
+	}
+	if m.generic != nil {
+		m.generic.Remove(host, port, ups, varname)
+	}
+}
+
+// A UPS has gone away, so drop all its series, ups_up included, so ones that are gone for good don't pile up.
+func (m *MetricRegistry) ForgetUPS(host string, port int, ups string) {
+	if m.mapped != nil {
+		m.mapped.ForgetUPS(host, port, ups)
+	}
+	if m.generic != nil {
+		m.generic.ForgetUPS(host, port, ups)
+	}
+	labels := []string{host, strconv.Itoa(port), ups}
+	m.metrics.UPSLastScrape.DeleteLabelValues(labels...)
+	m.metrics.UPSPowerWatts.DeleteLabelValues(labels...)
+	m.metrics.UPSPowerVA.DeleteLabelValues(labels...)
+	m.metrics.UPSEnergy.DeleteLabelValues(labels...)
+	m.metrics.UPSUp.DeleteLabelValues(labels...)
+}
+
+// Export every NUT variable matching include (or everything, if empty) and not matching exclude.
+func (m *MetricRegistry) EnableGenericExporter(include []string, exclude []string, named bool) {
+	m.generic = NewGenericExporter(m.registry, include, exclude, named)
+}
+
+// Export a new value for a UPS variable, wherever it's wanted.
+func (m *MetricRegistry) UpdateUPSVariable(host string, port int, ups string, varname string, value string) {
+	if m.mapped != nil {
+		m.mapped.Update(host, port, ups, varname, value)
+	}
+	if m.generic != nil {
+		m.generic.Update(host, port, ups, varname, value)
+	}
 }
 
-var UPSMetricsList = []UPSMetrics{
+// What we export if the config file doesn't say otherwise.
+var UPSMetricsList = []config.MetricMapping{
 	{
-		Name:        "ups_output_voltage",
-		Help:        "UPS Output Voltage",
-		NutVariable: "output.voltage",
-		Type:        "gaugevec",
+		Variable: "output.voltage",
+		Name:     "ups_output_voltage",
+		Help:     "UPS Output Voltage",
+		Type:     "gauge",
 	},
 	{
-		Name:        "ups_output_current",
-		Help:        "UPS Output Current",
-		NutVariable: "output.current",
-		Type:        "gaugevec",
+		Variable: "output.current",
+		Name:     "ups_output_current",
+		Help:     "UPS Output Current",
+		Type:     "gauge",
 	},
 	{
-		Name:        "ups_output_frequency",
-		Help:        "UPS Output frequency",
-		NutVariable: "output.frequency",
-		Type:        "gaugevec",
+		Variable: "output.frequency",
+		Name:     "ups_output_frequency",
+		Help:     "UPS Output frequency",
+		Type:     "gauge",
 	},
 	{
-		Name:        "ups_input_voltage",
-		Help:        "UPS Input Voltage",
-		NutVariable: "input.voltage",
-		Type:        "gaugevec",
+		Variable: "input.voltage",
+		Name:     "ups_input_voltage",
+		Help:     "UPS Input Voltage",
+		Type:     "gauge",
 	},
 	{
-		Name:        "ups_input_current",
-		Help:        "UPS Input Current",
-		NutVariable: "input.current",
-		Type:        "gaugevec",
+		Variable: "input.current",
+		Name:     "ups_input_current",
+		Help:     "UPS Input Current",
+		Type:     "gauge",
 	},
 	{
-		Name:        "ups_input_frequency",
-		Help:        "UPS Input Frequency",
-		NutVariable: "input.frequency",
-		Type:        "gaugevec",
+		Variable: "input.frequency",
+		Name:     "ups_input_frequency",
+		Help:     "UPS Input Frequency",
+		Type:     "gauge",
 	},
 	{
-		Name:        "ups_load",
-		Help:        "UPS Load",
-		NutVariable: "ups.load",
-		Type:        "gaugevec",
+		Variable: "ups.load",
+		Name:     "ups_load",
+		Help:     "UPS Load",
+		Type:     "gauge",
 	},
 	{
-		Name:        "ups_battery_voltage",
-		Help:        "UPS Battery Voltage",
-		NutVariable: "battery.voltage",
-		Type:        "gaugevec",
+		Variable: "battery.voltage",
+		Name:     "ups_battery_voltage",
+		Help:     "UPS Battery Voltage",
+		Type:     "gauge",
 	},
 	{
-		Name:        "ups_battery_charge",
-		Help:        "Battery charge percentage",
-		NutVariable: "battery.charge",
-		Type:        "gaugevec",
+		Variable: "battery.charge",
+		Name:     "ups_battery_charge",
+		Help:     "Battery charge percentage",
+		Type:     "gauge",
 	},
 }
@@ -0,0 +1,101 @@
+package mqtt
+
+// Home Assistant MQTT discovery for the derived power and energy variables, so they turn up as sensors
+// (and can go straight on the energy dashboard) without any YAML.
+
+import (
+	"encoding/json"
+	"regexp"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	control "github.com/gerrowadat/nut2mqtt/internal/control"
+)
+
+const DefaultHADiscoveryPrefix = "homeassistant"
+
+type haSensor struct {
+	// Last bit of the object ID, and what to call it.
+	key          string
+	name         string
+	device_class string
+	state_class  string
+}
+
+var haSensors = map[string]haSensor{
+	control.DerivedRealPowerVar:     {key: "power", name: "Power", device_class: "power", state_class: "measurement"},
+	control.DerivedApparentPowerVar: {key: "apparent_power", name: "Apparent power", device_class: "apparent_power", state_class: "measurement"},
+	control.DerivedEnergyVar:        {key: "energy", name: "Energy", device_class: "energy", state_class: "total_increasing"},
+}
+
+// Home Assistant only likes these in object IDs.
+var haObjectIDRegexp = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+type haDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+}
+
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class"`
+	StateClass        string   `json:"state_class"`
+	AvailabilityTopic string   `json:"availability_topic,omitempty"`
+	Available         string   `json:"payload_available,omitempty"`
+	NotAvailable      string   `json:"payload_not_available,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// Publish discovery configs under prefix. Empty turns it off.
+func (m *MQTTClient) SetHADiscoveryPrefix(prefix string) {
+	m.ha_discovery_prefix = prefix
+}
+
+func haObjectID(up *channels.UPSVariableUpdate) string {
+	return "nut2mqtt_" + haObjectIDRegexp.ReplaceAllString(up.UpsID, "_")
+}
+
+// Where the discovery config for a variable goes, if it gets one.
+func (m *MQTTClient) discoveryTopic(up *channels.UPSVariableUpdate) (string, haSensor, bool) {
+	s, ok := haSensors[up.VarName]
+	if !ok || m.ha_discovery_prefix == "" {
+		return "", s, false
+	}
+	return m.ha_discovery_prefix + "/sensor/" + haObjectID(up) + "/" + s.key + "/config", s, true
+}
+
+// Tell Home Assistant about a variable published on topic (under the topic base), if it's one it should know about.
+func (m *MQTTClient) announce(c *control.Controller, up *channels.UPSVariableUpdate, topic string) {
+	disc_topic, s, ok := m.discoveryTopic(up)
+	if !ok {
+		return
+	}
+	cfg := haSensorConfig{
+		Name:        s.name,
+		UniqueID:    haObjectID(up) + "_" + s.key,
+		StateTopic:  m.topic_base + topic,
+		Unit:        up.Meta.Unit,
+		DeviceClass: s.device_class,
+		StateClass:  s.state_class,
+		Device:      haDevice{Identifiers: []string{haObjectID(up)}, Name: up.DisplayName()},
+	}
+	// Our own state topic, as only the active instance announces things, and a new one announces them all again.
+	if m.will_topic != "" {
+		cfg.AvailabilityTopic, cfg.Available, cfg.NotAvailable = m.will_topic, "online", "offline"
+	}
+	out, err := json.Marshal(cfg)
+	if err != nil {
+		logger.Error("Error encoding discovery config", "output", m.name, "ups", up.DisplayName(), "var", up.VarName, "err", err)
+		return
+	}
+	m.enqueue(c, &channels.MQTTUpdate{Topic: disc_topic, UPSData: true, Absolute: true, Content: string(out), Retain: true, ContentType: "application/json"})
+}
+
+// The variable's gone, so take the sensor away again.
+func (m *MQTTClient) clearDiscovery(c *control.Controller, up *channels.UPSVariableUpdate) {
+	if disc_topic, _, ok := m.discoveryTopic(up); ok {
+		m.enqueue(c, &channels.MQTTUpdate{Topic: disc_topic, UPSData: true, Absolute: true, Content: "", Retain: true})
+	}
+}
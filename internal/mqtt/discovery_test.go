@@ -0,0 +1,62 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	control "github.com/gerrowadat/nut2mqtt/internal/control"
+)
+
+func TestHADiscovery(t *testing.T) {
+	c := control.NewController("bridge", time.Minute)
+	p := &fakePublisher{connected: true}
+	m := newMQTTClient(ClientOptions{QueueSize: 10, WillTopic: "nut/bridge/instances/nas/state"})
+	m.pub = p
+	m.SetTopicBase("nut/")
+	m.SetHADiscoveryPrefix("homeassistant")
+
+	up := &channels.UPSVariableUpdate{Host: "h", UpsName: "ups", UpsID: "h:3493/ups", VarName: control.DerivedEnergyVar, Content: "1.5", Meta: &channels.VarMetadata{Unit: "kWh"}}
+	m.HandleVariableUpdate(&c, up)
+	// Nothing to announce for the rest.
+	m.HandleVariableUpdate(&c, &channels.UPSVariableUpdate{Host: "h", UpsName: "ups", UpsID: "h:3493/ups", VarName: "ups.load", Content: "10", Meta: &channels.VarMetadata{}})
+
+	topic := "homeassistant/sensor/nut2mqtt_h_3493_ups/energy/config"
+	m.mu.Lock()
+	msg, ok := m.retained[topic]
+	m.mu.Unlock()
+	if !ok || !msg.Absolute {
+		t.Fatalf("no discovery config on %v", topic)
+	}
+	got := haSensorConfig{}
+	if err := json.Unmarshal([]byte(msg.Content), &got); err != nil {
+		t.Fatalf("bad discovery config %v: %v", msg.Content, err)
+	}
+	if got.StateTopic != "nut/hosts/h/ups/derived/energy" || got.DeviceClass != "energy" || got.StateClass != "total_increasing" || got.Unit != "kWh" || got.AvailabilityTopic != "nut/bridge/instances/nas/state" {
+		t.Errorf("discovery config = %+v", got)
+	}
+	if m.queue.Len() != 5 {
+		t.Errorf("queued %d updates, want 5", m.queue.Len())
+	}
+
+	m.flush(&c, false)
+	found := false
+	for _, pub := range p.published {
+		if pub == topic+"="+msg.Content {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("discovery config not published without the topic base: %v", p.published)
+	}
+
+	// And taken away again.
+	m.HandleVariableUpdate(&c, &channels.UPSVariableUpdate{Host: "h", UpsName: "ups", UpsID: "h:3493/ups", VarName: control.DerivedEnergyVar, Removed: true})
+	m.mu.Lock()
+	_, ok = m.retained[topic]
+	m.mu.Unlock()
+	if ok || !m.queue.Has(topic) {
+		t.Errorf("discovery config not cleared")
+	}
+}
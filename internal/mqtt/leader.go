@@ -0,0 +1,174 @@
+package mqtt
+
+// Active/standby pairs (or more) of bridges, where only the leader publishes UPS data. The leader keeps a
+// retained lease topic fresh, and if it stops, someone else takes over once the lease runs out.
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	control "github.com/gerrowadat/nut2mqtt/internal/control"
+)
+
+var errNotConnected = errors.New("not connected")
+
+// What goes on the lease topic. Empty means nobody's leader.
+type leaseMessage struct {
+	InstanceID string    `json:"instance_id"`
+	Expires    time.Time `json:"expires"`
+	// Going by the sender's clock for expiry isn't safe, so we go by when we heard it, plus this.
+	LeaseSeconds float64 `json:"lease_seconds"`
+}
+
+// Who's leader, as far as we can tell. No locking, LeaderElection does that.
+type leaderState struct {
+	id    string
+	lease time.Duration
+	// Don't claim anything until we've had a chance to hear from an existing leader.
+	claim_after time.Time
+	// Who we think is leader, and when their lease runs out, by our clock.
+	leader  string
+	expires time.Time
+	// When we last renewed our own lease, if we're leader.
+	renewed time.Time
+}
+
+func newLeaderState(id string, lease time.Duration, now time.Time) *leaderState {
+	return &leaderState{id: id, lease: lease, claim_after: now.Add(lease / 3)}
+}
+
+func (s *leaderState) active() bool {
+	return s.leader == s.id
+}
+
+// Take in a message from the lease topic.
+func (s *leaderState) observe(payload []byte, now time.Time) {
+	if len(payload) == 0 {
+		// Released, e.g. on a clean shutdown.
+		if !s.active() {
+			s.leader = ""
+		}
+		return
+	}
+	var l leaseMessage
+	if err := json.Unmarshal(payload, &l); err != nil {
+		logger.Warn("Ignoring bad HA lease", "lease", string(payload), "err", err)
+		return
+	}
+	if l.InstanceID == s.id || l.InstanceID == "" {
+		// Just us.
+		return
+	}
+	if s.active() && l.InstanceID > s.id {
+		// Two of us think we're leader. Lowest ID wins, and they'll stand down when they hear from us.
+		return
+	}
+	s.leader = l.InstanceID
+	s.expires = now.Add(time.Duration(l.LeaseSeconds * float64(time.Second)))
+}
+
+// Whether to publish our lease now, either to renew it or to take over.
+func (s *leaderState) shouldClaim(now time.Time) bool {
+	if s.active() {
+		return true
+	}
+	if now.Before(s.claim_after) {
+		return false
+	}
+	return s.leader == "" || !now.Before(s.expires)
+}
+
+// How publishing our lease went. If we can't renew it in time, someone else will have taken over.
+func (s *leaderState) claimed(now time.Time, ok bool) {
+	if ok {
+		s.leader = s.id
+		s.renewed = now
+		return
+	}
+	if s.active() && now.Sub(s.renewed) > s.lease {
+		s.leader = ""
+	}
+}
+
+func (s *leaderState) message(now time.Time) *leaseMessage {
+	return &leaseMessage{InstanceID: s.id, Expires: now.Add(s.lease), LeaseSeconds: s.lease.Seconds()}
+}
+
+type LeaderElection struct {
+	m     *MQTTClient
+	c     *control.Controller
+	topic string
+
+	mu    sync.Mutex
+	state *leaderState
+}
+
+// Elect a leader among the instances in group, through m's broker. Until we win, the controller's on standby.
+func NewLeaderElection(m *MQTTClient, c *control.Controller, group string, instance_id string, lease_time time.Duration) *LeaderElection {
+	c.SetActive(false)
+	return &LeaderElection{
+		m:     m,
+		c:     c,
+		topic: "ha/" + group + "/leader",
+		state: newLeaderState(instance_id, lease_time, time.Now()),
+	}
+}
+
+func (e *LeaderElection) Topic() string {
+	return e.topic
+}
+
+func (e *LeaderElection) Run() {
+	defer e.c.WaitGroupDone()
+	if err := e.m.Subscribe(e.topic, e.observe); err != nil {
+		// Subscriptions are redone on reconnect, so this isn't the end of the world.
+		logger.Error("Error subscribing to HA lease topic", "topic", e.topic, "err", err)
+	}
+	ticker := time.NewTicker(e.state.lease / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		e.tick(time.Now())
+	}
+}
+
+func (e *LeaderElection) observe(payload []byte) {
+	e.mu.Lock()
+	was_leader := e.state.leader
+	e.state.observe(payload, time.Now())
+	leader, active := e.state.leader, e.state.active()
+	e.mu.Unlock()
+	if leader != was_leader && leader != "" && !active {
+		logger.Info("HA leader elected", "leader", leader)
+	}
+	e.c.SetActive(active)
+}
+
+func (e *LeaderElection) tick(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state.shouldClaim(now) {
+		out, _ := json.Marshal(e.state.message(now))
+		// paho v3 quietly drops QoS 0 messages while reconnecting, so check for ourselves.
+		err := errNotConnected
+		if e.m.pub.IsConnected() {
+			err = e.m.PublishMessage(&channels.MQTTUpdate{Topic: e.topic, Content: string(out), Retain: true, ContentType: "application/json"})
+		}
+		if err != nil {
+			logger.Error("Error publishing HA lease", "topic", e.topic, "err", err)
+		}
+		e.state.claimed(now, err == nil)
+	}
+	e.c.SetActive(e.state.active())
+}
+
+// Give up the lease, so a standby can take over straight away. For clean shutdowns.
+func (e *LeaderElection) Release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state.active() {
+		e.m.PublishMessage(&channels.MQTTUpdate{Topic: e.topic, Content: "", Retain: true})
+	}
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	control "github.com/gerrowadat/nut2mqtt/internal/control"
+)
+
+func leaseFrom(t *testing.T, id string, lease time.Duration) []byte {
+	t.Helper()
+	out, err := json.Marshal(&leaseMessage{InstanceID: id, LeaseSeconds: lease.Seconds()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestLeaderState(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	lease := 30 * time.Second
+
+	// Nobody else around: wait a bit, then take over.
+	s := newLeaderState("b", lease, start)
+	if s.shouldClaim(start) {
+		t.Errorf("shouldn't claim before hearing from any existing leader")
+	}
+	if !s.shouldClaim(start.Add(10 * time.Second)) {
+		t.Errorf("should claim with no leader around")
+	}
+	s.claimed(start.Add(10*time.Second), true)
+	if !s.active() {
+		t.Errorf("should be active after claiming")
+	}
+
+	// Someone with a higher ID also thinks they're leader, so we carry on.
+	s.observe(leaseFrom(t, "c", lease), start.Add(11*time.Second))
+	if !s.active() {
+		t.Errorf("c shouldn't take over from b")
+	}
+	// But a lower one wins.
+	s.observe(leaseFrom(t, "a", lease), start.Add(12*time.Second))
+	if s.active() || s.leader != "a" {
+		t.Errorf("a should have taken over, leader is %q", s.leader)
+	}
+	if s.shouldClaim(start.Add(41 * time.Second)) {
+		t.Errorf("shouldn't claim while a's lease is good")
+	}
+	// a goes quiet, so we take over when its lease runs out.
+	if !s.shouldClaim(start.Add(42 * time.Second)) {
+		t.Errorf("should claim once a's lease runs out")
+	}
+	s.claimed(start.Add(42*time.Second), true)
+
+	// Can't renew for a while, so assume someone else has taken over.
+	s.claimed(start.Add(60*time.Second), false)
+	if !s.active() {
+		t.Errorf("should still be active within the lease")
+	}
+	s.claimed(start.Add(73*time.Second), false)
+	if s.active() {
+		t.Errorf("shouldn't be active after failing to renew for a whole lease")
+	}
+
+	// A released lease is up for grabs straight away.
+	s = newLeaderState("b", lease, start)
+	s.observe(leaseFrom(t, "a", lease), start)
+	s.observe(nil, start.Add(20*time.Second))
+	if !s.shouldClaim(start.Add(20 * time.Second)) {
+		t.Errorf("should claim a released lease")
+	}
+	// Our own lease coming back to us is nothing new, nor is junk.
+	s.observe(leaseFrom(t, "b", lease), start.Add(21*time.Second))
+	s.observe([]byte("{"), start.Add(21*time.Second))
+	if s.leader != "" {
+		t.Errorf("leader should still be nobody, is %q", s.leader)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	c := control.NewController("bridge", time.Minute)
+	p := &fakePublisher{connected: true}
+	m := newMQTTClient(ClientOptions{})
+	m.pub = p
+	m.SetTopicBase("nut/")
+	e := NewLeaderElection(m, &c, "site1", "b", 30*time.Second)
+	if c.IsActive() {
+		t.Errorf("should start on standby")
+	}
+
+	now := time.Now().Add(10 * time.Second)
+	e.tick(now)
+	if !c.IsActive() {
+		t.Errorf("should be active after claiming the lease")
+	}
+	if len(p.published) != 1 || !strings.HasPrefix(p.published[0], `nut/ha/site1/leader={"instance_id":"b"`) {
+		t.Errorf("published %v, want our lease", p.published)
+	}
+
+	e.observe(leaseFrom(t, "a", 30*time.Second))
+	if c.IsActive() {
+		t.Errorf("should be on standby once a takes over")
+	}
+	p.published = nil
+	e.tick(now.Add(10 * time.Second))
+	e.Release()
+	if len(p.published) != 0 {
+		t.Errorf("standby published %v", p.published)
+	}
+}
@@ -1,88 +1,508 @@
 package mqtt
 
 import (
-	"fmt"
-	"log"
-	"strings"
+	"crypto/tls"
+	"encoding/json"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
 	control "github.com/gerrowadat/nut2mqtt/internal/control"
+	logging "github.com/gerrowadat/nut2mqtt/internal/logging"
 )
 
-type mqttClient struct {
-	c          mqtt.Client
+var logger = logging.Logger("mqtt")
+
+// Whatever's actually talking to the broker, MQTT v3 or v5.
+type publisher interface {
+	// topic is the full topic, base and all.
+	Publish(topic string, msg *channels.MQTTUpdate, retain bool) error
+	// Subscriptions are redone on every reconnect.
+	Subscribe(topic string, handler func(payload []byte)) error
+	IsConnected() bool
+	Disconnect(quiesce uint)
+}
+
+type ClientOptions struct {
+	// e.g. tcp://host:1883 or ssl://host:8883
+	URL      string
+	User     string
+	Password string
+	// Has to be unique on the broker, or whoever else has it keeps kicking us off.
+	ClientID string
+	// Can be nil, for the defaults.
+	TLS *tls.Config
+	// If set, the broker publishes a retained "offline" here if we go away without saying so.
+	WillTopic string
+	// How many topics' worth of updates to hold on to while the broker's away.
+	QueueSize int
+	// 0, 1 or 2
+	QoS byte
+}
+
+// Tells UpdateConsumer the connection's gone up or down. Shared between copies of the client.
+type connState struct {
+	changed chan struct{}
+	// Set when the broker says (MQTT v5 only) someone else has connected with our client ID.
+	taken_over atomic.Bool
+}
+
+func (s *connState) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+		// Already on its way.
+	}
+}
+
+// One MQTT broker we publish to, with its own queue, so a slow or missing broker only holds itself up.
+type MQTTClient struct {
+	// Which output this is, for logs and metrics.
+	name       string
+	client_id  string
+	pub        publisher
 	topic_base string
+	// Where we say whether we're online, including the topic base.
+	will_topic string
+	// Where to publish Home Assistant discovery configs, e.g. homeassistant. Empty for not at all.
+	ha_discovery_prefix string
+	// Retain every message, not just the ones that ask for it.
+	retain bool
+	topics *TopicRenderer
+	// Globs on NUT variable names. An empty include list means everything.
+	include []string
+	exclude []string
+	conn    *connState
+	// Only used from Run.
+	takeovers *takeoverDetector
+	// Poked whenever there's something new in the queue.
+	pending chan struct{}
+
+	mu sync.Mutex
+	// Updates waiting to go out, including while the broker's away.
+	queue *offlineQueue
+	// The latest retained message on each topic, to put back if the broker's forgotten them.
+	retained map[string]*channels.MQTTUpdate
+}
+
+func newMQTTClient(opts ClientOptions) *MQTTClient {
+	if opts.ClientID == "" {
+		opts.ClientID = "nut2mqtt"
+	}
+	return &MQTTClient{
+		name:       "default",
+		client_id:  opts.ClientID,
+		will_topic: opts.WillTopic,
+		topics:     defaultTopicRenderer,
+		conn:       &connState{changed: make(chan struct{}, 1)},
+		takeovers:  newTakeoverDetector(),
+		pending:    make(chan struct{}, 1),
+		queue:      newOfflineQueue(opts.QueueSize),
+		retained:   map[string]*channels.MQTTUpdate{},
+	}
 }
 
-func NewMQTTClient(mqtt_url string, user *string, pass *string) (mqttClient, error) {
+func NewMQTTClient(o ClientOptions) (*MQTTClient, error) {
 
-	ret := mqttClient{}
+	ret := newMQTTClient(o)
 
-	log.Print("Connecting to MQTT at " + mqtt_url + " as " + *user)
+	logger.Info("Connecting to MQTT", "url", o.URL, "user", o.User, "client_id", ret.client_id)
+	p := &mqtt3Publisher{qos: o.QoS, subs: map[string]func([]byte){}}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(mqtt_url)
-	opts.SetClientID("nut2mqtt")
-	opts.SetUsername(*user)
-	opts.SetPassword(*pass)
-	client := mqtt.NewClient(opts)
+	opts.AddBroker(o.URL)
+	opts.SetClientID(ret.client_id)
+	opts.SetUsername(o.User)
+	opts.SetPassword(o.Password)
+	if o.TLS != nil {
+		opts.SetTLSConfig(o.TLS)
+	}
+	if o.WillTopic != "" {
+		opts.SetWill(o.WillTopic, "offline", o.QoS, true)
+	}
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(time.Minute)
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		p.resubscribe()
+		ret.conn.notify()
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		logger.Warn("Lost connection to MQTT", "url", o.URL, "err", err)
+		ret.conn.notify()
+	})
+	p.c = mqtt.NewClient(opts)
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return ret, error(token.Error())
+	if token := p.c.Connect(); token.Wait() && token.Error() != nil {
+		return nil, error(token.Error())
 	}
 
-	ret.c = client
+	ret.pub = p
 
 	return ret, nil
 }
 
-func (m *mqttClient) SetTopicBase(topic_base string) {
+type mqtt3Publisher struct {
+	c    mqtt.Client
+	qos  byte
+	mu   sync.Mutex
+	subs map[string]func(payload []byte)
+}
+
+// v3 has nowhere to put properties, so it's just the content.
+func (p *mqtt3Publisher) Publish(topic string, msg *channels.MQTTUpdate, retain bool) error {
+	pub_tok := p.c.Publish(topic, p.qos, retain, msg.Content)
+	pub_tok.Wait()
+	return pub_tok.Error()
+}
+
+func (p *mqtt3Publisher) subscribe(topic string, handler func([]byte)) error {
+	tok := p.c.Subscribe(topic, 0, func(_ mqtt.Client, msg mqtt.Message) { handler(msg.Payload()) })
+	tok.Wait()
+	return tok.Error()
+}
+
+func (p *mqtt3Publisher) Subscribe(topic string, handler func(payload []byte)) error {
+	p.mu.Lock()
+	p.subs[topic] = handler
+	p.mu.Unlock()
+	return p.subscribe(topic, handler)
+}
+
+// We connect with a clean session, so the broker forgets our subscriptions whenever we reconnect.
+func (p *mqtt3Publisher) resubscribe() {
+	p.mu.Lock()
+	subs := map[string]func([]byte){}
+	for t, h := range p.subs {
+		subs[t] = h
+	}
+	p.mu.Unlock()
+	// Can't wait on a subscription from within the OnConnect handler.
+	go func() {
+		for t, h := range subs {
+			if err := p.subscribe(t, h); err != nil {
+				logger.Error("Error resubscribing", "topic", t, "err", err)
+			}
+		}
+	}()
+}
+
+func (p *mqtt3Publisher) IsConnected() bool {
+	return p.c.IsConnectionOpen()
+}
+
+func (p *mqtt3Publisher) Disconnect(quiesce uint) {
+	p.c.Disconnect(quiesce)
+}
+
+func (m *MQTTClient) Name() string {
+	return m.name
+}
+
+func (m *MQTTClient) SetName(name string) {
+	m.name = name
+}
+
+func (m *MQTTClient) ClientID() string {
+	return m.client_id
+}
+
+// Only send variables matching these globs. An empty include list means everything.
+func (m *MQTTClient) SetVariableFilter(include []string, exclude []string) {
+	m.include = include
+	m.exclude = exclude
+}
+
+func (m *MQTTClient) wants(varname string) bool {
+	for _, pat := range m.exclude {
+		if ok, _ := path.Match(pat, varname); ok {
+			return false
+		}
+	}
+	if len(m.include) == 0 {
+		return true
+	}
+	for _, pat := range m.include {
+		if ok, _ := path.Match(pat, varname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MQTTClient) SetTopicBase(topic_base string) {
 	m.topic_base = topic_base
 }
 
-func (m *mqttClient) GetTopicBase() string {
+func (m *MQTTClient) GetTopicBase() string {
 	return m.topic_base
 }
 
-func (m *mqttClient) PublishMessage(msg *channels.MQTTUpdate) error {
-	pub_tok := m.c.Publish(m.topic_base+msg.Topic, 0, false, msg.Content)
-	pub_tok.Wait()
+func (m *MQTTClient) SetRetain(retain bool) {
+	m.retain = retain
+}
+
+func (m *MQTTClient) PublishMessage(msg *channels.MQTTUpdate) error {
+	return m.pub.Publish(m.fullTopic(msg), msg, msg.Retain || m.retain)
+}
 
-	if pub_tok.Error() != nil {
-		return error(pub_tok.Error())
+// Where an update actually goes on the broker.
+func (m *MQTTClient) fullTopic(msg *channels.MQTTUpdate) string {
+	if msg.Absolute {
+		return msg.Topic
 	}
-	return nil
+	return m.topic_base + msg.Topic
+}
+
+// Listen on a topic under the topic base. Survives reconnects.
+func (m *MQTTClient) Subscribe(topic string, handler func(payload []byte)) error {
+	return m.pub.Subscribe(m.topic_base+topic, handler)
 }
 
-func (m *mqttClient) Disconnect(code uint) {
-	m.c.Disconnect(code)
+func (m *MQTTClient) Disconnect(code uint) {
+	m.pub.Disconnect(code)
 }
 
+// The topic for an update, with the default template.
 func TopicFromUPSVariableUpdate(up *channels.UPSVariableUpdate) string {
-	ret := fmt.Sprintf("hosts/%v/%v/%v", up.Host, up.UpsName, up.VarName)
-	return strings.Replace(ret, ".", "/", -1)
+	ret, _ := defaultTopicRenderer.Topic(up)
+	return ret
 }
 
-func (m *mqttClient) UpdateProducer(c *control.Controller) {
-	// Take in UPSVariableUpdate messages and spit out MQTTUpdate messages to be consumed.
-	defer c.WaitGroupDone()
-	for {
-		up := <-c.Channels().MqttConverter
-		topic := TopicFromUPSVariableUpdate(up)
-		c.Channels().Mqtt <- &channels.MQTTUpdate{Topic: topic, Content: up.Content, OldContent: up.OldContent}
+func MetaTopicFromUPSVariableUpdate(up *channels.UPSVariableUpdate) string {
+	ret, _ := defaultTopicRenderer.MetaTopic(up)
+	return ret
+}
+
+func (m *MQTTClient) SetTopicTemplate(tmpl string) error {
+	r, err := NewTopicRenderer(tmpl)
+	if err != nil {
+		return err
+	}
+	m.topics = r
+	return nil
+}
+
+// Turn a variable update into MQTT updates, and queue them.
+func (m *MQTTClient) HandleVariableUpdate(c *control.Controller, up *channels.UPSVariableUpdate) {
+	if !m.wants(up.VarName) {
+		return
+	}
+	topic, err := m.topics.Topic(up)
+	if err != nil {
+		logger.Error("Error working out topic", "output", m.name, "host", up.Host, "ups", up.DisplayName(), "var", up.VarName, "err", err)
+		return
+	}
+	meta_topic := topic + "/$meta"
+	if up.Removed {
+		// An empty retained message clears whatever the broker was holding on to.
+		m.enqueue(c, &channels.MQTTUpdate{Topic: topic, UPSData: true, Content: "", OldContent: up.OldContent, Retain: true})
+		m.enqueue(c, &channels.MQTTUpdate{Topic: meta_topic, UPSData: true, Content: "", Retain: true})
+		m.clearDiscovery(c, up)
+		return
+	}
+	props := map[string]string{"host": up.Host, "ups": up.DisplayName(), "var": up.VarName}
+	if up.OldContent != "" {
+		props["old"] = up.OldContent
+	}
+	m.enqueue(c, &channels.MQTTUpdate{Topic: topic, UPSData: true, Content: up.Content, OldContent: up.OldContent, ContentType: "text/plain", Properties: props, Volatile: true})
+	if up.Meta != nil {
+		// Retained, so anything subscribing later can still label things properly.
+		meta, err := json.Marshal(up.Meta)
+		if err != nil {
+			logger.Error("Error encoding metadata", "host", up.Host, "ups", up.DisplayName(), "var", up.VarName, "err", err)
+			return
+		}
+		m.enqueue(c, &channels.MQTTUpdate{Topic: meta_topic, UPSData: true, Content: string(meta), Retain: true, ContentType: "application/json"})
+		m.announce(c, up, topic)
 	}
 }
 
-func (m *mqttClient) UpdateConsumer(c *control.Controller) {
+// Queue an update to go out as soon as it can. Never blocks.
+func (m *MQTTClient) enqueue(c *control.Controller, update *channels.MQTTUpdate) {
+	m.mu.Lock()
+	if update.Retain || m.retain {
+		if update.Content == "" {
+			delete(m.retained, update.Topic)
+		} else {
+			m.retained[update.Topic] = update
+		}
+	}
+	dropped := m.queue.Add(update, !m.pub.IsConnected())
+	queued := m.queue.Len()
+	m.mu.Unlock()
+	if dropped > 0 {
+		c.MetricRegistry().Metrics().MQTTQueueDropped.WithLabelValues(m.name).Add(float64(dropped))
+	}
+	c.MetricRegistry().Metrics().MQTTQueued.WithLabelValues(m.name).Set(float64(queued))
+	select {
+	case m.pending <- struct{}{}:
+	default:
+	}
+}
+
+// How long to wait before trying publishes that failed while we were connected again.
+const (
+	minRetryInterval = time.Second
+	maxRetryInterval = time.Minute
+)
+
+// Back off from minRetryInterval to maxRetryInterval, doubling each time. 0 is for the first retry.
+func nextRetryInterval(last time.Duration) time.Duration {
+	if last == 0 {
+		return minRetryInterval
+	}
+	return min(2*last, maxRetryInterval)
+}
+
+// Publish whatever's queued, for as long as the broker's there.
+func (m *MQTTClient) Run(c *control.Controller) {
 	defer c.WaitGroupDone()
+	mr := c.MetricRegistry().Metrics()
+	connected := m.pub.IsConnected()
+	if connected {
+		mr.MQTTConnected.WithLabelValues(m.name).Set(1)
+		m.takeovers.up(time.Now())
+	}
+	// If publishes fail while we're connected, nothing else might come along to try them again for a
+	// long while on a quiet output, so retry on a timer.
+	var retry <-chan time.Time
+	retry_interval := time.Duration(0)
+	flush := func(republish bool) {
+		if m.flush(c, republish) {
+			retry_interval = nextRetryInterval(retry_interval)
+			retry = time.After(retry_interval)
+		} else {
+			retry, retry_interval = nil, 0
+		}
+	}
 	for {
-		update := <-c.Channels().Mqtt
-		old := update.OldContent
-		if old == "" {
-			old = "[null]"
+		select {
+		case <-m.pending:
+			if connected {
+				flush(false)
+			}
+		case <-retry:
+			retry = nil
+			if connected {
+				flush(false)
+			}
+		case <-m.conn.changed:
+			was_connected := connected
+			connected = m.pub.IsConnected()
+			if connected {
+				mr.MQTTConnected.WithLabelValues(m.name).Set(1)
+				m.takeovers.up(time.Now())
+				logger.Info("Connected to MQTT, republishing retained topics and anything queued", "output", m.name)
+				flush(true)
+			} else {
+				mr.MQTTConnected.WithLabelValues(m.name).Set(0)
+				if was_connected {
+					mr.MQTTConnectionLosses.WithLabelValues(m.name).Inc()
+					if m.takeovers.down(time.Now(), m.conn.taken_over.Swap(false)) {
+						mr.MQTTSessionTakeovers.WithLabelValues(m.name).Inc()
+						logger.Warn("Looks like something else is connecting with our client ID and kicking us off. Give each instance its own --instance-id or --mqtt-client-id", "output", m.name, "client_id", m.client_id)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Send everything that's queued. With republish, first put back whatever retained state the broker may have lost.
+// Returns whether anything failed to publish while we were connected, and so wants retrying.
+func (m *MQTTClient) flush(c *control.Controller, republish bool) bool {
+	mr := c.MetricRegistry().Metrics()
+	m.mu.Lock()
+	if !c.IsActive() {
+		m.dropUPSData()
+	}
+	updates := []*channels.MQTTUpdate{}
+	if republish {
+		topics := []string{}
+		for t := range m.retained {
+			if !m.queue.Has(t) {
+				topics = append(topics, t)
+			}
+		}
+		sort.Strings(topics)
+		for _, t := range topics {
+			updates = append(updates, m.retained[t])
+		}
+	}
+	updates = append(updates, m.queue.Drain()...)
+	m.mu.Unlock()
+	mr.MQTTQueued.WithLabelValues(m.name).Set(0)
+
+	failed := false
+	for i, update := range updates {
+		if !m.pub.IsConnected() {
+			// Gone again, so put the rest back for next time.
+			m.requeue(c, updates[i:])
+			return false
+		}
+		m.logUpdate(update)
+		mr.MQTTUpdatesProcessed.WithLabelValues(m.name).Inc()
+		if err := m.PublishMessage(update); err != nil {
+			logger.Error("Error publishing", "output", m.name, "topic", m.fullTopic(update), "err", err)
+			mr.MQTTPublishFailures.WithLabelValues(m.name).Inc()
+			m.requeue(c, []*channels.MQTTUpdate{update})
+			failed = true
+		}
+	}
+	return failed
+}
+
+// On standby, forget any UPS data we were going to publish (or put back after a reconnect), as it's the
+// active instance's to publish now, and ours is only going to get staler. Call with mu held.
+func (m *MQTTClient) dropUPSData() {
+	for t, u := range m.retained {
+		if u.UPSData {
+			delete(m.retained, t)
+		}
+	}
+	for _, u := range m.queue.Drain() {
+		if !u.UPSData {
+			m.queue.Add(u, false)
+		}
+	}
+}
+
+// Put updates back in the queue, unless something newer's turned up for the same topic meanwhile.
+func (m *MQTTClient) requeue(c *control.Controller, updates []*channels.MQTTUpdate) {
+	offline := !m.pub.IsConnected()
+	m.mu.Lock()
+	dropped := 0
+	for _, u := range updates {
+		if !m.queue.Has(u.Topic) {
+			dropped += m.queue.Add(u, offline)
+		}
+	}
+	queued := m.queue.Len()
+	m.mu.Unlock()
+	if dropped > 0 {
+		c.MetricRegistry().Metrics().MQTTQueueDropped.WithLabelValues(m.name).Add(float64(dropped))
+	}
+	c.MetricRegistry().Metrics().MQTTQueued.WithLabelValues(m.name).Set(float64(queued))
+}
+
+func (m *MQTTClient) logUpdate(update *channels.MQTTUpdate) {
+	old := update.OldContent
+	if old == "" {
+		old = "[null]"
+	}
+	content := update.Content
+	if content == "" && update.Retain {
+		content = "[cleared]"
+	}
+	attrs := []any{"output", m.name, "topic", m.fullTopic(update), "old", old, "new", content}
+	// Values say which UPS and variable they're for.
+	for _, k := range []string{"host", "ups", "var"} {
+		if v, ok := update.Properties[k]; ok {
+			attrs = append(attrs, k, v)
 		}
-		log.Printf("MQTT Change: [%v]\t%v -> %v ", m.GetTopicBase()+update.Topic, old, update.Content)
-		c.MetricRegistry().Metrics().MQTTUpdatesProcessed.Inc()
-		m.PublishMessage(update)
 	}
+	logger.Debug("MQTT change", attrs...)
 }
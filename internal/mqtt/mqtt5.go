@@ -0,0 +1,318 @@
+package mqtt
+
+// MQTT v5, for user properties, content types, message expiry, topic aliases and request/response.
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+)
+
+type MQTT5Options struct {
+	// How long volatile readings live on the broker. Zero means forever.
+	MessageExpiry time.Duration
+	// The most topic aliases we'll use, if the broker allows that many. Zero turns them off.
+	TopicAliases uint16
+}
+
+// DISCONNECT reason code for another client connecting with our client ID.
+const sessionTakenOver = 0x8E
+
+// Answers a request that came in on the request topic. What comes back goes to the response topic.
+type RequestHandler func(request string) (string, error)
+
+// Hands out topic aliases, first come first served, until we run out.
+type topicAliases struct {
+	mu      sync.Mutex
+	max     uint16
+	aliases map[string]uint16
+	// Topics the broker knows the alias for, as we've sent the two together successfully.
+	known map[string]bool
+	// Bumped on every reset, so a packet built for an old connection can be spotted before it goes out on a new one.
+	generation uint64
+}
+
+// Start again, e.g. on a new connection, where the broker has forgotten any aliases we set.
+func (t *topicAliases) reset(max uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.generation++
+	t.max = max
+	t.aliases = map[string]uint16{}
+	t.known = map[string]bool{}
+}
+
+// The alias for a topic, whether the broker needs the topic sent along with it, and which generation of
+// aliases that's from. An alias of 0 means we're out of them, so just send the topic.
+func (t *topicAliases) alias(topic string) (uint16, bool, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a, ok := t.aliases[topic]; ok {
+		return a, !t.known[topic], t.generation
+	}
+	if len(t.aliases) >= int(t.max) {
+		return 0, true, t.generation
+	}
+	a := uint16(len(t.aliases) + 1)
+	t.aliases[topic] = a
+	return a, true, t.generation
+}
+
+func (t *topicAliases) current(generation uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.generation == generation
+}
+
+// The topic's gone out with its alias, so the broker knows it - as long as that was on this connection.
+func (t *topicAliases) sent(topic string, generation uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.aliases[topic]; ok && t.generation == generation {
+		t.known[topic] = true
+	}
+}
+
+type mqtt5Publisher struct {
+	cm      *autopaho.ConnectionManager
+	opts    MQTT5Options
+	qos     byte
+	aliases topicAliases
+
+	connected atomic.Bool
+	conn      *connState
+
+	mu            sync.Mutex
+	request_topic string
+	handler       RequestHandler
+	// Other subscriptions, by (exact) topic.
+	subs map[string]func(payload []byte)
+}
+
+func NewMQTT5Client(o ClientOptions, opts MQTT5Options) (*MQTTClient, error) {
+	ret := newMQTTClient(o)
+
+	logger.Info("Connecting to MQTT v5", "url", o.URL, "user", o.User, "client_id", ret.client_id)
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return nil, err
+	}
+	p := &mqtt5Publisher{opts: opts, qos: o.QoS, conn: ret.conn, subs: map[string]func([]byte){}}
+	p.aliases.reset(0)
+	cfg := autopaho.ClientConfig{
+		ServerUrls:      []*url.URL{u},
+		TlsCfg:          o.TLS,
+		KeepAlive:       30,
+		ConnectUsername: o.User,
+		ConnectPassword: []byte(o.Password),
+		// Back off from a second or two between tries to a minute.
+		ReconnectBackoff: autopaho.NewExponentialBackoff(time.Second, time.Minute, 2*time.Second, 2),
+		OnConnectionUp:   p.onConnectionUp,
+		OnConnectionDown: p.onConnectionDown,
+		OnConnectError:   func(err error) { logger.Error("Error connecting to MQTT", "url", o.URL, "err", err) },
+		ClientConfig: paho.ClientConfig{
+			ClientID:           ret.client_id,
+			OnPublishReceived:  []func(paho.PublishReceived) (bool, error){p.onPublishReceived},
+			OnServerDisconnect: p.onServerDisconnect,
+		},
+	}
+	if o.WillTopic != "" {
+		cfg.WillMessage = &paho.WillMessage{Topic: o.WillTopic, Payload: []byte("offline"), QoS: o.QoS, Retain: true}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	p.cm, err = autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.cm.AwaitConnection(ctx); err != nil {
+		// Otherwise it keeps trying in the background, will and all, for a client nobody's using.
+		p.Disconnect(250)
+		return nil, fmt.Errorf("timed out connecting to %v: %v", o.URL, err)
+	}
+	ret.pub = p
+	return ret, nil
+}
+
+func (p *mqtt5Publisher) onConnectionUp(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+	max := uint16(0)
+	if connack.Properties != nil && connack.Properties.TopicAliasMaximum != nil {
+		max = min(*connack.Properties.TopicAliasMaximum, p.opts.TopicAliases)
+	}
+	p.aliases.reset(max)
+	p.connected.Store(true)
+	p.conn.notify()
+	// We're not keeping a session, so subscribe all over again.
+	p.mu.Lock()
+	topics := []string{}
+	if p.request_topic != "" {
+		topics = append(topics, p.request_topic)
+	}
+	for t := range p.subs {
+		topics = append(topics, t)
+	}
+	p.mu.Unlock()
+	// Can't block in here.
+	go func() {
+		for _, t := range topics {
+			p.subscribe(cm, t)
+		}
+	}()
+}
+
+func (p *mqtt5Publisher) onConnectionDown() bool {
+	logger.Warn("Lost connection to MQTT")
+	// No aliases until we hear what the next connection allows, and anything built with the old ones is stale.
+	p.aliases.reset(0)
+	p.connected.Store(false)
+	p.conn.notify()
+	// Keep trying.
+	return true
+}
+
+func (p *mqtt5Publisher) onServerDisconnect(d *paho.Disconnect) {
+	if d.ReasonCode == sessionTakenOver {
+		p.conn.taken_over.Store(true)
+	}
+	logger.Warn("MQTT broker disconnected us", "reason_code", fmt.Sprintf("0x%02x", d.ReasonCode))
+}
+
+func (p *mqtt5Publisher) IsConnected() bool {
+	return p.connected.Load()
+}
+
+func (p *mqtt5Publisher) Subscribe(topic string, handler func(payload []byte)) error {
+	p.mu.Lock()
+	p.subs[topic] = handler
+	p.mu.Unlock()
+	return p.subscribe(p.cm, topic)
+}
+
+func (p *mqtt5Publisher) subscribe(cm *autopaho.ConnectionManager, topic string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: 0}}})
+	if err != nil {
+		logger.Error("Error subscribing", "topic", topic, "err", err)
+	}
+	return err
+}
+
+// Listen for requests on topic, and answer them with handler on whatever response topic they ask for.
+func (p *mqtt5Publisher) SetRequestHandler(topic string, handler RequestHandler) {
+	p.mu.Lock()
+	p.request_topic = topic
+	p.handler = handler
+	p.mu.Unlock()
+	p.subscribe(p.cm, topic)
+}
+
+func (p *mqtt5Publisher) onPublishReceived(pr paho.PublishReceived) (bool, error) {
+	p.mu.Lock()
+	topic, handler := p.request_topic, p.handler
+	sub := p.subs[pr.Packet.Topic]
+	p.mu.Unlock()
+	if sub != nil {
+		sub(pr.Packet.Payload)
+		return true, nil
+	}
+	if handler == nil || pr.Packet.Topic != topic {
+		return false, nil
+	}
+	var response_topic string
+	var correlation []byte
+	if pr.Packet.Properties != nil {
+		response_topic = pr.Packet.Properties.ResponseTopic
+		correlation = pr.Packet.Properties.CorrelationData
+	}
+	if response_topic == "" {
+		logger.Warn("Ignoring request with no response topic", "topic", topic)
+		return true, nil
+	}
+	reply := &channels.MQTTUpdate{ContentType: "application/json", CorrelationData: correlation, Properties: map[string]string{}}
+	content, err := handler(string(pr.Packet.Payload))
+	if err != nil {
+		reply.Properties["error"] = err.Error()
+	}
+	reply.Content = content
+	// Don't hold up whatever else paho's got to deliver.
+	go func() {
+		// Response topics are usually one-offs, so not worth an alias.
+		if err := p.publish(response_topic, reply, false, false); err != nil {
+			logger.Error("Error replying to request", "topic", response_topic, "err", err)
+		}
+	}()
+	return true, nil
+}
+
+func (p *mqtt5Publisher) Publish(topic string, msg *channels.MQTTUpdate, retain bool) error {
+	return p.publish(topic, msg, retain, true)
+}
+
+func (p *mqtt5Publisher) publish(topic string, msg *channels.MQTTUpdate, retain bool, use_alias bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pub, gen := p.packet(topic, msg, retain, use_alias)
+	_, err := p.cm.Publish(ctx, pub)
+	if err != nil && !p.aliases.current(gen) {
+		// We reconnected in the meantime, so the alias we used may mean nothing to the broker now.
+		// Have another go with whatever the new connection needs.
+		pub, gen = p.packet(topic, msg, retain, use_alias)
+		_, err = p.cm.Publish(ctx, pub)
+	}
+	if err != nil {
+		return err
+	}
+	p.aliases.sent(topic, gen)
+	return nil
+}
+
+// The packet to publish, and the generation of aliases it was built with.
+func (p *mqtt5Publisher) packet(topic string, msg *channels.MQTTUpdate, retain bool, use_alias bool) (*paho.Publish, uint64) {
+	props := &paho.PublishProperties{ContentType: msg.ContentType, CorrelationData: msg.CorrelationData}
+	keys := []string{}
+	for k := range msg.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		props.User.Add(k, msg.Properties[k])
+	}
+	if msg.Volatile && p.opts.MessageExpiry > 0 {
+		expiry := uint32(p.opts.MessageExpiry.Seconds())
+		props.MessageExpiry = &expiry
+	}
+	pub := &paho.Publish{Topic: topic, QoS: p.qos, Retain: retain, Payload: []byte(msg.Content), Properties: props}
+	alias, with_topic, gen := uint16(0), true, uint64(0)
+	if use_alias {
+		alias, with_topic, gen = p.aliases.alias(topic)
+	}
+	if alias != 0 {
+		props.TopicAlias = &alias
+	}
+	if !with_topic {
+		pub.Topic = ""
+	}
+	return pub, gen
+}
+
+func (p *mqtt5Publisher) Disconnect(quiesce uint) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancel()
+	p.cm.Disconnect(ctx)
+}
+
+// Only MQTT v5 has response topics, so this does nothing otherwise.
+func (m *MQTTClient) SetRequestHandler(topic string, handler RequestHandler) {
+	if p, ok := m.pub.(*mqtt5Publisher); ok {
+		p.SetRequestHandler(m.topic_base+topic, handler)
+	}
+}
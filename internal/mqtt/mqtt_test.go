@@ -1,8 +1,11 @@
 package mqtt
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/eclipse/paho.golang/paho"
 	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
 )
 
@@ -34,3 +37,145 @@ func TestTopicFromUPSVariableUpdate(t *testing.T) {
 		})
 	}
 }
+
+func TestMetaTopicFromUPSVariableUpdate(t *testing.T) {
+	up := &channels.UPSVariableUpdate{Host: "host1", UpsName: "ups1", VarName: "battery.charge", Content: "100"}
+	want := "hosts/host1/ups1/battery/charge/$meta"
+	if got := MetaTopicFromUPSVariableUpdate(up); got != want {
+		t.Errorf("MetaTopicFromUPSVariableUpdate() = %v, want %v", got, want)
+	}
+}
+
+func TestTopicRenderer(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		up      *channels.UPSVariableUpdate
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Default",
+			tmpl: DefaultTopicTemplate,
+			up:   &channels.UPSVariableUpdate{Host: "host1", UpsName: "ups1", VarName: "battery.charge"},
+			want: "hosts/host1/ups1/battery/charge",
+		},
+		{
+			name: "Alias",
+			tmpl: DefaultTopicTemplate,
+			up:   &channels.UPSVariableUpdate{Host: "host1", UpsName: "ups1", Alias: "rack-a", VarName: "battery.charge"},
+			want: "hosts/host1/rack-a/battery/charge",
+		},
+		{
+			name: "Flat",
+			tmpl: "ups/{{.Ups}}/{{.Var | underscores}}",
+			up:   &channels.UPSVariableUpdate{Host: "host1", UpsName: "ups1", VarName: "battery.charge"},
+			want: "ups/ups1/battery_charge",
+		},
+		{
+			name: "AliasField",
+			tmpl: "{{.Alias}}/{{.Var | slashes}}",
+			up:   &channels.UPSVariableUpdate{Host: "host1", UpsName: "ups1", Alias: "rack-a", VarName: "battery.charge"},
+			want: "rack-a/battery/charge",
+		},
+		{
+			name: "AliasFieldUnset",
+			tmpl: "ups/{{.Name}}/{{.Alias}}",
+			up:   &channels.UPSVariableUpdate{Host: "host1", UpsName: "ups1", VarName: "battery.charge"},
+			want: "ups/ups1/",
+		},
+		{
+			name: "PerUPSOverride",
+			tmpl: DefaultTopicTemplate,
+			up:   &channels.UPSVariableUpdate{Host: "host1", UpsName: "ups1", TopicTemplate: "{{.Name | lower}}/{{.Var}}", VarName: "battery.charge"},
+			want: "ups1/battery.charge",
+		},
+		{
+			name: "Sanitised",
+			tmpl: "/{{.Host}}/{{.Ups}}/{{.Var}}",
+			up:   &channels.UPSVariableUpdate{Host: "host#1", UpsName: "ups+1", VarName: "battery.charge"},
+			want: "host_1/ups_1/battery.charge",
+		},
+		{
+			name:    "BadOverride",
+			tmpl:    DefaultTopicTemplate,
+			up:      &channels.UPSVariableUpdate{Host: "host1", UpsName: "ups1", TopicTemplate: "{{.Nope}}", VarName: "battery.charge"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewTopicRenderer(tt.tmpl)
+			if err != nil {
+				t.Fatalf("NewTopicRenderer() error = %v", err)
+			}
+			got, err := r.Topic(tt.up)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Topic() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Topic() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTopicTemplate(t *testing.T) {
+	for _, tmpl := range []string{"{{.Host", "{{.Nope}}", "{{.Var | nope}}"} {
+		if _, err := ParseTopicTemplate(tmpl); err == nil {
+			t.Errorf("ParseTopicTemplate(%q) should have failed", tmpl)
+		}
+	}
+}
+
+func TestMQTT5Packet(t *testing.T) {
+	p := &mqtt5Publisher{opts: MQTT5Options{MessageExpiry: time.Minute}}
+	p.aliases.reset(1)
+	msg := &channels.MQTTUpdate{Content: "100", ContentType: "text/plain", Properties: map[string]string{"var": "battery.charge", "host": "host1"}, Volatile: true}
+
+	pub, _ := p.packet("nut/hosts/host1/ups/battery/charge", msg, false, true)
+	if pub.Topic != "nut/hosts/host1/ups/battery/charge" || pub.Properties.TopicAlias == nil || *pub.Properties.TopicAlias != 1 {
+		t.Errorf("first packet should set alias 1 with the topic, got topic %q alias %v", pub.Topic, pub.Properties.TopicAlias)
+	}
+	if pub.Properties.MessageExpiry == nil || *pub.Properties.MessageExpiry != 60 {
+		t.Errorf("packet should expire in 60s, got %v", pub.Properties.MessageExpiry)
+	}
+	want_props := paho.UserProperties{{Key: "host", Value: "host1"}, {Key: "var", Value: "battery.charge"}}
+	if !reflect.DeepEqual(pub.Properties.User, want_props) {
+		t.Errorf("user properties = %v, want %v", pub.Properties.User, want_props)
+	}
+
+	// Until it's been sent, we keep sending the topic along with the alias.
+	if pub, _ = p.packet("nut/hosts/host1/ups/battery/charge", msg, false, true); pub.Topic == "" {
+		t.Errorf("unsent alias shouldn't drop the topic")
+	}
+	pub, gen := p.packet("nut/hosts/host1/ups/battery/charge", msg, false, true)
+	p.aliases.sent(pub.Topic, gen)
+	if pub, _ = p.packet("nut/hosts/host1/ups/battery/charge", msg, false, true); pub.Topic != "" || *pub.Properties.TopicAlias != 1 {
+		t.Errorf("sent alias should drop the topic, got topic %q alias %v", pub.Topic, pub.Properties.TopicAlias)
+	}
+
+	// Out of aliases.
+	pub, _ = p.packet("nut/hosts/host1/ups/battery/runtime", &channels.MQTTUpdate{Content: "600", Retain: true}, true, true)
+	if pub.Topic != "nut/hosts/host1/ups/battery/runtime" || pub.Properties.TopicAlias != nil || pub.Properties.MessageExpiry != nil {
+		t.Errorf("got topic %q alias %v expiry %v, want the topic, no alias and no expiry", pub.Topic, pub.Properties.TopicAlias, pub.Properties.MessageExpiry)
+	}
+
+	// A new connection starts again.
+	p.aliases.reset(1)
+	if pub, _ = p.packet("nut/hosts/host1/ups/battery/charge", msg, false, true); pub.Topic == "" {
+		t.Errorf("aliases should be forgotten on reset")
+	}
+
+	// Something built for the old connection that only goes out after a reconnect doesn't make the broker
+	// know the alias on the new one.
+	pub, gen = p.packet("nut/hosts/host1/ups/battery/charge", msg, false, true)
+	p.aliases.reset(1)
+	p.aliases.sent(pub.Topic, gen)
+	if p.aliases.current(gen) {
+		t.Errorf("generation %d should be stale after a reset", gen)
+	}
+	if pub, _ = p.packet("nut/hosts/host1/ups/battery/charge", msg, false, true); pub.Topic == "" {
+		t.Errorf("alias sent on an old connection shouldn't drop the topic on a new one")
+	}
+}
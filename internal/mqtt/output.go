@@ -0,0 +1,199 @@
+package mqtt
+
+// Publishing to more than one broker, e.g. a local one for Home Assistant and a central one for monitoring.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+	control "github.com/gerrowadat/nut2mqtt/internal/control"
+)
+
+var outputNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Fill in anything an output doesn't set from defaults (i.e. the --mqtt-* flags).
+func OutputWithDefaults(o config.OutputConfig, defaults config.OutputConfig) config.OutputConfig {
+	if o.ClientID == "" {
+		// So two outputs on the same broker don't kick each other off.
+		o.ClientID = defaults.ClientID + "-" + o.Name
+	}
+	if o.Protocol == 0 {
+		o.Protocol = defaults.Protocol
+	}
+	if o.TopicBase == "" {
+		o.TopicBase = defaults.TopicBase
+	}
+	if o.TopicTemplate == "" {
+		o.TopicTemplate = defaults.TopicTemplate
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = defaults.QueueSize
+	}
+	if o.MessageExpiry == "" {
+		o.MessageExpiry = defaults.MessageExpiry
+	}
+	if o.TopicAliases == 0 {
+		o.TopicAliases = defaults.TopicAliases
+	}
+	if o.HADiscoveryPrefix == "" {
+		o.HADiscoveryPrefix = defaults.HADiscoveryPrefix
+	}
+	return o
+}
+
+// Check an output's config, without connecting to anything.
+func ValidateOutput(o config.OutputConfig) error {
+	if !outputNameRegexp.MatchString(o.Name) {
+		return fmt.Errorf("bad output name %q", o.Name)
+	}
+	if err := ValidateBrokerURL(o.URL); err != nil {
+		return err
+	}
+	if o.Protocol != 3 && o.Protocol != 5 {
+		return fmt.Errorf("protocol must be 3 or 5, not %d", o.Protocol)
+	}
+	if o.QoS < 0 || o.QoS > 2 {
+		return fmt.Errorf("qos must be 0, 1 or 2, not %d", o.QoS)
+	}
+	if o.TopicAliases < 0 || o.TopicAliases > 65535 {
+		return errors.New("topic_aliases must be between 0 and 65535")
+	}
+	if o.MessageExpiry != "" {
+		d, err := time.ParseDuration(o.MessageExpiry)
+		if err != nil {
+			return fmt.Errorf("bad message_expiry: %v", err)
+		}
+		// MQTT counts expiry in whole seconds, and 0 means never, so anything shorter can't be done.
+		if d != 0 && d < time.Second {
+			return fmt.Errorf("message_expiry must be 0 or at least 1s, not %v", d)
+		}
+	}
+	if _, err := ParseTopicTemplate(o.TopicTemplate); err != nil {
+		return err
+	}
+	for _, pat := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("bad variable glob %v: %v", pat, err)
+		}
+	}
+	return nil
+}
+
+// Connect to an output's broker and get it ready to go. state_topic (under the topic base) is where we say we're
+// online, and so where our will goes.
+func NewOutput(o config.OutputConfig, state_topic string) (*MQTTClient, error) {
+	if err := ValidateOutput(o); err != nil {
+		return nil, fmt.Errorf("output %v: %v", o.Name, err)
+	}
+	tls_cfg, err := TLSOptions{CAFile: o.CAFile, CertFile: o.CertFile, KeyFile: o.KeyFile, InsecureSkipVerify: o.InsecureSkipVerify}.Config()
+	if err != nil {
+		return nil, fmt.Errorf("output %v: %v", o.Name, err)
+	}
+	opts := ClientOptions{
+		URL:       o.URL,
+		User:      o.User,
+		ClientID:  o.ClientID,
+		TLS:       tls_cfg,
+		WillTopic: o.TopicBase + state_topic,
+		QueueSize: o.QueueSize,
+		QoS:       byte(o.QoS),
+	}
+	if o.PasswordEnv != "" {
+		opts.Password = os.Getenv(o.PasswordEnv)
+	}
+	var m *MQTTClient
+	if o.Protocol == 5 {
+		var expiry time.Duration
+		if o.MessageExpiry != "" {
+			expiry, _ = time.ParseDuration(o.MessageExpiry)
+		}
+		m, err = NewMQTT5Client(opts, MQTT5Options{MessageExpiry: expiry, TopicAliases: uint16(o.TopicAliases)})
+	} else {
+		m, err = NewMQTTClient(opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("output %v: %v", o.Name, err)
+	}
+	m.SetName(o.Name)
+	m.SetTopicBase(o.TopicBase)
+	m.SetRetain(o.Retain)
+	m.SetVariableFilter(o.Include, o.Exclude)
+	if o.HADiscovery {
+		prefix := o.HADiscoveryPrefix
+		if prefix == "" {
+			prefix = DefaultHADiscoveryPrefix
+		}
+		m.SetHADiscoveryPrefix(prefix)
+	}
+	if err := m.SetTopicTemplate(o.TopicTemplate); err != nil {
+		return nil, fmt.Errorf("output %v: %v", o.Name, err)
+	}
+	return m, nil
+}
+
+// All the brokers we publish to. Each gets everything, and has its own queue, so one slow broker doesn't hold up the rest.
+type Outputs []*MQTTClient
+
+// Start each output publishing. Call before UpdateProducer and UpdateConsumer.
+func (o Outputs) Run(c *control.Controller) {
+	for _, m := range o {
+		go m.Run(c)
+	}
+}
+
+// Take in UPSVariableUpdate messages and hand them to every output.
+func (o Outputs) UpdateProducer(c *control.Controller) {
+	defer c.WaitGroupDone()
+	for {
+		up := <-c.Channels().MqttConverter
+		for _, m := range o {
+			m.HandleVariableUpdate(c, up)
+		}
+	}
+}
+
+// Hand MQTTUpdate messages (e.g. from the controller) to every output.
+func (o Outputs) UpdateConsumer(c *control.Controller) {
+	defer c.WaitGroupDone()
+	for {
+		update := <-c.Channels().Mqtt
+		for _, m := range o {
+			m.enqueue(c, update)
+		}
+	}
+}
+
+// Answer requests on every output that can (i.e. MQTT v5 ones).
+func (o Outputs) SetRequestHandler(topic string, handler RequestHandler) {
+	for _, m := range o {
+		m.SetRequestHandler(topic, handler)
+	}
+}
+
+// Listen on a topic (under its topic base) on the first output only, so something that reaches several of our
+// brokers (e.g. via a bridge between them) is only handled once.
+func (o Outputs) Subscribe(topic string, handler func(payload []byte)) {
+	if err := o[0].Subscribe(topic, handler); err != nil {
+		// We'll try again when we reconnect.
+		logger.Error("Error subscribing", "output", o[0].Name(), "topic", topic, "err", err)
+	}
+}
+
+// Publish something straight away, bypassing the queues, e.g. on the way out.
+func (o Outputs) PublishMessage(msg *channels.MQTTUpdate) {
+	for _, m := range o {
+		m.PublishMessage(msg)
+	}
+}
+
+func (o Outputs) Disconnect(quiesce uint) {
+	for _, m := range o {
+		m.Disconnect(quiesce)
+	}
+}
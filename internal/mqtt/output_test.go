@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
+	control "github.com/gerrowadat/nut2mqtt/internal/control"
+)
+
+func TestOutputWithDefaults(t *testing.T) {
+	defaults := config.OutputConfig{ClientID: "nut2mqtt-nas", Protocol: 3, TopicBase: "nut/", TopicTemplate: DefaultTopicTemplate, QueueSize: 100, MessageExpiry: "5m", TopicAliases: 10}
+	got := OutputWithDefaults(config.OutputConfig{Name: "central", URL: "ssl://central:8883", Protocol: 5, TopicBase: "site1/"}, defaults)
+	want := config.OutputConfig{Name: "central", URL: "ssl://central:8883", ClientID: "nut2mqtt-nas-central", Protocol: 5, TopicBase: "site1/", TopicTemplate: DefaultTopicTemplate, QueueSize: 100, MessageExpiry: "5m", TopicAliases: 10}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OutputWithDefaults() = %+v, want %+v", got, want)
+	}
+	if got := OutputWithDefaults(config.OutputConfig{Name: "central", ClientID: "site1"}, defaults); got.ClientID != "site1" {
+		t.Errorf("OutputWithDefaults() overrode client_id with %v", got.ClientID)
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	good := config.OutputConfig{Name: "local", URL: "tcp://localhost:1883", Protocol: 3, TopicTemplate: DefaultTopicTemplate}
+	tests := []struct {
+		name    string
+		change  func(o *config.OutputConfig)
+		wantErr bool
+	}{
+		{name: "Good", change: func(o *config.OutputConfig) {}},
+		{name: "NoName", change: func(o *config.OutputConfig) { o.Name = "" }, wantErr: true},
+		{name: "SlashInName", change: func(o *config.OutputConfig) { o.Name = "a/b" }, wantErr: true},
+		{name: "BadURL", change: func(o *config.OutputConfig) { o.URL = "http://localhost" }, wantErr: true},
+		{name: "BadProtocol", change: func(o *config.OutputConfig) { o.Protocol = 4 }, wantErr: true},
+		{name: "BadQoS", change: func(o *config.OutputConfig) { o.QoS = 3 }, wantErr: true},
+		{name: "BadExpiry", change: func(o *config.OutputConfig) { o.MessageExpiry = "soon" }, wantErr: true},
+		{name: "SubSecondExpiry", change: func(o *config.OutputConfig) { o.MessageExpiry = "500ms" }, wantErr: true},
+		{name: "NegativeExpiry", change: func(o *config.OutputConfig) { o.MessageExpiry = "-1m" }, wantErr: true},
+		{name: "NoExpiry", change: func(o *config.OutputConfig) { o.MessageExpiry = "0s" }},
+		{name: "BadTemplate", change: func(o *config.OutputConfig) { o.TopicTemplate = "{{.Nope}}" }, wantErr: true},
+		{name: "BadGlob", change: func(o *config.OutputConfig) { o.Exclude = []string{"[battery"} }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := good
+			tt.change(&o)
+			if err := ValidateOutput(o); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOutputVariableFilter(t *testing.T) {
+	c := control.NewController("bridge", time.Minute)
+	p := &fakePublisher{connected: true}
+	m := newMQTTClient(ClientOptions{QueueSize: 10})
+	m.pub = p
+	m.SetVariableFilter([]string{"battery.*", "ups.status"}, []string{"battery.mfr.*"})
+
+	for _, v := range []string{"battery.charge", "battery.mfr.date", "ups.status", "ups.load"} {
+		m.HandleVariableUpdate(&c, &channels.UPSVariableUpdate{Host: "h", UpsName: "ups", UpsID: "h/ups", VarName: v, Content: "1"})
+	}
+	m.flush(&c, false)
+	want := []string{"hosts/h/ups/battery/charge=1", "hosts/h/ups/ups/status=1"}
+	if !reflect.DeepEqual(p.published, want) {
+		t.Errorf("published %v, want %v", p.published, want)
+	}
+}
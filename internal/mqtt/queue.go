@@ -0,0 +1,67 @@
+package mqtt
+
+// Holding on to updates while the broker's away.
+
+import (
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+)
+
+// Updates waiting to go to the broker. Only the latest update for each topic is kept, as that's all anyone
+// cares about. While the broker's away, if more than max topics are waiting the oldest are dropped; while it's
+// there, everything's kept, as it'll all be sent shortly. Callers do the locking.
+type offlineQueue struct {
+	max int
+	// Topics in the order they were first queued.
+	order   []string
+	updates map[string]*channels.MQTTUpdate
+}
+
+func newOfflineQueue(max int) *offlineQueue {
+	return &offlineQueue{max: max, updates: map[string]*channels.MQTTUpdate{}}
+}
+
+// Queue an update, replacing anything already waiting for the same topic. With offline, keeps to max topics,
+// returning how many updates got dropped to make room.
+func (q *offlineQueue) Add(u *channels.MQTTUpdate, offline bool) int {
+	if _, ok := q.updates[u.Topic]; ok {
+		q.updates[u.Topic] = u
+		return 0
+	}
+	if !offline {
+		q.order = append(q.order, u.Topic)
+		q.updates[u.Topic] = u
+		return 0
+	}
+	if q.max <= 0 {
+		return 1
+	}
+	dropped := 0
+	for len(q.order) >= q.max {
+		delete(q.updates, q.order[0])
+		q.order = q.order[1:]
+		dropped++
+	}
+	q.order = append(q.order, u.Topic)
+	q.updates[u.Topic] = u
+	return dropped
+}
+
+func (q *offlineQueue) Len() int {
+	return len(q.order)
+}
+
+func (q *offlineQueue) Has(topic string) bool {
+	_, ok := q.updates[topic]
+	return ok
+}
+
+// Everything that's waiting, oldest first, leaving the queue empty.
+func (q *offlineQueue) Drain() []*channels.MQTTUpdate {
+	ret := []*channels.MQTTUpdate{}
+	for _, t := range q.order {
+		ret = append(ret, q.updates[t])
+	}
+	q.order = nil
+	q.updates = map[string]*channels.MQTTUpdate{}
+	return ret
+}
@@ -0,0 +1,193 @@
+package mqtt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	control "github.com/gerrowadat/nut2mqtt/internal/control"
+)
+
+func TestOfflineQueue(t *testing.T) {
+	q := newOfflineQueue(2)
+	q.Add(&channels.MQTTUpdate{Topic: "a", Content: "1"}, true)
+	q.Add(&channels.MQTTUpdate{Topic: "b", Content: "1"}, true)
+	// Coalesced, so nothing's dropped.
+	if dropped := q.Add(&channels.MQTTUpdate{Topic: "a", Content: "2"}, true); dropped != 0 {
+		t.Errorf("Add() dropped %d, want 0", dropped)
+	}
+	// Full, so a goes.
+	if dropped := q.Add(&channels.MQTTUpdate{Topic: "c", Content: "1"}, true); dropped != 1 {
+		t.Errorf("Add() dropped %d, want 1", dropped)
+	}
+	if q.Has("a") || !q.Has("b") || q.Len() != 2 {
+		t.Errorf("queue should have b and c, has a %v b %v len %d", q.Has("a"), q.Has("b"), q.Len())
+	}
+	got := []string{}
+	for _, u := range q.Drain() {
+		got = append(got, u.Topic+"="+u.Content)
+	}
+	if want := []string{"b=1", "c=1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Drain() = %v, want %v", got, want)
+	}
+	if q.Len() != 0 {
+		t.Errorf("queue should be empty after Drain()")
+	}
+
+	// No limit while we're connected.
+	for _, topic := range []string{"a", "b", "c", "d"} {
+		if dropped := q.Add(&channels.MQTTUpdate{Topic: topic, Content: "1"}, false); dropped != 0 {
+			t.Errorf("Add() while connected dropped %d", dropped)
+		}
+	}
+	if q.Len() != 4 {
+		t.Errorf("queue has %d topics, want 4", q.Len())
+	}
+}
+
+// A queue size of 0 means hold nothing while the broker's away, not publish nothing at all.
+func TestZeroQueueSize(t *testing.T) {
+	c := control.NewController("bridge", time.Minute)
+	p := &fakePublisher{connected: true}
+	m := newMQTTClient(ClientOptions{QueueSize: 0})
+	m.pub = p
+	m.SetTopicBase("nut/")
+
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/battery/charge", Content: "100"})
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/ups/status", Content: "OL"})
+	m.flush(&c, false)
+	if want := []string{"nut/hosts/h/ups/battery/charge=100", "nut/hosts/h/ups/ups/status=OL"}; !reflect.DeepEqual(p.published, want) {
+		t.Errorf("published %v, want %v", p.published, want)
+	}
+
+	p.connected = false
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/ups/status", Content: "OB"})
+	if m.queue.Len() != 0 {
+		t.Errorf("queue should hold nothing while disconnected, has %d", m.queue.Len())
+	}
+}
+
+// Pretends to be a broker connection we can pull the plug on.
+type fakePublisher struct {
+	connected bool
+	fail      bool
+	published []string
+}
+
+func (p *fakePublisher) Publish(topic string, msg *channels.MQTTUpdate, retain bool) error {
+	if !p.connected || p.fail {
+		return errors.New("not connected")
+	}
+	p.published = append(p.published, topic+"="+msg.Content)
+	return nil
+}
+
+func (p *fakePublisher) Subscribe(topic string, handler func(payload []byte)) error { return nil }
+func (p *fakePublisher) IsConnected() bool                                          { return p.connected }
+func (p *fakePublisher) Disconnect(quiesce uint)                                    {}
+
+func TestOfflineBuffering(t *testing.T) {
+	c := control.NewController("bridge", time.Minute)
+	p := &fakePublisher{connected: true}
+	m := newMQTTClient(ClientOptions{QueueSize: 10})
+	m.pub = p
+	m.SetTopicBase("nut/")
+
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "bridge/state", Content: "online", Retain: true})
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/battery/charge", Content: "100"})
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/battery/charge/$meta", Content: "{}", Retain: true})
+	m.flush(&c, false)
+	if len(p.published) != 3 {
+		t.Errorf("published %v, want 3 updates", p.published)
+	}
+
+	// Broker goes away.
+	p.connected = false
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/battery/charge", Content: "99"})
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/battery/charge", Content: "98"})
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/ups/status", Content: "OB"})
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/battery/charge/$meta", Content: "", Retain: true})
+	m.flush(&c, false)
+	if m.queue.Len() != 3 {
+		t.Errorf("queue should have 3 topics waiting, has %d", m.queue.Len())
+	}
+
+	// And comes back, having forgotten everything.
+	p.connected = true
+	p.published = nil
+	m.flush(&c, true)
+	want := []string{
+		"nut/bridge/state=online",
+		"nut/hosts/h/ups/battery/charge=98",
+		"nut/hosts/h/ups/ups/status=OB",
+		"nut/hosts/h/ups/battery/charge/$meta=",
+	}
+	if !reflect.DeepEqual(p.published, want) {
+		t.Errorf("republished %v, want %v", p.published, want)
+	}
+	if m.queue.Len() != 0 {
+		t.Errorf("queue should be empty, has %d", m.queue.Len())
+	}
+
+	// Failed publishes get another go next time, unless something newer's turned up.
+	p.fail = true
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/ups/status", Content: "OL"})
+	if !m.flush(&c, false) {
+		t.Errorf("flush() should ask for a retry after a failed publish")
+	}
+	if !m.queue.Has("hosts/h/ups/ups/status") {
+		t.Errorf("failed publish should be queued")
+	}
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "hosts/h/ups/ups/status", Content: "OB"})
+	p.fail = false
+	p.published = nil
+	if m.flush(&c, false) {
+		t.Errorf("flush() asked for a retry when everything went out")
+	}
+	if want := []string{"nut/hosts/h/ups/ups/status=OB"}; !reflect.DeepEqual(p.published, want) {
+		t.Errorf("published %v, want %v", p.published, want)
+	}
+}
+
+func TestNextRetryInterval(t *testing.T) {
+	got := []time.Duration{}
+	last := time.Duration(0)
+	for i := 0; i < 8; i++ {
+		last = nextRetryInterval(last)
+		got = append(got, last)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("retry intervals = %v, want %v", got, want)
+	}
+}
+
+// A demoted leader mustn't put its stale UPS data back over the new leader's.
+func TestStandbyDropsUPSData(t *testing.T) {
+	c := control.NewController("bridge", time.Minute)
+	p := &fakePublisher{connected: true}
+	m := newMQTTClient(ClientOptions{QueueSize: 10})
+	m.pub = p
+	m.SetTopicBase("nut/")
+	m.SetRetain(true)
+
+	m.enqueue(&c, &channels.MQTTUpdate{Topic: "bridge/state", Content: "online", Retain: true})
+	m.HandleVariableUpdate(&c, &channels.UPSVariableUpdate{Host: "h", UpsName: "ups", UpsID: "h:3493/ups", VarName: "battery.charge", Content: "100", Meta: &channels.VarMetadata{}})
+	m.flush(&c, false)
+
+	c.SetActive(false)
+	// Something from before we stood down, still on its way.
+	m.HandleVariableUpdate(&c, &channels.UPSVariableUpdate{Host: "h", UpsName: "ups", UpsID: "h:3493/ups", VarName: "battery.charge", Content: "99"})
+	p.published = nil
+	m.flush(&c, true)
+	if want := []string{"nut/bridge/state=online"}; !reflect.DeepEqual(p.published, want) {
+		t.Errorf("published %v on standby, want %v", p.published, want)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.retained) != 1 || m.queue.Len() != 0 {
+		t.Errorf("still holding %d retained topics and %d queued, want 1 and 0", len(m.retained), m.queue.Len())
+	}
+}
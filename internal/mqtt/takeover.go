@@ -0,0 +1,47 @@
+package mqtt
+
+// Spotting another client using our client ID. The broker kicks one of us off whenever the other connects, so we
+// both end up reconnecting forever.
+
+import (
+	"regexp"
+	"time"
+)
+
+var clientIDRegexp = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// Make something (e.g. a hostname) safe to use in a client ID.
+func SanitiseClientID(id string) string {
+	return clientIDRegexp.ReplaceAllString(id, "-")
+}
+
+type takeoverDetector struct {
+	// Connections shorter than this count towards a loop.
+	short time.Duration
+	// How many short connections in a row before we say something.
+	limit        int
+	connected_at time.Time
+	short_run    int
+}
+
+func newTakeoverDetector() *takeoverDetector {
+	return &takeoverDetector{short: 10 * time.Second, limit: 3}
+}
+
+func (d *takeoverDetector) up(now time.Time) {
+	d.connected_at = now
+}
+
+// Whether losing the connection now looks like part of a takeover loop. taken_over is the broker telling us
+// so outright, which only MQTT v5 can do. Otherwise, we complain every limit short connections in a row.
+func (d *takeoverDetector) down(now time.Time, taken_over bool) bool {
+	if now.Sub(d.connected_at) < d.short {
+		d.short_run++
+	} else {
+		d.short_run = 0
+	}
+	if taken_over {
+		return true
+	}
+	return d.short_run > 0 && d.short_run%d.limit == 0
+}
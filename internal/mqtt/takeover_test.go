@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeoverDetector(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		uptimes    []time.Duration
+		taken_over bool
+		want       bool
+	}{
+		{name: "LongConnections", uptimes: []time.Duration{time.Hour, time.Hour, time.Hour}},
+		{name: "FewShortConnections", uptimes: []time.Duration{time.Second, time.Second}},
+		{name: "Loop", uptimes: []time.Duration{time.Second, time.Second, time.Second}, want: true},
+		{name: "LoopBroken", uptimes: []time.Duration{time.Second, time.Second, time.Hour}},
+		{name: "BrokerSaysSo", uptimes: []time.Duration{time.Hour}, taken_over: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTakeoverDetector()
+			now := start
+			got := false
+			for i, up := range tt.uptimes {
+				d.up(now)
+				now = now.Add(up)
+				got = d.down(now, tt.taken_over && i == len(tt.uptimes)-1)
+			}
+			if got != tt.want {
+				t.Errorf("down() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitiseClientID(t *testing.T) {
+	if got := SanitiseClientID("nut2mqtt-nas.local:1/ä"); got != "nut2mqtt-nas.local-1--" {
+		t.Errorf("SanitiseClientID() = %v", got)
+	}
+}
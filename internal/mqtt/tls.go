@@ -0,0 +1,72 @@
+package mqtt
+
+// TLS for ssl:// and wss:// brokers.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+type TLSOptions struct {
+	// PEM file of CAs to trust instead of the system ones.
+	CAFile string
+	// PEM client certificate and key, for brokers that want one.
+	CertFile string
+	KeyFile  string
+	// Don't check the broker's certificate. Only for testing!
+	InsecureSkipVerify bool
+}
+
+func (o TLSOptions) IsSet() bool {
+	return o.CAFile != "" || o.CertFile != "" || o.KeyFile != "" || o.InsecureSkipVerify
+}
+
+// Build a tls.Config from the options. Nil if there's nothing to configure, in which case the defaults do.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if !o.IsSet() {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("need both a client certificate and key")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Check a broker URL is something we can connect to.
+func ValidateBrokerURL(mqtt_url string) error {
+	u, err := url.Parse(mqtt_url)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return fmt.Errorf("unsupported scheme %q in broker URL %v (use tcp, ssl, ws or wss)", u.Scheme, mqtt_url)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("no host in broker URL %v", mqtt_url)
+	}
+	return nil
+}
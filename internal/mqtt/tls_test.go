@@ -0,0 +1,214 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// PEM files
+	cert_file string
+	key_file  string
+}
+
+// Make a certificate, signed by parent (or itself, if parent is nil).
+func newTestCert(t *testing.T, dir string, name string, parent *testCert, client bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signer_key := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signer_key = parent.cert, parent.key
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		if client {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		} else {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signer_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := &testCert{cert: cert, key: key, cert_file: filepath.Join(dir, name+".crt"), key_file: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(ret.cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ret.key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// Just enough of a broker to accept a connection: CONNACK whatever CONNECT we get, then ignore everything.
+func fakeTLSBroker(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// CONNECT: fixed header byte, then the remaining length as a varint.
+				hdr := make([]byte, 1)
+				if _, err := io.ReadFull(conn, hdr); err != nil {
+					return
+				}
+				length, mult := 0, 1
+				for {
+					if _, err := io.ReadFull(conn, hdr); err != nil {
+						return
+					}
+					length += int(hdr[0]&0x7f) * mult
+					mult *= 128
+					if hdr[0]&0x80 == 0 {
+						break
+					}
+				}
+				if _, err := io.CopyN(io.Discard, conn, int64(length)); err != nil {
+					return
+				}
+				// CONNACK, session not present, accepted.
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return "ssl://" + l.Addr().String()
+}
+
+func TestTLSConnect(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, false)
+	server := newTestCert(t, dir, "server", ca, false)
+	client := newTestCert(t, dir, "client", ca, true)
+	other_ca := newTestCert(t, dir, "other-ca", nil, false)
+
+	server_cert, err := tls.LoadX509KeyPair(server.cert_file, server.key_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_cas := x509.NewCertPool()
+	client_cas.AddCert(ca.cert)
+	broker := fakeTLSBroker(t, &tls.Config{Certificates: []tls.Certificate{server_cert}, ClientCAs: client_cas, ClientAuth: tls.RequireAndVerifyClientCert})
+
+	tests := []struct {
+		name    string
+		opts    TLSOptions
+		wantErr bool
+	}{
+		{
+			name: "ClientCert",
+			opts: TLSOptions{CAFile: ca.cert_file, CertFile: client.cert_file, KeyFile: client.key_file},
+		},
+		{
+			name:    "NoClientCert",
+			opts:    TLSOptions{CAFile: ca.cert_file},
+			wantErr: true,
+		},
+		{
+			name:    "UntrustedBroker",
+			opts:    TLSOptions{CAFile: other_ca.cert_file, CertFile: client.cert_file, KeyFile: client.key_file},
+			wantErr: true,
+		},
+		{
+			name: "InsecureSkipVerify",
+			opts: TLSOptions{CAFile: other_ca.cert_file, CertFile: client.cert_file, KeyFile: client.key_file, InsecureSkipVerify: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.opts.Config()
+			if err != nil {
+				t.Fatalf("Config() error = %v", err)
+			}
+			c, err := NewMQTTClient(ClientOptions{URL: broker, User: "nut", TLS: cfg})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewMQTTClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				c.Disconnect(0)
+			}
+		})
+	}
+}
+
+func TestTLSOptionsConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, false)
+	not_pem := filepath.Join(dir, "not.pem")
+	os.WriteFile(not_pem, []byte("hello"), 0600)
+
+	if cfg, err := (TLSOptions{}).Config(); cfg != nil || err != nil {
+		t.Errorf("empty TLSOptions should give no config, got %v, %v", cfg, err)
+	}
+	for _, o := range []TLSOptions{
+		{CAFile: filepath.Join(dir, "missing.pem")},
+		{CAFile: not_pem},
+		{CertFile: ca.cert_file},
+		{CertFile: ca.cert_file, KeyFile: not_pem},
+	} {
+		if _, err := o.Config(); err == nil {
+			t.Errorf("Config(%+v) should have failed", o)
+		}
+	}
+}
+
+func TestValidateBrokerURL(t *testing.T) {
+	for url, ok := range map[string]bool{
+		"tcp://localhost:1883":    true,
+		"ssl://broker:8883":       true,
+		"ws://broker:9001/mqtt":   true,
+		"wss://broker/mqtt":       true,
+		"http://broker:1883":      false,
+		"ssl://":                  false,
+		"broker:1883":             false,
+		"tcp://[::1:1883/nothing": false,
+	} {
+		if err := ValidateBrokerURL(url); (err == nil) != ok {
+			t.Errorf("ValidateBrokerURL(%v) = %v, want ok %v", url, err, ok)
+		}
+	}
+}
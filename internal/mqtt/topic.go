@@ -0,0 +1,123 @@
+package mqtt
+
+// Working out which topic each variable goes to, from a text/template.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+)
+
+// The layout we've always used: hosts/<host>/<ups>/<var with dots as slashes>
+const DefaultTopicTemplate = "hosts/{{.Host | slashes}}/{{.Ups | slashes}}/{{.Var | slashes}}"
+
+// What a topic template gets to play with.
+type TopicData struct {
+	// upsd host
+	Host string
+	// The UPS's alias if it has one, otherwise its name.
+	Ups string
+	// The UPS's alias, or empty if it hasn't got one.
+	Alias string
+	// The UPS's name in NUT, regardless of alias.
+	Name string
+	// The stable UPS identity, e.g. host:3493/ups
+	ID string
+	// The NUT variable, e.g. battery.charge
+	Var string
+}
+
+var topicFuncs = template.FuncMap{
+	// battery.charge -> battery/charge
+	"slashes": func(s string) string { return strings.ReplaceAll(s, ".", "/") },
+	// battery.charge -> battery_charge
+	"underscores": func(s string) string { return strings.ReplaceAll(s, ".", "_") },
+	"lower":       strings.ToLower,
+}
+
+// Wildcards and NUL aren't allowed in a topic we publish to.
+var topicSanitiser = strings.NewReplacer("+", "_", "#", "_", "\x00", "_")
+
+// Make something safe to publish to: no wildcards, and no leading slash (which would make an empty first level).
+func SanitiseTopic(topic string) string {
+	return strings.TrimLeft(topicSanitiser.Replace(topic), "/")
+}
+
+func ParseTopicTemplate(tmpl string) (*template.Template, error) {
+	t, err := template.New("topic").Funcs(topicFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("bad topic template %q: %v", tmpl, err)
+	}
+	// Try it out, so field typos are caught now rather than on the first update.
+	var b strings.Builder
+	if err := t.Execute(&b, &TopicData{Host: "host", Ups: "ups", Alias: "alias", Name: "ups", ID: "host:3493/ups", Var: "battery.charge"}); err != nil {
+		return nil, fmt.Errorf("bad topic template %q: %v", tmpl, err)
+	}
+	return t, nil
+}
+
+// Renders topics from the default template, or a UPS's own, caching the parsed templates.
+type TopicRenderer struct {
+	mu        sync.Mutex
+	default_t *template.Template
+	per_ups   map[string]*template.Template
+}
+
+func NewTopicRenderer(default_tmpl string) (*TopicRenderer, error) {
+	t, err := ParseTopicTemplate(default_tmpl)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicRenderer{default_t: t, per_ups: map[string]*template.Template{}}, nil
+}
+
+func (r *TopicRenderer) template(tmpl string) (*template.Template, error) {
+	if tmpl == "" {
+		return r.default_t, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.per_ups[tmpl]; ok {
+		return t, nil
+	}
+	t, err := ParseTopicTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	r.per_ups[tmpl] = t
+	return t, nil
+}
+
+func (r *TopicRenderer) Topic(up *channels.UPSVariableUpdate) (string, error) {
+	t, err := r.template(up.TopicTemplate)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = t.Execute(&b, &TopicData{
+		Host:  SanitiseTopic(up.Host),
+		Ups:   SanitiseTopic(up.DisplayName()),
+		Alias: SanitiseTopic(up.Alias),
+		Name:  SanitiseTopic(up.UpsName),
+		ID:    up.UpsID,
+		Var:   up.VarName,
+	})
+	if err != nil {
+		return "", err
+	}
+	return SanitiseTopic(b.String()), nil
+}
+
+// Variable metadata lives alongside the variable, e.g. hosts/host1/ups1/battery/charge/$meta
+func (r *TopicRenderer) MetaTopic(up *channels.UPSVariableUpdate) (string, error) {
+	topic, err := r.Topic(up)
+	if err != nil {
+		return "", err
+	}
+	return topic + "/$meta", nil
+}
+
+var defaultTopicRenderer, _ = NewTopicRenderer(DefaultTopicTemplate)
@@ -0,0 +1,416 @@
+package nutserver
+
+// Pretending to be upsd (see rfc9271), so NUT clients (upsmon, NASes and so on) can read every UPS we know about,
+// on every host we poll, from the one place. It's all served from the controller's cache, and read-only:
+// there's no SET, INSTCMD or FSD, and any username and password will do.
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	control "github.com/gerrowadat/nut2mqtt/internal/control"
+	logging "github.com/gerrowadat/nut2mqtt/internal/logging"
+	upsc "github.com/gerrowadat/nut2mqtt/internal/upsc"
+)
+
+var logger = logging.Logger("nutserver")
+
+// upsd is fussy about UPS names.
+var badNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+func sanitiseName(s string) string {
+	return badNameChars.ReplaceAllString(s, "_")
+}
+
+// upsd's usual port, which we leave out of names.
+const defaultUpsdPort = 3493
+
+// The name a UPS always gets, so clients configured with it keep working whatever else turns up: its nut_name,
+// or its alias, or host-name (host-port-name if upsd isn't on the usual port).
+func ServedName(u *channels.UPSInfo) string {
+	if u.NUTName != "" {
+		return sanitiseName(u.NUTName)
+	}
+	if u.Alias != "" {
+		return sanitiseName(u.Alias)
+	}
+	if u.Port != 0 && u.Port != defaultUpsdPort {
+		return sanitiseName(fmt.Sprintf("%v-%d-%v", u.Host, u.Port, u.Name))
+	}
+	return sanitiseName(u.Host + "-" + u.Name)
+}
+
+// Every UPS by its served name. Should a nut_name or alias clash with another UPS's name anyway, the one it was
+// set on wins (nut_name first), and the other isn't served.
+func ServedNames(upses []*channels.UPSInfo) map[string]*channels.UPSInfo {
+	rank := func(u *channels.UPSInfo) int {
+		switch {
+		case u.NUTName != "":
+			return 0
+		case u.Alias != "":
+			return 1
+		}
+		return 2
+	}
+	sorted := append([]*channels.UPSInfo{}, upses...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if rank(sorted[i]) != rank(sorted[j]) {
+			return rank(sorted[i]) < rank(sorted[j])
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	ret := map[string]*channels.UPSInfo{}
+	for _, u := range sorted {
+		name := ServedName(u)
+		if other, ok := ret[name]; ok {
+			logger.Debug("Not serving UPS, as its name's taken", "ups", u.ID, "name", name, "taken_by", other.ID)
+			continue
+		}
+		ret[name] = u
+	}
+	return ret
+}
+
+// Clients that say nothing for this long get hung up on, and we'll only talk to this many at once.
+const (
+	defaultIdleTimeout = 5 * time.Minute
+	defaultMaxClients  = 100
+)
+
+type Server struct {
+	c *control.Controller
+	// Data older than this gets DATA-STALE rather than being served.
+	stale_after  time.Duration
+	idle_timeout time.Duration
+	// One token per connected client.
+	clients chan struct{}
+	mu      sync.Mutex
+	// Clients LOGINed to each UPS, for GET NUMLOGINS.
+	logins map[string]int
+}
+
+// How long before a UPS's data is stale: two polls, so one slow poll doesn't set it off, but no more than half the
+// cache lifetime. UPSes drop out of the cache (and so become UNKNOWN-UPS) somewhere between one and one and a
+// half cache lifetimes after they were last seen, so this leaves them DATA-STALE for a good while first.
+func StaleAfter(poll_interval time.Duration, cache_lifetime time.Duration) time.Duration {
+	return min(2*poll_interval, cache_lifetime/2)
+}
+
+func NewServer(c *control.Controller, stale_after time.Duration) *Server {
+	return &Server{c: c, stale_after: stale_after, idle_timeout: defaultIdleTimeout, clients: make(chan struct{}, defaultMaxClients), logins: map[string]int{}}
+}
+
+// Serve NUT clients on listen until something goes badly wrong. Anything not polled in stale_after is DATA-STALE.
+func NUTServer(c *control.Controller, listen string, stale_after time.Duration) {
+	defer c.WaitGroupDone()
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		logger.Error("Can't listen for NUT clients", "listen", listen, "err", err)
+		return
+	}
+	logger.Info("Listening for NUT clients", "listen", listen)
+	if err := NewServer(c, stale_after).Serve(ln); err != nil {
+		logger.Error("Stopped serving NUT clients", "listen", listen, "err", err)
+	}
+}
+
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		select {
+		case s.clients <- struct{}{}:
+		default:
+			logger.Warn("Too many NUT clients, hanging up on another", "client", conn.RemoteAddr().String(), "max", cap(s.clients))
+			conn.Close()
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+// One client connection.
+type session struct {
+	username string
+	password string
+	// The UPS it's LOGINed to, if any.
+	login string
+}
+
+// Hands back the client token Serve took once the connection's closed.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	// Before the close, so a client that sees us hang up can reconnect straight away.
+	defer func() { <-s.clients }()
+	mr := s.c.MetricRegistry().Metrics()
+	mr.NUTServerClients.Inc()
+	defer mr.NUTServerClients.Dec()
+	client := conn.RemoteAddr().String()
+	logger.Debug("NUT client connected", "client", client)
+	sess := &session{}
+	defer s.logout(sess)
+
+	in := bufio.NewScanner(conn)
+	out := bufio.NewWriter(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.idle_timeout))
+		if !in.Scan() {
+			break
+		}
+		lines, done := s.Respond(sess, in.Text())
+		for _, l := range lines {
+			out.WriteString(l + "\n")
+		}
+		if err := out.Flush(); err != nil || done {
+			break
+		}
+	}
+	logger.Debug("NUT client gone", "client", client)
+}
+
+func (s *Server) logout(sess *session) {
+	if sess.login == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins[sess.login]--
+	if s.logins[sess.login] <= 0 {
+		delete(s.logins, sess.login)
+	}
+	sess.login = ""
+}
+
+func errLine(code string) []string {
+	return []string{"ERR " + code}
+}
+
+// Answer a line from a client. done means hang up after sending the answer.
+func (s *Server) Respond(sess *session, line string) (lines []string, done bool) {
+	args, err := upsc.SplitUpsdLine(line)
+	if err != nil {
+		lines = errLine("INVALID-ARGUMENT")
+		s.countRequest("", lines)
+		return lines, false
+	}
+	cmd := strings.ToUpper(args[0])
+	if (cmd == "LIST" || cmd == "GET") && len(args) > 1 {
+		cmd += " " + strings.ToUpper(args[1])
+		args = args[2:]
+	} else {
+		args = args[1:]
+	}
+	lines, done = s.respond(sess, cmd, args)
+	s.countRequest(cmd, lines)
+	return lines, done
+}
+
+func (s *Server) countRequest(cmd string, lines []string) {
+	code := ""
+	if len(lines) == 1 && strings.HasPrefix(lines[0], "ERR ") {
+		code = strings.TrimPrefix(lines[0], "ERR ")
+	}
+	if _, known := commandArgs[cmd]; !known {
+		// Keep junk out of the labels.
+		cmd = "other"
+	}
+	s.c.MetricRegistry().Metrics().NUTServerRequests.WithLabelValues(cmd, code).Inc()
+}
+
+// How many arguments each command takes, after any LIST or GET subcommand. -1 for we don't care.
+var commandArgs = map[string]int{
+	"SET":           -1,
+	"INSTCMD":       -1,
+	"VER":           0,
+	"NETVER":        0,
+	"PROTVER":       0,
+	"HELP":          0,
+	"LOGOUT":        0,
+	"STARTTLS":      0,
+	"USERNAME":      1,
+	"PASSWORD":      1,
+	"LOGIN":         1,
+	"PRIMARY":       1,
+	"MASTER":        1,
+	"FSD":           1,
+	"LIST UPS":      0,
+	"LIST VAR":      1,
+	"LIST RW":       1,
+	"LIST CMD":      1,
+	"LIST CLIENT":   1,
+	"LIST ENUM":     2,
+	"LIST RANGE":    2,
+	"GET VAR":       2,
+	"GET TYPE":      2,
+	"GET DESC":      2,
+	"GET CMDDESC":   2,
+	"GET UPSDESC":   1,
+	"GET NUMLOGINS": 1,
+}
+
+func (s *Server) respond(sess *session, cmd string, args []string) ([]string, bool) {
+	want, ok := commandArgs[cmd]
+	if !ok {
+		return errLine("UNKNOWN-COMMAND"), false
+	}
+	if want >= 0 && len(args) != want {
+		return errLine("INVALID-ARGUMENT"), false
+	}
+
+	switch cmd {
+	case "VER":
+		return []string{"Network UPS Tools upsd emulation - nut2mqtt " + s.c.InstanceInfo().Version}, false
+	case "NETVER", "PROTVER":
+		return []string{"1.3"}, false
+	case "HELP":
+		return []string{"Commands: HELP VER GET LIST SET INSTCMD LOGIN LOGOUT USERNAME PASSWORD STARTTLS"}, false
+	case "LOGOUT":
+		return []string{"OK Goodbye"}, true
+	case "STARTTLS":
+		return errLine("FEATURE-NOT-CONFIGURED"), false
+	case "USERNAME":
+		if sess.username != "" {
+			return errLine("ALREADY-SET-USERNAME"), false
+		}
+		sess.username = args[0]
+		return []string{"OK"}, false
+	case "PASSWORD":
+		if sess.password != "" {
+			return errLine("ALREADY-SET-PASSWORD"), false
+		}
+		sess.password = args[0]
+		return []string{"OK"}, false
+	case "PRIMARY", "MASTER", "FSD", "SET", "INSTCMD":
+		// Being primary means being allowed to shut the UPS down, which isn't ours to do. Nor is anything else.
+		return errLine("ACCESS-DENIED"), false
+	}
+
+	upses := ServedNames(s.c.State().Snapshot())
+	if cmd == "LIST UPS" {
+		names := []string{}
+		for n := range upses {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		ret := []string{"BEGIN LIST UPS"}
+		for _, n := range names {
+			ret = append(ret, fmt.Sprintf("UPS %v %v", n, upsc.QuoteUpsdValue(upsDesc(upses[n]))))
+		}
+		return append(ret, "END LIST UPS"), false
+	}
+
+	name := args[0]
+	u, ok := upses[name]
+	if !ok {
+		return errLine("UNKNOWN-UPS"), false
+	}
+	switch cmd {
+	case "LOGIN":
+		if sess.login != "" {
+			return errLine("ALREADY-LOGGED-IN"), false
+		}
+		if sess.username == "" {
+			return errLine("USERNAME-REQUIRED"), false
+		}
+		if sess.password == "" {
+			return errLine("PASSWORD-REQUIRED"), false
+		}
+		s.mu.Lock()
+		s.logins[name]++
+		s.mu.Unlock()
+		sess.login = name
+		return []string{"OK"}, false
+	case "GET UPSDESC":
+		return []string{fmt.Sprintf("UPSDESC %v %v", name, upsc.QuoteUpsdValue(upsDesc(u)))}, false
+	case "GET NUMLOGINS":
+		s.mu.Lock()
+		n := s.logins[name]
+		s.mu.Unlock()
+		return []string{fmt.Sprintf("NUMLOGINS %v %d", name, n)}, false
+	case "LIST VAR":
+		if s.stale(u) {
+			return errLine("DATA-STALE"), false
+		}
+		vars := []string{}
+		for k := range u.Vars {
+			vars = append(vars, k)
+		}
+		sort.Strings(vars)
+		ret := []string{"BEGIN LIST VAR " + name}
+		for _, k := range vars {
+			ret = append(ret, fmt.Sprintf("VAR %v %v %v", name, k, upsc.QuoteUpsdValue(u.Vars[k])))
+		}
+		return append(ret, "END LIST VAR "+name), false
+	case "LIST RW", "LIST CMD", "LIST CLIENT":
+		// Nothing's writable, there are no commands, and we don't say who else is connected.
+		list := strings.TrimPrefix(cmd, "LIST ")
+		return []string{"BEGIN LIST " + list + " " + name, "END LIST " + list + " " + name}, false
+	case "GET CMDDESC":
+		return errLine("CMD-NOT-SUPPORTED"), false
+	}
+	if s.stale(u) {
+		return errLine("DATA-STALE"), false
+	}
+
+	// Everything else is about a variable.
+	varname := args[1]
+	value, ok := u.Vars[varname]
+	if !ok {
+		return errLine("VAR-NOT-SUPPORTED"), false
+	}
+	switch cmd {
+	case "GET VAR":
+		return []string{fmt.Sprintf("VAR %v %v %v", name, varname, upsc.QuoteUpsdValue(value))}, false
+	case "GET TYPE":
+		return []string{fmt.Sprintf("TYPE %v %v %v", name, varname, varType(u.Meta[varname], value))}, false
+	case "GET DESC":
+		desc := "Description unavailable"
+		if m := u.Meta[varname]; m != nil && m.Description != "" {
+			desc = m.Description
+		}
+		return []string{fmt.Sprintf("DESC %v %v %v", name, varname, upsc.QuoteUpsdValue(desc))}, false
+	default:
+		// LIST ENUM and LIST RANGE, which only matter for writable variables.
+		list := strings.TrimPrefix(cmd, "LIST ")
+		return []string{fmt.Sprintf("BEGIN LIST %v %v %v", list, name, varname), fmt.Sprintf("END LIST %v %v %v", list, name, varname)}, false
+	}
+}
+
+// Whether upsd's stopped answering for this UPS, so we'd only be handing out old values.
+func (s *Server) stale(u *channels.UPSInfo) bool {
+	seen := s.c.State().LastSeen(u.ID)
+	return s.stale_after > 0 && !seen.IsZero() && time.Since(seen) > s.stale_after
+}
+
+func upsDesc(u *channels.UPSInfo) string {
+	if u.Description != "" {
+		return u.Description
+	}
+	return "Unavailable"
+}
+
+// As GET TYPE has it, but never RW, as we won't SET anything.
+func varType(m *channels.VarMetadata, value string) string {
+	if m == nil || m.Type == "" {
+		return "NUMBER"
+	}
+	if m.Type == "STRING" {
+		// Clients expect a length, so if upsd didn't give us one, what's there now will have to do.
+		n := m.MaxLength
+		if n <= 0 {
+			n = len(value)
+		}
+		return "STRING:" + strconv.Itoa(n)
+	}
+	return m.Type
+}
@@ -0,0 +1,270 @@
+package nutserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	control "github.com/gerrowadat/nut2mqtt/internal/control"
+	upsc "github.com/gerrowadat/nut2mqtt/internal/upsc"
+)
+
+func TestServedNames(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		upses []*channels.UPSInfo
+		want  map[string]string
+	}{
+		{
+			name: "host and name",
+			upses: []*channels.UPSInfo{
+				{ID: "nas:3493/ups", Host: "nas", Port: 3493, Name: "ups"},
+				{ID: "pi.lan:3493/ups", Host: "pi.lan", Port: 3493, Name: "ups"},
+				{ID: "nas:3494/ups", Host: "nas", Port: 3494, Name: "ups"},
+			},
+			want: map[string]string{"nas-ups": "nas:3493/ups", "pi.lan-ups": "pi.lan:3493/ups", "nas-3494-ups": "nas:3494/ups"},
+		},
+		{
+			name: "aliases and nut names",
+			upses: []*channels.UPSInfo{
+				{ID: "nas:3493/ups", Host: "nas", Port: 3493, Name: "ups", Alias: "rack ups"},
+				{ID: "pi:3493/ups", Host: "pi", Port: 3493, Name: "ups", Alias: "desk", NUTName: "ups"},
+			},
+			want: map[string]string{"rack_ups": "nas:3493/ups", "ups": "pi:3493/ups"},
+		},
+		{
+			name: "clashing anyway",
+			upses: []*channels.UPSInfo{
+				{ID: "nas:3493/ups", Host: "nas", Port: 3493, Name: "ups"},
+				{ID: "pi:3493/ups", Host: "pi", Port: 3493, Name: "ups", Alias: "nas-ups"},
+				{ID: "pi:3493/other", Host: "pi", Port: 3493, Name: "other", NUTName: "nas-ups"},
+			},
+			want: map[string]string{"nas-ups": "pi:3493/other"},
+		},
+	} {
+		got := map[string]string{}
+		for n, u := range ServedNames(tt.upses) {
+			got[n] = u.ID
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: ServedNames() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Names don't change as other UPSes come and go.
+func TestServedNamesStable(t *testing.T) {
+	a := &channels.UPSInfo{ID: "nas:3493/ups", Host: "nas", Port: 3493, Name: "ups"}
+	b := &channels.UPSInfo{ID: "pi:3493/ups", Host: "pi", Port: 3493, Name: "ups"}
+	before := ServedNames([]*channels.UPSInfo{a})
+	after := ServedNames([]*channels.UPSInfo{a, b})
+	if before["nas-ups"] != a || after["nas-ups"] != a {
+		t.Errorf("nas-ups moved: before %v, after %v", before, after)
+	}
+}
+
+func testServer(stale_after time.Duration) *Server {
+	c := control.NewController("bridge", time.Minute)
+	c.State().Set("nas:3493/ups", &channels.UPSInfo{
+		ID: "nas:3493/ups", Host: "nas", Port: 3493, Name: "ups", NUTName: "ups", Description: "Rack UPS",
+		Vars: map[string]string{"battery.charge": "100", "ups.status": "OL", "device.model": `Smart "1500"`},
+		Meta: map[string]*channels.VarMetadata{
+			"battery.charge": {Description: "Battery charge (percent of full)", Type: "NUMBER", Writable: true},
+			"device.model":   {Type: "STRING", MaxLength: 32},
+		},
+	})
+	return NewServer(&c, stale_after)
+}
+
+func TestRespond(t *testing.T) {
+	s := testServer(time.Minute)
+	sess := &session{}
+	for _, tt := range []struct {
+		line string
+		want []string
+		done bool
+	}{
+		{line: "LIST UPS", want: []string{"BEGIN LIST UPS", `UPS ups "Rack UPS"`, "END LIST UPS"}},
+		{line: "LIST VAR ups", want: []string{"BEGIN LIST VAR ups", `VAR ups battery.charge "100"`, `VAR ups device.model "Smart \"1500\""`, `VAR ups ups.status "OL"`, "END LIST VAR ups"}},
+		{line: "list var nope", want: []string{"ERR UNKNOWN-UPS"}},
+		{line: "LIST VAR", want: []string{"ERR INVALID-ARGUMENT"}},
+		{line: "LIST RW ups", want: []string{"BEGIN LIST RW ups", "END LIST RW ups"}},
+		{line: "LIST ENUM ups ups.status", want: []string{"BEGIN LIST ENUM ups ups.status", "END LIST ENUM ups ups.status"}},
+		{line: "GET VAR ups ups.status", want: []string{`VAR ups ups.status "OL"`}},
+		{line: "GET VAR ups input.voltage", want: []string{"ERR VAR-NOT-SUPPORTED"}},
+		// Never RW, as we won't SET anything.
+		{line: "GET TYPE ups battery.charge", want: []string{"TYPE ups battery.charge NUMBER"}},
+		{line: "GET TYPE ups device.model", want: []string{"TYPE ups device.model STRING:32"}},
+		{line: "GET DESC ups battery.charge", want: []string{`DESC ups battery.charge "Battery charge (percent of full)"`}},
+		{line: "GET DESC ups ups.status", want: []string{`DESC ups ups.status "Description unavailable"`}},
+		{line: "GET UPSDESC ups", want: []string{`UPSDESC ups "Rack UPS"`}},
+		{line: "SET VAR ups battery.charge 50", want: []string{"ERR ACCESS-DENIED"}},
+		{line: "INSTCMD ups test.battery.start", want: []string{"ERR ACCESS-DENIED"}},
+		{line: "LOGIN ups", want: []string{"ERR USERNAME-REQUIRED"}},
+		{line: "USERNAME monuser", want: []string{"OK"}},
+		{line: "USERNAME again", want: []string{"ERR ALREADY-SET-USERNAME"}},
+		{line: "PASSWORD secret", want: []string{"OK"}},
+		{line: "LOGIN nope", want: []string{"ERR UNKNOWN-UPS"}},
+		{line: "LOGIN ups", want: []string{"OK"}},
+		{line: "LOGIN ups", want: []string{"ERR ALREADY-LOGGED-IN"}},
+		{line: "GET NUMLOGINS ups", want: []string{"NUMLOGINS ups 1"}},
+		{line: "PRIMARY ups", want: []string{"ERR ACCESS-DENIED"}},
+		{line: "FSD ups", want: []string{"ERR ACCESS-DENIED"}},
+		{line: "STARTTLS", want: []string{"ERR FEATURE-NOT-CONFIGURED"}},
+		{line: "NETVER", want: []string{"1.3"}},
+		{line: "FROB", want: []string{"ERR UNKNOWN-COMMAND"}},
+		{line: `GET VAR "ups`, want: []string{"ERR INVALID-ARGUMENT"}},
+		{line: "LOGOUT", want: []string{"OK Goodbye"}, done: true},
+	} {
+		got, done := s.Respond(sess, tt.line)
+		if !reflect.DeepEqual(got, tt.want) || done != tt.done {
+			t.Errorf("Respond(%q) = %q, %v, want %q, %v", tt.line, got, done, tt.want, tt.done)
+		}
+	}
+	s.logout(sess)
+	if got, _ := s.Respond(sess, "GET NUMLOGINS ups"); !reflect.DeepEqual(got, []string{"NUMLOGINS ups 0"}) {
+		t.Errorf("after logging out, got %q", got)
+	}
+}
+
+func TestStale(t *testing.T) {
+	s := testServer(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	sess := &session{}
+	for line, want := range map[string][]string{
+		"LIST UPS":               {"BEGIN LIST UPS", `UPS ups "Rack UPS"`, "END LIST UPS"},
+		"LIST VAR ups":           {"ERR DATA-STALE"},
+		"GET VAR ups ups.status": {"ERR DATA-STALE"},
+	} {
+		if got, _ := s.Respond(sess, line); !reflect.DeepEqual(got, want) {
+			t.Errorf("Respond(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+// With the controller pruning its cache for real, a UPS that stops turning up is DATA-STALE for a while before
+// it's gone altogether.
+func TestStaleBeforePruned(t *testing.T) {
+	lifetime := 400 * time.Millisecond
+	c := control.NewController("bridge", lifetime)
+	c.SetActive(false)
+	go c.UPSVariableUpdateMultiplexer()
+	go c.MetricsUpdateConsumer()
+	s := NewServer(&c, StaleAfter(time.Second, lifetime))
+	sess := &session{}
+
+	start := time.Now()
+	c.Channels().Ups <- &channels.UPSInfo{Host: "nas", Port: 3493, Name: "ups", Vars: map[string]string{"ups.status": "OL"}}
+	for {
+		if got, _ := s.Respond(sess, "GET VAR nas-ups ups.status"); reflect.DeepEqual(got, []string{`VAR nas-ups ups.status "OL"`}) {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("UPS never showed up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Stale after 200ms, pruned somewhere between 400ms and 600ms.
+	time.Sleep(time.Until(start.Add(300 * time.Millisecond)))
+	if got, _ := s.Respond(sess, "GET VAR nas-ups ups.status"); !reflect.DeepEqual(got, []string{"ERR DATA-STALE"}) {
+		t.Errorf("after 300ms got %q, want DATA-STALE", got)
+	}
+	time.Sleep(time.Until(start.Add(800 * time.Millisecond)))
+	if got, _ := s.Respond(sess, "GET VAR nas-ups ups.status"); !reflect.DeepEqual(got, []string{"ERR UNKNOWN-UPS"}) {
+		t.Errorf("after 800ms got %q, want UNKNOWN-UPS", got)
+	}
+}
+
+// Our own upsd client should get back what we put in.
+func TestServe(t *testing.T) {
+	s := testServer(time.Minute)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+	go s.Serve(ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr := ln.Addr().(*net.TCPAddr)
+	client := upsc.NewUPSDClient(addr.IP.String(), addr.Port)
+	upses, err := upsc.GetUPSes(ctx, client)
+	if err != nil || len(upses) != 1 || upses[0].Name != "ups" || upses[0].Description != "Rack UPS" {
+		t.Fatalf("GetUPSes() = %+v, %v", upses, err)
+	}
+	vars, err := upsc.GetVars(ctx, client, upses[0])
+	if err != nil {
+		t.Fatalf("GetVars(): %v", err)
+	}
+	if want := map[string]string{"battery.charge": "100", "ups.status": "OL", "device.model": `Smart "1500"`}; !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetVars() = %v, want %v", vars, want)
+	}
+	vt, err := upsc.GetType(ctx, client, "ups", "device.model")
+	if err != nil || vt.Kind != "STRING" || vt.MaxLength != 32 || vt.Writable {
+		t.Errorf("GetType() = %+v, %v", vt, err)
+	}
+	if _, err := upsc.GetVar(ctx, client, "nope", "ups.status"); err == nil {
+		t.Errorf("GetVar() on an unknown UPS should fail")
+	}
+	cmds, err := upsc.ListCmds(ctx, client, "ups")
+	if err != nil || len(cmds) != 0 {
+		t.Errorf("ListCmds() = %v, %v", cmds, err)
+	}
+}
+
+func TestIdleAndMaxClients(t *testing.T) {
+	s := testServer(time.Minute)
+	s.idle_timeout = 100 * time.Millisecond
+	s.clients = make(chan struct{}, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+	go s.Serve(ln)
+
+	// Closed on us, one way or another, within a second.
+	hungUp := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer first.Close()
+	// Make sure the first one's being handled before the second turns up.
+	fmt.Fprintf(first, "NETVER\n")
+	if line, _ := bufio.NewReader(first).ReadString('\n'); line != "1.3\n" {
+		t.Fatalf("NETVER got %q", line)
+	}
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer second.Close()
+	if !hungUp(second) {
+		t.Errorf("second client should be turned away while the first is connected")
+	}
+	// The first says nothing more, so it's dropped, making room for another.
+	if !hungUp(first) {
+		t.Errorf("idle client should be hung up on")
+	}
+	third, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer third.Close()
+	fmt.Fprintf(third, "NETVER\n")
+	if line, _ := bufio.NewReader(third).ReadString('\n'); line != "1.3\n" {
+		t.Errorf("client after the idle one went got %q", line)
+	}
+}
@@ -0,0 +1,454 @@
+package upsc
+
+// Parsing of upsd responses into something typed. See rfc9271, section 4.
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A single line of a LIST or GET response, split into its parts.
+type UpsdItem struct {
+	// The noun the line starts with, e.g. VAR, RW, CMD, RANGE.
+	Noun string
+	// The UPS this line is about.
+	Ups string
+	// The variable, command or client this line is about, if the noun has one.
+	Name string
+	// Everything after the identifiers, with quoting removed.
+	Args []string
+}
+
+// The first argument, which is the value for most nouns.
+func (i *UpsdItem) Value() string {
+	if len(i.Args) == 0 {
+		return ""
+	}
+	return i.Args[0]
+}
+
+// A parsed response to a LIST or GET command.
+type UpsdResponse struct {
+	Cmd   string
+	Items []*UpsdItem
+}
+
+// Flatten the response into name -> value, for nouns with one value per name (UPS, VAR, RW, DESC, etc).
+// For UPS and UPSDESC the UPS name is the key.
+func (r *UpsdResponse) Map() map[string]string {
+	ret := map[string]string{}
+	for _, i := range r.Items {
+		if i.Name != "" {
+			ret[i.Name] = i.Value()
+		} else {
+			ret[i.Ups] = i.Value()
+		}
+	}
+	return ret
+}
+
+// All the names in the response, e.g. the commands from LIST CMD.
+func (r *UpsdResponse) Names() []string {
+	ret := []string{}
+	for _, i := range r.Items {
+		ret = append(ret, i.Name)
+	}
+	return ret
+}
+
+// All the values in the response, e.g. the permitted values from LIST ENUM.
+func (r *UpsdResponse) Values() []string {
+	ret := []string{}
+	for _, i := range r.Items {
+		ret = append(ret, i.Value())
+	}
+	return ret
+}
+
+// An ERR response from upsd, see rfc9271 section 4.3.
+type UpsdError struct {
+	// e.g. UNKNOWN-UPS, VAR-NOT-SUPPORTED, ACCESS-DENIED
+	Code string
+	// Some errors carry extra detail after the code.
+	Extra string
+}
+
+func (e *UpsdError) Error() string {
+	if e.Extra != "" {
+		return fmt.Sprintf("upsd error %v (%v)", e.Code, e.Extra)
+	}
+	return "upsd error " + e.Code
+}
+
+// How each noun lays out its line: how many identifier tokens follow it, and how many arguments after that.
+// max_args of -1 means there's no upper bound.
+type upsdNounLayout struct {
+	identifiers int
+	min_args    int
+	max_args    int
+}
+
+var upsdNounLayouts = map[string]upsdNounLayout{
+	// UPS <upsname> "<description>"
+	"UPS": {1, 1, 1},
+	// VAR <upsname> <varname> "<value>"
+	"VAR": {2, 1, 1},
+	// RW <upsname> <varname> "<value>"
+	"RW": {2, 1, 1},
+	// CMD <upsname> <cmdname>
+	"CMD": {2, 0, 0},
+	// ENUM <upsname> <varname> "<value>"
+	"ENUM": {2, 1, 1},
+	// RANGE <upsname> <varname> "<min>" "<max>"
+	"RANGE": {2, 2, 2},
+	// CLIENT <upsname> <client ip>
+	"CLIENT": {2, 0, 0},
+	// TYPE <upsname> <varname> <type>...
+	"TYPE": {2, 1, -1},
+	// DESC <upsname> <varname> "<description>"
+	"DESC": {2, 1, 1},
+	// CMDDESC <upsname> <cmdname> "<description>"
+	"CMDDESC": {2, 1, 1},
+	// NUMLOGINS <upsname> <value>
+	"NUMLOGINS": {1, 1, 1},
+	// UPSDESC <upsname> "<description>"
+	"UPSDESC": {1, 1, 1},
+}
+
+// The noun we expect in response to a command, which is always its second word (LIST VAR -> VAR, GET TYPE -> TYPE).
+func expectedNoun(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+func processUpsdResponse(response string, cmd string) (*UpsdResponse, error) {
+	ret := &UpsdResponse{Cmd: cmd, Items: []*UpsdItem{}}
+	replines := strings.Split(response, "\n")
+	// Drop trailing newline
+	if len(replines) > 0 && replines[len(replines)-1] == "" {
+		replines = replines[:len(replines)-1]
+	}
+	if len(replines) == 0 {
+		// No response is fine.
+		return ret, nil
+	}
+	if replines[0] == "ERR" || strings.HasPrefix(replines[0], "ERR ") {
+		return nil, parseUpsdError(replines[0])
+	}
+	noun := expectedNoun(cmd)
+	if strings.HasPrefix(cmd, "LIST") {
+		// rfc9271 4.2.7 "All the LIST commands had fucking better produce a response with a common format."
+		// (I'm paraphrasing here)
+		if !strings.HasPrefix(replines[0], fmt.Sprintf("BEGIN %v", cmd)) {
+			return nil, fmt.Errorf("no BEGIN preamble in %v response", cmd)
+		}
+		if !strings.HasPrefix(replines[len(replines)-1], fmt.Sprintf("END %v", cmd)) {
+			return nil, fmt.Errorf("no END addendum in %v response", cmd)
+		}
+		for i := 1; i < (len(replines) - 1); i++ {
+			item, err := parseUpsdLine(replines[i])
+			if err != nil {
+				return nil, err
+			}
+			if item == nil {
+				continue
+			}
+			if item.Noun != noun {
+				return nil, fmt.Errorf("unexpected %v line in %v response", item.Noun, cmd)
+			}
+			ret.Items = append(ret.Items, item)
+		}
+		return ret, nil
+	}
+
+	if strings.HasPrefix(cmd, "GET") {
+		// GET should return a single item, if at all.
+		if len(replines) > 1 {
+			return nil, fmt.Errorf("multiple response lines from GET command")
+		}
+		item, err := parseUpsdLine(replines[0])
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			if item.Noun != noun {
+				return nil, fmt.Errorf("unexpected %v line in %v response", item.Noun, cmd)
+			}
+			ret.Items = append(ret.Items, item)
+		}
+		return ret, nil
+	}
+
+	return nil, fmt.Errorf("command not implemented: %v", cmd)
+}
+
+func parseUpsdError(line string) *UpsdError {
+	// ERR <message> [<extra>]
+	fields := strings.SplitN(strings.TrimPrefix(line, "ERR"), " ", 3)
+	ret := &UpsdError{}
+	if len(fields) > 1 {
+		ret.Code = fields[1]
+	}
+	if len(fields) > 2 {
+		ret.Extra = fields[2]
+	}
+	return ret
+}
+
+func parseUpsdLine(line string) (*UpsdItem, error) {
+	// See rfc9271, sections 4.2.4 and 4.2.7
+	// Each line in either a single-line GET response or a multi-line LIST response is of the form:
+	// NOUN <identifiers...> <arguments...>
+	// How many identifiers and arguments there are depends on the noun, so look it up and
+	// shit the bed if we don't 100% know how the noun works.
+	if line == "" {
+		return nil, nil
+	}
+	tokens, err := SplitUpsdLine(line)
+	if err != nil {
+		return nil, err
+	}
+	layout, ok := upsdNounLayouts[tokens[0]]
+	if !ok {
+		return nil, fmt.Errorf("do not know how to interpret UPS response: %v", line)
+	}
+	args := tokens[1:]
+	if len(args) < layout.identifiers+layout.min_args || (layout.max_args >= 0 && len(args) > layout.identifiers+layout.max_args) {
+		return nil, fmt.Errorf("wrong number of fields in %v response: %v", tokens[0], line)
+	}
+	ret := &UpsdItem{Noun: tokens[0], Ups: args[0], Args: args[layout.identifiers:]}
+	if layout.identifiers > 1 {
+		ret.Name = args[1]
+	}
+	return ret, nil
+}
+
+// Split a line (from upsd, or a client, see internal/nutserver) into tokens, following the NUT quoting rules:
+// tokens are separated by spaces, double quotes group words (and allow empty tokens),
+// and a backslash takes the next character literally, inside or outside quotes.
+func SplitUpsdLine(line string) ([]string, error) {
+	tokens := []string{}
+	var tok strings.Builder
+	in_token := false
+	in_quotes := false
+	escaped := false
+	// Everything significant is ASCII, so walk bytes and leave anything else untouched.
+	for i := 0; i < len(line); i++ {
+		r := line[i]
+		switch {
+		case escaped:
+			tok.WriteByte(r)
+			in_token = true
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			// Quotes just toggle whether spaces split, so `"a b"c` is the one token `a bc`.
+			in_quotes = !in_quotes
+			in_token = true
+		case (r == ' ' || r == '\t') && !in_quotes:
+			if in_token {
+				tokens = append(tokens, tok.String())
+				tok.Reset()
+				in_token = false
+			}
+		default:
+			tok.WriteByte(r)
+			in_token = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in upsd line: %q", line)
+	}
+	if in_quotes {
+		return nil, fmt.Errorf("unterminated quote in upsd line: %q", line)
+	}
+	if in_token {
+		tokens = append(tokens, tok.String())
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty upsd line: %q", line)
+	}
+	return tokens, nil
+}
+
+// Quote a value the way upsd does, so that SplitUpsdLine gets it back intact.
+func QuoteUpsdValue(s string) string {
+	var ret strings.Builder
+	ret.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			ret.WriteByte('\\')
+		}
+		ret.WriteByte(s[i])
+	}
+	ret.WriteByte('"')
+	return ret.String()
+}
+
+// The typed variants of the various LIST and GET commands.
+
+// LIST RW: writable variables and their current values.
+func ListRW(ctx context.Context, upsd_c UPSDClientIf, ups string) (map[string]string, error) {
+	rep, err := UpsdCommand(ctx, upsd_c, "LIST RW "+ups)
+	if err != nil {
+		return nil, err
+	}
+	return rep.Map(), nil
+}
+
+// LIST CMD: instant commands the UPS supports.
+func ListCmds(ctx context.Context, upsd_c UPSDClientIf, ups string) ([]string, error) {
+	rep, err := UpsdCommand(ctx, upsd_c, "LIST CMD "+ups)
+	if err != nil {
+		return nil, err
+	}
+	return rep.Names(), nil
+}
+
+// LIST ENUM: the permitted values of an enum variable.
+func ListEnum(ctx context.Context, upsd_c UPSDClientIf, ups string, varname string) ([]string, error) {
+	rep, err := UpsdCommand(ctx, upsd_c, fmt.Sprintf("LIST ENUM %v %v", ups, varname))
+	if err != nil {
+		return nil, err
+	}
+	return rep.Values(), nil
+}
+
+type VarRange struct {
+	Min string
+	Max string
+}
+
+// LIST RANGE: the permitted ranges of a range variable.
+func ListRange(ctx context.Context, upsd_c UPSDClientIf, ups string, varname string) ([]VarRange, error) {
+	rep, err := UpsdCommand(ctx, upsd_c, fmt.Sprintf("LIST RANGE %v %v", ups, varname))
+	if err != nil {
+		return nil, err
+	}
+	ret := []VarRange{}
+	for _, i := range rep.Items {
+		ret = append(ret, VarRange{Min: i.Args[0], Max: i.Args[1]})
+	}
+	return ret, nil
+}
+
+// LIST CLIENT: addresses of clients logged into this UPS.
+func ListClients(ctx context.Context, upsd_c UPSDClientIf, ups string) ([]string, error) {
+	rep, err := UpsdCommand(ctx, upsd_c, "LIST CLIENT "+ups)
+	if err != nil {
+		return nil, err
+	}
+	return rep.Names(), nil
+}
+
+// Pull the single value out of a GET response, complaining if there isn't one.
+func getSingle(ctx context.Context, upsd_c UPSDClientIf, cmd string) (*UpsdItem, error) {
+	rep, err := UpsdCommand(ctx, upsd_c, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(rep.Items) != 1 {
+		return nil, fmt.Errorf("no response to %v", cmd)
+	}
+	return rep.Items[0], nil
+}
+
+// GET VAR: the value of a single variable.
+func GetVar(ctx context.Context, upsd_c UPSDClientIf, ups string, varname string) (string, error) {
+	item, err := getSingle(ctx, upsd_c, fmt.Sprintf("GET VAR %v %v", ups, varname))
+	if err != nil {
+		return "", err
+	}
+	return item.Value(), nil
+}
+
+// The type of a variable, as returned by GET TYPE.
+type VarType struct {
+	// Settable via SET VAR
+	Writable bool
+	// One of STRING, NUMBER, ENUM or RANGE
+	Kind string
+	// For STRING, the maximum length.
+	MaxLength int
+}
+
+func parseVarType(args []string) (*VarType, error) {
+	ret := &VarType{}
+	for _, a := range args {
+		switch {
+		case a == "RW":
+			ret.Writable = true
+		case a == "NUMBER" || a == "ENUM" || a == "RANGE":
+			ret.Kind = a
+		case strings.HasPrefix(a, "STRING:"):
+			ret.Kind = "STRING"
+			n, err := strconv.Atoi(strings.TrimPrefix(a, "STRING:"))
+			if err != nil {
+				return nil, fmt.Errorf("bad string length in type %v: %v", a, err)
+			}
+			ret.MaxLength = n
+		default:
+			return nil, fmt.Errorf("unknown variable type: %v", a)
+		}
+	}
+	// Per rfc9271 4.2.6, something that's neither a string nor an enum/range is a number.
+	if ret.Kind == "" {
+		ret.Kind = "NUMBER"
+	}
+	return ret, nil
+}
+
+// GET TYPE: whether a variable is writable and what sort of value it holds.
+func GetType(ctx context.Context, upsd_c UPSDClientIf, ups string, varname string) (*VarType, error) {
+	item, err := getSingle(ctx, upsd_c, fmt.Sprintf("GET TYPE %v %v", ups, varname))
+	if err != nil {
+		return nil, err
+	}
+	return parseVarType(item.Args)
+}
+
+// GET DESC: the human-readable description of a variable.
+func GetDesc(ctx context.Context, upsd_c UPSDClientIf, ups string, varname string) (string, error) {
+	item, err := getSingle(ctx, upsd_c, fmt.Sprintf("GET DESC %v %v", ups, varname))
+	if err != nil {
+		return "", err
+	}
+	return item.Value(), nil
+}
+
+// GET CMDDESC: the human-readable description of an instant command.
+func GetCmdDesc(ctx context.Context, upsd_c UPSDClientIf, ups string, cmdname string) (string, error) {
+	item, err := getSingle(ctx, upsd_c, fmt.Sprintf("GET CMDDESC %v %v", ups, cmdname))
+	if err != nil {
+		return "", err
+	}
+	return item.Value(), nil
+}
+
+// GET NUMLOGINS: how many clients are logged into this UPS.
+func GetNumLogins(ctx context.Context, upsd_c UPSDClientIf, ups string) (int, error) {
+	item, err := getSingle(ctx, upsd_c, "GET NUMLOGINS "+ups)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(item.Value())
+	if err != nil {
+		return 0, fmt.Errorf("bad NUMLOGINS value %q: %v", item.Value(), err)
+	}
+	return n, nil
+}
+
+// GET UPSDESC: the description of the UPS from ups.conf.
+func GetUPSDesc(ctx context.Context, upsd_c UPSDClientIf, ups string) (string, error) {
+	item, err := getSingle(ctx, upsd_c, "GET UPSDESC "+ups)
+	if err != nil {
+		return "", err
+	}
+	return item.Value(), nil
+}
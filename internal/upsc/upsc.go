@@ -1,21 +1,25 @@
 package upsc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
 	control "github.com/gerrowadat/nut2mqtt/internal/control"
+	logging "github.com/gerrowadat/nut2mqtt/internal/logging"
 )
 
+var logger = logging.Logger("upsc")
+
 type UPSDClientIf interface {
-	Request(cmd string) (string, error)
+	Request(ctx context.Context, cmd string) (string, error)
 	Host() string
 	Port() int
 }
@@ -23,14 +27,35 @@ type UPSDClientIf interface {
 type UPSDClient struct {
 	host string
 	port int
+	// Told about every request we make, e.g. for metrics.
+	observer RequestObserver
+}
+
+// Called after each upsd request with the command (e.g. "LIST VAR"), how long it took,
+// and the ErrorType of any error (or "" if it worked).
+type RequestObserver func(host string, command string, took time.Duration, err_type string)
+
+// Clients that can be told how their requests went, see UpsdCommand.
+type observableClient interface {
+	ObserveRequest(command string, took time.Duration, err_type string)
 }
 
 func NewUPSDClient(host string, port int) *UPSDClient {
 	return &UPSDClient{host: host, port: port}
 }
 
-func (upsd_c *UPSDClient) Request(cmd string) (string, error) {
-	return rawUpsdCommand(upsd_c, cmd)
+func (upsd_c *UPSDClient) Request(ctx context.Context, cmd string) (string, error) {
+	return rawUpsdCommand(ctx, upsd_c, cmd)
+}
+
+func (upsd_c *UPSDClient) SetObserver(o RequestObserver) {
+	upsd_c.observer = o
+}
+
+func (upsd_c *UPSDClient) ObserveRequest(command string, took time.Duration, err_type string) {
+	if upsd_c.observer != nil {
+		upsd_c.observer(upsd_c.host, command, took, err_type)
+	}
 }
 
 func (upsd_c *UPSDClient) Host() string {
@@ -43,6 +68,8 @@ func (upsd_c *UPSDClient) Port() int {
 
 type UPSHosts struct {
 	Hosts []*UPSDClient
+	// Variable metadata doesn't change, so we only ask once. Keyed by host:port/ups, then variable.
+	meta_cache map[string]map[string]*channels.VarMetadata
 }
 
 func NewUPSHosts(hosts_flag string, default_port int) *UPSHosts {
@@ -52,163 +79,255 @@ func NewUPSHosts(hosts_flag string, default_port int) *UPSHosts {
 		// If the host has a port, use it. Otherwise, use the default.
 		host_fragments := strings.Split(host, ":")
 		if len(host_fragments) == 1 {
-			hosts = append(hosts, NewUPSDClient(host, 3493))
+			hosts = append(hosts, NewUPSDClient(host, default_port))
 		} else if len(host_fragments) == 2 {
 			port, err := strconv.Atoi(host_fragments[1])
 			if err != nil {
-				log.Fatalf("Error parsing port number from %v: %v", host, err)
+				logger.Error("Error parsing port number from --upsd-hosts", "host", host, "err", err)
+				os.Exit(1)
 			}
 			hosts = append(hosts, NewUPSDClient(host_fragments[0], port))
 		} else {
-			log.Fatalf("Error parsing host '%v' from flag", host)
+			logger.Error("Error parsing host from --upsd-hosts", "host", host)
+			os.Exit(1)
 		}
 	}
 	ret.Hosts = hosts
+	ret.meta_cache = map[string]map[string]*channels.VarMetadata{}
 	return ret
 }
 
-func (ups_hosts *UPSHosts) UPSInfoProducer(c *control.Controller, poll_interval time.Duration) {
+func (ups_hosts *UPSHosts) UPSInfoProducer(c *control.Controller, poll_interval time.Duration, request_timeout time.Duration) {
 	// Check the list of UPses and emit each one on the channel for checking.
 	defer c.WaitGroupDone()
 	for _, upsd_c := range ups_hosts.Hosts {
-		log.Printf("Watching for UPSes on %v:%v\n", upsd_c.Host(), upsd_c.Port())
+		logger.Info("Watching for UPSes", "host", upsd_c.Host(), "port", upsd_c.Port())
+		upsd_c.SetObserver(c.MetricRegistry().ObserveUPSDRequest)
 	}
+	ups_hosts.pollAll(c, request_timeout)
+	ticker := time.NewTicker(poll_interval * time.Second)
+	defer ticker.Stop()
 	for {
-		for _, upsd_c := range ups_hosts.Hosts {
-			upses, err := GetUPSes(upsd_c)
-			if err != nil {
-				c.Shutdown("Error getting UPSes: %v", err)
-			}
-			for _, u := range upses {
-				c.MetricRegistry().Metrics().UPSScrapesCount.Inc()
-				//GetUpdatedVars(upsd_c, u)
-				u.Vars, err = GetVars(upsd_c, u)
-				if err != nil {
-					c.Shutdown("Error getting vars for %v: %v", u.Name, err)
+		select {
+		case <-ticker.C:
+			ups_hosts.pollAll(c, request_timeout)
+		case host := <-c.PollRequests():
+			// Asked to poll now, by a poll-now command.
+			for _, upsd_c := range ups_hosts.Hosts {
+				if host == "" || host == fmt.Sprintf("%v:%v", upsd_c.Host(), upsd_c.Port()) {
+					ups_hosts.poll(c, upsd_c, request_timeout)
 				}
-				c.Channels().Ups <- u
 			}
 		}
-		time.Sleep(poll_interval * time.Second)
 	}
 }
 
-func UpsdCommand(upsd_c UPSDClientIf, cmd string) (map[string]string, error) {
-	// Get raw output from upsd if we know how to parse it.
-	if strings.HasPrefix(cmd, "LIST") || strings.HasPrefix(cmd, "GET") {
-		//raw, err := rawUpsdCommand(upsd_c, cmd)
-		raw, err := upsd_c.Request(cmd)
-		if err != nil {
-			return nil, err
-		}
-		return processUpsdResponse(raw, cmd)
-	} else {
-		return nil, errors.New("Don't know how to issue upsd command: " + cmd)
+func (ups_hosts *UPSHosts) pollAll(c *control.Controller, request_timeout time.Duration) {
+	for _, upsd_c := range ups_hosts.Hosts {
+		ups_hosts.poll(c, upsd_c, request_timeout)
 	}
 }
 
-func processUpsdResponse(response string, cmd string) (map[string]string, error) {
-	ret := map[string]string{}
-	replines := strings.Split(response, "\n")
-	// Drop trailing newline
-	if len(replines) > 0 && replines[len(replines)-1] == "" {
-		replines = replines[:len(replines)-1]
-	}
-	if len(replines) == 0 {
-		// No response is fine.
-		return ret, nil
-	}
-	if strings.HasPrefix(cmd, "LIST") {
-		// rfc9271 4.2.7 "All the LIST commands had fucking better produce a response with a common format."
-		// (I'm paraphrasing here)
-		if !strings.HasPrefix(replines[0], fmt.Sprintf("BEGIN %v", cmd)) {
-			return nil, fmt.Errorf("no BEGIN preamble in %v response", cmd)
-		}
-		if !strings.HasPrefix(replines[len(replines)-1], fmt.Sprintf("END %v", cmd)) {
-			return nil, fmt.Errorf("no END addendum in %v response", cmd)
-		}
-		if len(replines) == 2 {
-			return ret, nil
+// Get every UPS on a host, and hand them to the controller.
+func (ups_hosts *UPSHosts) poll(c *control.Controller, upsd_c *UPSDClient, request_timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), request_timeout)
+	upses, err := GetUPSes(ctx, upsd_c)
+	cancel()
+	if err != nil {
+		if IsTimeout(err) {
+			// A hung upsd shouldn't take out every other host, skip it until next time.
+			logger.Warn("Timed out listing UPSes, skipping", "host", upsd_c.Host(), "port", upsd_c.Port(), "err", err)
+			return
 		}
-		for i := 1; i < (len(replines) - 1); i++ {
-			k, v, err := getKeyValueFromListLine(replines[i])
-			if err != nil {
-				return nil, err
+		c.Shutdown("Error getting UPSes: %v", err)
+	}
+	for _, u := range upses {
+		c.MetricRegistry().Metrics().UPSScrapesCount.Inc()
+		ctx, cancel := context.WithTimeout(context.Background(), request_timeout)
+		u.Vars, err = GetVars(ctx, upsd_c, u)
+		cancel()
+		if err != nil {
+			if IsTimeout(err) {
+				logger.Warn("Timed out getting vars, skipping", "host", upsd_c.Host(), "port", upsd_c.Port(), "ups", u.Name, "err", err)
+				continue
 			}
-			ret[k] = v
+			c.Shutdown("Error getting vars for %v: %v", u.Name, err)
 		}
-		return ret, nil
+		u.Meta = ups_hosts.varMetadata(upsd_c, u, request_timeout)
+		c.Channels().Ups <- u
 	}
+}
 
-	if strings.HasPrefix(cmd, "GET") {
-		// GET should return a single item, if at all.
-		if len(replines) > 1 {
-			return nil, fmt.Errorf("multiple response lines from GET command")
-		}
-		k, v, err := getKeyValueFromListLine(replines[0])
-		if err != nil {
-			return nil, err
-		}
-		if k != "" {
-			ret[k] = v
+// Metadata for all of a UPS's variables, fetching whatever we haven't seen before.
+func (ups_hosts *UPSHosts) varMetadata(upsd_c UPSDClientIf, u *channels.UPSInfo, request_timeout time.Duration) map[string]*channels.VarMetadata {
+	key := fmt.Sprintf("%v:%v/%v", upsd_c.Host(), upsd_c.Port(), u.Name)
+	cached, ok := ups_hosts.meta_cache[key]
+	if !ok {
+		cached = map[string]*channels.VarMetadata{}
+		ups_hosts.meta_cache[key] = cached
+	}
+	ret := map[string]*channels.VarMetadata{}
+	for k := range u.Vars {
+		if _, ok := cached[k]; !ok {
+			ctx, cancel := context.WithTimeout(context.Background(), request_timeout)
+			meta, err := GetVarMetadata(ctx, upsd_c, u.Name, k)
+			cancel()
+			if err != nil {
+				// Leave it uncached, we'll have another go next poll.
+				logger.Warn("Error getting metadata", "host", upsd_c.Host(), "port", upsd_c.Port(), "ups", u.Name, "var", k, "err", err)
+				continue
+			}
+			cached[k] = meta
 		}
-		return ret, nil
+		ret[k] = cached[k]
 	}
+	return ret
+}
 
-	return nil, fmt.Errorf("command not implemented: %v", cmd)
+// Returned (wrapped) when upsd doesn't answer within the request's deadline.
+var ErrUpsdTimeout = errors.New("upsd request timed out")
 
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrUpsdTimeout)
 }
 
-func getKeyValueFromListLine(line string) (string, string, error) {
-	// See rfc9271, sections 4.2.4 and 4.2.7
-	// Each line in either a single-line GET response or a multi-line LIST response is of the form:
-	// NOUN <requested> <response>
-	// <requested> can of course be more then one token, of course. The response is the rest of the line.
-	// So here, we figure things out by noun, and shit the bed of we don't 100% know how the noun works.
-	if line == "" {
-		return "", "", nil
+// Wrap timeouts from the net package or our context as ErrUpsdTimeout, so callers can tell them apart.
+func upsdError(err error) error {
+	var net_err net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &net_err) && net_err.Timeout()) {
+		return fmt.Errorf("%w: %v", ErrUpsdTimeout, err)
 	}
-	fragments := strings.Split(line, " ")
-	switch fragments[0] {
-	case "UPS":
-		// UPS upsname "ups description"
-		val_raw := strings.Join(fragments[2:], " ")
-		return fragments[1], val_raw[1 : len(val_raw)-1], nil
-	case "VAR":
-		// VAR myups varname "var value"
-		val_raw := strings.Join(fragments[3:], " ")
-		return fragments[2], val_raw[1 : len(val_raw)-1], nil
+	return err
+}
+
+// What sort of failure this was, for metrics: timeout, network, upsd (an ERR response) or protocol (we didn't understand it).
+func ErrorType(err error) string {
+	var upsd_err *UpsdError
+	var net_err net.Error
+	switch {
+	case IsTimeout(err):
+		return "timeout"
+	case errors.As(err, &upsd_err):
+		return "upsd"
+	case errors.As(err, &net_err):
+		return "network"
 	default:
-		return "", "", fmt.Errorf("do not know how to interpret UPS response: %v", line)
+		return "protocol"
 	}
+}
 
+// The command without its arguments, e.g. "LIST VAR myups" -> "LIST VAR", so metric labels don't explode.
+func commandName(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) > 2 {
+		fields = fields[:2]
+	}
+	return strings.Join(fields, " ")
 }
 
-func GetUPSes(upsd_c UPSDClientIf) ([]*channels.UPSInfo, error) {
+func UpsdCommand(ctx context.Context, upsd_c UPSDClientIf, cmd string) (rep *UpsdResponse, err error) {
+	// Get raw output from upsd if we know how to parse it.
+	if strings.HasPrefix(cmd, "LIST") || strings.HasPrefix(cmd, "GET") {
+		if o, ok := upsd_c.(observableClient); ok {
+			start := time.Now()
+			defer func() {
+				err_type := ""
+				if err != nil {
+					err_type = ErrorType(err)
+				}
+				o.ObserveRequest(commandName(cmd), time.Since(start), err_type)
+			}()
+		}
+		raw, err := upsd_c.Request(ctx, cmd)
+		if err != nil {
+			return nil, err
+		}
+		return processUpsdResponse(raw, cmd)
+	} else {
+		return nil, errors.New("Don't know how to issue upsd command: " + cmd)
+	}
+}
+
+func GetUPSes(ctx context.Context, upsd_c UPSDClientIf) ([]*channels.UPSInfo, error) {
 	// Get the list of UPSes from upsd
 	upses := []*channels.UPSInfo{}
-	upslist, err := UpsdCommand(upsd_c, "LIST UPS")
+	upslist, err := UpsdCommand(ctx, upsd_c, "LIST UPS")
 	if err != nil {
 		return nil, err
 	}
-	for k, v := range upslist {
-		upses = append(upses, &channels.UPSInfo{Name: k, Description: v, Host: upsd_c.Host(), Vars: make(map[string]string)})
+	for k, v := range upslist.Map() {
+		upses = append(upses, &channels.UPSInfo{Name: k, Description: v, Host: upsd_c.Host(), Port: upsd_c.Port(), Vars: make(map[string]string)})
 	}
 	return upses, nil
 }
 
-func GetVars(upsd_c UPSDClientIf, u *channels.UPSInfo) (map[string]string, error) {
-	ret, err := UpsdCommand(upsd_c, "LIST VAR "+u.Name)
+func GetVars(ctx context.Context, upsd_c UPSDClientIf, u *channels.UPSInfo) (map[string]string, error) {
+	ret, err := UpsdCommand(ctx, upsd_c, "LIST VAR "+u.Name)
 	if err != nil {
 		return nil, err
 	}
+	return ret.Map(), nil
+}
+
+// Ask upsd what a variable is, and guess at its unit.
+// Not every driver describes every variable, so a missing description or type isn't an error.
+func GetVarMetadata(ctx context.Context, upsd_c UPSDClientIf, ups string, varname string) (*channels.VarMetadata, error) {
+	ret := &channels.VarMetadata{Unit: VarUnit(varname)}
+	var upsd_err *UpsdError
+
+	desc, err := GetDesc(ctx, upsd_c, ups, varname)
+	if err != nil && !errors.As(err, &upsd_err) {
+		return nil, err
+	}
+	ret.Description = desc
+
+	vt, err := GetType(ctx, upsd_c, ups, varname)
+	if err != nil && !errors.As(err, &upsd_err) {
+		return nil, err
+	}
+	if vt != nil {
+		ret.Type = vt.Kind
+		ret.Writable = vt.Writable
+		ret.MaxLength = vt.MaxLength
+	}
 	return ret, nil
 }
 
-func GetUpdatedVars(upsd_c UPSDClientIf, u *channels.UPSInfo) (map[string]string, error) {
+// Units, keyed by the part of a NUT variable name that gives them away.
+var varUnits = map[string]string{
+	"voltage":     "V",
+	"current":     "A",
+	"frequency":   "Hz",
+	"charge":      "%",
+	"load":        "%",
+	"humidity":    "%",
+	"runtime":     "s",
+	"delay":       "s",
+	"timer":       "s",
+	"temperature": "°C",
+	"realpower":   "W",
+	"power":       "VA",
+}
+
+// Guess a variable's unit from its name, e.g. input.voltage.nominal -> V. Empty if we've no idea.
+func VarUnit(varname string) string {
+	parts := strings.Split(varname, ".")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if unit, ok := varUnits[parts[i]]; ok {
+			return unit
+		}
+	}
+	// Transfer points (input.transfer.low, input.transfer.boost.high and so on) are voltages, but don't say so.
+	if strings.HasPrefix(varname, "input.transfer.") && varname != "input.transfer.reason" {
+		return "V"
+	}
+	return ""
+}
+
+func GetUpdatedVars(ctx context.Context, upsd_c UPSDClientIf, u *channels.UPSInfo) (map[string]string, error) {
 	// Fetch updated vars for this UPS and both update the struct in place and return the new values.
 	ret := map[string]string{}
-	new_vars, err := GetVars(upsd_c, u)
+	new_vars, err := GetVars(ctx, upsd_c, u)
 	if err != nil {
 		return nil, err
 	}
@@ -244,35 +363,53 @@ func GetVarDiff(old *channels.UPSInfo, new *channels.UPSInfo) map[string]string
 }
 
 // Issue a raw command to upsd and return the output.
-func rawUpsdCommand(upsd_c UPSDClientIf, cmd string) (rep string, err error) {
+// The context's deadline (if any) applies to the dial and to every read and write.
+func rawUpsdCommand(ctx context.Context, upsd_c UPSDClientIf, cmd string) (rep string, err error) {
 	addr := upsd_c.Host() + ":" + strconv.Itoa(upsd_c.Port())
-	c, err := net.Dial("tcp", addr)
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, "tcp", addr)
 
 	if err != nil {
-		return "", err
+		return "", upsdError(err)
 	}
 
 	defer c.Close()
 
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	// If the context is cancelled some other way, unblock any pending read.
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+
 	end_marker := "\n"
 	if strings.HasPrefix(cmd, "LIST") {
 		end_marker = "END LIST"
 	}
 
-	c.Write([]byte(cmd + "\n"))
+	if _, err := c.Write([]byte(cmd + "\n")); err != nil {
+		return "", upsdError(err)
+	}
 
 	buf := make([]byte, 2048)
 
 	for {
 		raw, err := c.Read(buf)
 		if err != nil {
+			if ctx.Err() != nil {
+				return "", upsdError(ctx.Err())
+			}
 			if err != io.EOF {
-				return "", err
+				return "", upsdError(err)
 			}
 			break
 		}
 		rep += string(buf[:raw])
-		if strings.Contains(string(buf), end_marker) {
+		if strings.Contains(rep, end_marker) {
+			break
+		}
+		// upsd answers a bad LIST with a single ERR line rather than a BEGIN/END block.
+		if strings.HasPrefix(rep, "ERR") && strings.HasSuffix(rep, "\n") {
 			break
 		}
 	}
@@ -1,26 +1,33 @@
 package upsc
 
 import (
+	"context"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 
 	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
 )
 
-var GetKeyValueFromListLine = getKeyValueFromListLine
-
 // Mock UPSDClient that implements the UPSDClientIf interface
 // and just returns whatever raw output is passed to NewUPSDMockClient()
+// or, if made with NewUPSDScriptedMockClient(), the response for the given command.
 type UPSDMockClient struct {
-	host string
-	port int
-	raw  string
+	host      string
+	port      int
+	raw       string
+	responses map[string]string
 }
 
 func NewUPSDMockClient(host string, port int, raw string) *UPSDMockClient {
 	return &UPSDMockClient{host: host, port: port, raw: raw}
 }
 
+func NewUPSDScriptedMockClient(host string, port int, responses map[string]string) *UPSDMockClient {
+	return &UPSDMockClient{host: host, port: port, responses: responses}
+}
+
 func (upsd_c *UPSDMockClient) Host() string {
 	return upsd_c.host
 }
@@ -29,60 +36,212 @@ func (upsd_c *UPSDMockClient) Port() int {
 	return upsd_c.port
 }
 
-func (upsd_c *UPSDMockClient) Request(cmd string) (string, error) {
+func (upsd_c *UPSDMockClient) Request(ctx context.Context, cmd string) (string, error) {
+	if upsd_c.responses != nil {
+		rep, ok := upsd_c.responses[cmd]
+		if !ok {
+			return "ERR UNKNOWN-COMMAND\n", nil
+		}
+		return rep, nil
+	}
 	return upsd_c.raw, nil
 }
 
-func Test_getKeyValueFromListLine(t *testing.T) {
+func Test_parseUpsdLine(t *testing.T) {
 	type args struct {
 		line string
 	}
 	tests := []struct {
 		name    string
 		args    args
-		wantk   string
-		wantv   string
+		want    *UpsdItem
 		wantErr bool
 	}{
 		{
 			name:    "Blank",
 			args:    args{line: ""},
-			wantk:   "",
-			wantv:   "",
+			want:    nil,
 			wantErr: false,
 		},
 		{
 			name:    "UknownNoun",
 			args:    args{line: "TEAPOT name  capacity"},
-			wantk:   "",
-			wantv:   "",
+			want:    nil,
 			wantErr: true,
 		},
 		{
 			name:    "NormalUPS",
 			args:    args{line: "UPS myups \"makes a beeping sound\""},
-			wantk:   "myups",
-			wantv:   "makes a beeping sound",
+			want:    &UpsdItem{Noun: "UPS", Ups: "myups", Args: []string{"makes a beeping sound"}},
+			wantErr: false,
+		},
+		{
+			name:    "NormalVar",
+			args:    args{line: "VAR myups battery.charge \"100\""},
+			want:    &UpsdItem{Noun: "VAR", Ups: "myups", Name: "battery.charge", Args: []string{"100"}},
+			wantErr: false,
+		},
+		{
+			name:    "EmptyVar",
+			args:    args{line: "VAR myups input.transfer.reason \"\""},
+			want:    &UpsdItem{Noun: "VAR", Ups: "myups", Name: "input.transfer.reason", Args: []string{""}},
+			wantErr: false,
+		},
+		{
+			name:    "Cmd",
+			args:    args{line: "CMD myups test.battery.start"},
+			want:    &UpsdItem{Noun: "CMD", Ups: "myups", Name: "test.battery.start", Args: []string{}},
+			wantErr: false,
+		},
+		{
+			name:    "Range",
+			args:    args{line: "RANGE myups input.transfer.low \"80\" \"100\""},
+			want:    &UpsdItem{Noun: "RANGE", Ups: "myups", Name: "input.transfer.low", Args: []string{"80", "100"}},
+			wantErr: false,
+		},
+		{
+			name:    "Type",
+			args:    args{line: "TYPE myups ups.id RW STRING:8"},
+			want:    &UpsdItem{Noun: "TYPE", Ups: "myups", Name: "ups.id", Args: []string{"RW", "STRING:8"}},
 			wantErr: false,
 		},
+		{
+			name:    "NumLogins",
+			args:    args{line: "NUMLOGINS myups 2"},
+			want:    &UpsdItem{Noun: "NUMLOGINS", Ups: "myups", Args: []string{"2"}},
+			wantErr: false,
+		},
+		{
+			name:    "EscapedQuotes",
+			args:    args{line: `UPS myups "the \"good\" one"`},
+			want:    &UpsdItem{Noun: "UPS", Ups: "myups", Args: []string{`the "good" one`}},
+			wantErr: false,
+		},
+		{
+			name:    "EscapedBackslash",
+			args:    args{line: `VAR myups ups.id "C:\\UPS"`},
+			want:    &UpsdItem{Noun: "VAR", Ups: "myups", Name: "ups.id", Args: []string{`C:\UPS`}},
+			wantErr: false,
+		},
+		{
+			name:    "TrailingBackslash",
+			args:    args{line: `VAR myups ups.id "abc\`},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "JustANoun",
+			args:    args{line: "UPS"},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "OnlySpaces",
+			args:    args{line: "   "},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "TruncatedVar",
+			args:    args{line: "VAR myups"},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "UnterminatedQuote",
+			args:    args{line: "UPS myups \"makes a beeping"},
+			want:    nil,
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			k, v, err := GetKeyValueFromListLine(tt.args.line)
+			got, err := parseUpsdLine(tt.args.line)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("getKeyValueFromListLine() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("parseUpsdLine() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if k != tt.wantk {
-				t.Errorf("getKeyValueFromListLine() got = %v, want %v", k, tt.wantk)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUpsdLine() = %v, want %v", got, tt.want)
 			}
-			if v != tt.wantv {
-				t.Errorf("getKeyValueFromListLine() got1 = %v, want %v", k, tt.wantv)
+		})
+	}
+}
+
+func TestQuoteUpsdValue(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "Plain", in: "100", want: `"100"`},
+		{name: "Empty", in: "", want: `""`},
+		{name: "Quotes", in: `the "good" one`, want: `"the \"good\" one"`},
+		{name: "Backslash", in: `C:\UPS`, want: `"C:\\UPS"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := QuoteUpsdValue(tt.in); got != tt.want {
+				t.Errorf("QuoteUpsdValue() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func FuzzParseUpsdLine(f *testing.F) {
+	f.Add("UPS myups \"makes a beeping sound\"")
+	f.Add("VAR myups ups.id \"a \\\"quoted\\\" \\\\ value\"")
+	f.Add("RANGE myups input.transfer.low \"80\" \"100\"")
+	f.Add("TYPE myups ups.id RW STRING:8")
+	f.Add("VAR myups \"")
+	f.Add("UPS")
+	f.Fuzz(func(t *testing.T, line string) {
+		// Anything goes, as long as we don't panic and what we return hangs together.
+		item, err := parseUpsdLine(line)
+		if err != nil || item == nil {
+			return
+		}
+		if _, ok := upsdNounLayouts[item.Noun]; !ok {
+			t.Errorf("parseUpsdLine(%q) returned unknown noun %v", line, item.Noun)
+		}
+	})
+}
+
+func FuzzQuoteUpsdValue(f *testing.F) {
+	f.Add("makes a beeping sound")
+	f.Add(`the "good" one`)
+	f.Add(`C:\UPS\`)
+	f.Add("")
+	f.Fuzz(func(t *testing.T, value string) {
+		// Whatever a UPS puts in a value, quoting and parsing it should get it back as-is.
+		line := "VAR myups some.var " + QuoteUpsdValue(value)
+		item, err := parseUpsdLine(line)
+		if err != nil {
+			t.Fatalf("parseUpsdLine(%q) error = %v", line, err)
+		}
+		if item.Value() != value {
+			t.Errorf("parseUpsdLine(%q) value = %q, want %q", line, item.Value(), value)
+		}
+	})
+}
+
+func FuzzProcessUpsdResponse(f *testing.F) {
+	f.Add("BEGIN LIST UPS\nUPS myups \"description\"\nEND LIST UPS\n", "LIST UPS")
+	f.Add("BEGIN LIST VAR myups\nVAR myups stuff.things \"yokes\"\nEND LIST VAR myups\n", "LIST VAR myups")
+	f.Add("VAR myups stuff.things \"yokes\"", "GET VAR myups stuff.things")
+	f.Add("ERR UNKNOWN-UPS\n", "LIST VAR myups")
+	f.Fuzz(func(t *testing.T, response string, cmd string) {
+		rep, err := processUpsdResponse(response, cmd)
+		if err != nil {
+			return
+		}
+		// Exercise the accessors too.
+		rep.Map()
+		rep.Names()
+		rep.Values()
+	})
+}
+
 func Test_processUpsdResponse(t *testing.T) {
 	type args struct {
 		response string
@@ -112,6 +271,18 @@ func Test_processUpsdResponse(t *testing.T) {
 			want:    map[string]string{"stuff.things": "yokes"},
 			wantErr: false,
 		},
+		{
+			name:    "GETWrongNoun",
+			args:    args{response: "DESC myups stuff.things \"yokes\"", cmd: "GET VAR myups stuff.things"},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "GETErr",
+			args:    args{response: "ERR VAR-NOT-SUPPORTED\n", cmd: "GET VAR myups stuff.things"},
+			want:    nil,
+			wantErr: true,
+		},
 		{
 			name:    "NotImplementedIndeed",
 			args:    args{response: "UPS stuff \"things\"", cmd: "FUNGE blarg"},
@@ -134,6 +305,11 @@ func Test_processUpsdResponse(t *testing.T) {
 			args:    args{response: "BEGIN LIST UPS\nUPS myups \"description\"\n", cmd: "LIST UPS"},
 			wantErr: true,
 		},
+		{
+			name:    "ListErr",
+			args:    args{response: "ERR UNKNOWN-UPS\n", cmd: "LIST VAR myups"},
+			wantErr: true,
+		},
 		{
 			name:    "ListOneElem",
 			args:    args{response: "BEGIN LIST UPS\nUPS myups \"description\"\nEND LIST UPS\n", cmd: "LIST UPS"},
@@ -146,6 +322,17 @@ func Test_processUpsdResponse(t *testing.T) {
 			wantErr: false,
 			want:    map[string]string{"myups": "description", "myotherups": "other one"},
 		},
+		{
+			name:    "ListRW",
+			args:    args{response: "BEGIN LIST RW myups\nRW myups input.transfer.low \"90\"\nEND LIST RW myups\n", cmd: "LIST RW myups"},
+			wantErr: false,
+			want:    map[string]string{"input.transfer.low": "90"},
+		},
+		{
+			name:    "ListMixedNouns",
+			args:    args{response: "BEGIN LIST RW myups\nVAR myups input.transfer.low \"90\"\nEND LIST RW myups\n", cmd: "LIST RW myups"},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -154,13 +341,86 @@ func Test_processUpsdResponse(t *testing.T) {
 				t.Errorf("processUpsdResponse() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("processUpsdResponse() = %v, want %v", got, tt.want)
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got.Map(), tt.want) {
+				t.Errorf("processUpsdResponse() = %v, want %v", got.Map(), tt.want)
 			}
 		})
 	}
 }
 
+func Test_processUpsdResponseErr(t *testing.T) {
+	_, err := processUpsdResponse("ERR ACCESS-DENIED\n", "LIST CLIENT myups")
+	upsd_err, ok := err.(*UpsdError)
+	if !ok {
+		t.Fatalf("processUpsdResponse() error = %v, want *UpsdError", err)
+	}
+	if upsd_err.Code != "ACCESS-DENIED" {
+		t.Errorf("UpsdError.Code = %v, want ACCESS-DENIED", upsd_err.Code)
+	}
+}
+
+func TestTypedCommands(t *testing.T) {
+	ctx := context.Background()
+
+	cmds, err := ListCmds(ctx, NewUPSDMockClient("localhost", 3493, "BEGIN LIST CMD myups\nCMD myups beeper.off\nCMD myups test.battery.start\nEND LIST CMD myups\n"), "myups")
+	if err != nil || !reflect.DeepEqual(cmds, []string{"beeper.off", "test.battery.start"}) {
+		t.Errorf("ListCmds() = %v, %v", cmds, err)
+	}
+
+	enums, err := ListEnum(ctx, NewUPSDMockClient("localhost", 3493, "BEGIN LIST ENUM myups input.transfer.low\nENUM myups input.transfer.low \"103\"\nENUM myups input.transfer.low \"100\"\nEND LIST ENUM myups input.transfer.low\n"), "myups", "input.transfer.low")
+	if err != nil || !reflect.DeepEqual(enums, []string{"103", "100"}) {
+		t.Errorf("ListEnum() = %v, %v", enums, err)
+	}
+
+	ranges, err := ListRange(ctx, NewUPSDMockClient("localhost", 3493, "BEGIN LIST RANGE myups input.transfer.low\nRANGE myups input.transfer.low \"90\" \"100\"\nEND LIST RANGE myups input.transfer.low\n"), "myups", "input.transfer.low")
+	if err != nil || !reflect.DeepEqual(ranges, []VarRange{{Min: "90", Max: "100"}}) {
+		t.Errorf("ListRange() = %v, %v", ranges, err)
+	}
+
+	clients, err := ListClients(ctx, NewUPSDMockClient("localhost", 3493, "BEGIN LIST CLIENT myups\nCLIENT myups 127.0.0.1\nEND LIST CLIENT myups\n"), "myups")
+	if err != nil || !reflect.DeepEqual(clients, []string{"127.0.0.1"}) {
+		t.Errorf("ListClients() = %v, %v", clients, err)
+	}
+
+	vt, err := GetType(ctx, NewUPSDMockClient("localhost", 3493, "TYPE myups ups.id RW STRING:8\n"), "myups", "ups.id")
+	if err != nil || !reflect.DeepEqual(vt, &VarType{Writable: true, Kind: "STRING", MaxLength: 8}) {
+		t.Errorf("GetType() = %v, %v", vt, err)
+	}
+
+	vt, err = GetType(ctx, NewUPSDMockClient("localhost", 3493, "TYPE myups battery.charge NUMBER\n"), "myups", "battery.charge")
+	if err != nil || !reflect.DeepEqual(vt, &VarType{Kind: "NUMBER"}) {
+		t.Errorf("GetType() = %v, %v", vt, err)
+	}
+
+	desc, err := GetDesc(ctx, NewUPSDMockClient("localhost", 3493, "DESC myups battery.charge \"Battery charge (percent of full)\"\n"), "myups", "battery.charge")
+	if err != nil || desc != "Battery charge (percent of full)" {
+		t.Errorf("GetDesc() = %v, %v", desc, err)
+	}
+
+	cmddesc, err := GetCmdDesc(ctx, NewUPSDMockClient("localhost", 3493, "CMDDESC myups beeper.off \"Disable the UPS beeper\"\n"), "myups", "beeper.off")
+	if err != nil || cmddesc != "Disable the UPS beeper" {
+		t.Errorf("GetCmdDesc() = %v, %v", cmddesc, err)
+	}
+
+	logins, err := GetNumLogins(ctx, NewUPSDMockClient("localhost", 3493, "NUMLOGINS myups 3\n"), "myups")
+	if err != nil || logins != 3 {
+		t.Errorf("GetNumLogins() = %v, %v", logins, err)
+	}
+
+	upsdesc, err := GetUPSDesc(ctx, NewUPSDMockClient("localhost", 3493, "UPSDESC myups \"Rack UPS\"\n"), "myups")
+	if err != nil || upsdesc != "Rack UPS" {
+		t.Errorf("GetUPSDesc() = %v, %v", upsdesc, err)
+	}
+
+	_, err = GetVar(ctx, NewUPSDMockClient("localhost", 3493, "ERR VAR-NOT-SUPPORTED\n"), "myups", "battery.charge")
+	if err == nil {
+		t.Errorf("GetVar() error = nil, want VAR-NOT-SUPPORTED")
+	}
+}
+
 func TestUpsdCommand(t *testing.T) {
 	type args struct {
 		upsd_c *UPSDClient
@@ -169,7 +429,7 @@ func TestUpsdCommand(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		want    map[string]string
+		want    *UpsdResponse
 		wantErr bool
 	}{
 		{
@@ -180,7 +440,7 @@ func TestUpsdCommand(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := UpsdCommand(tt.args.upsd_c, tt.args.cmd)
+			got, err := UpsdCommand(context.Background(), tt.args.upsd_c, tt.args.cmd)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("UpsdCommand() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -211,13 +471,13 @@ func TestGetUPSes(t *testing.T) {
 		{
 			name:    "OneResponse",
 			args:    args{upsd_c: NewUPSDMockClient("localhost", 3493, "BEGIN LIST UPS\nUPS myups \"description\"\nEND LIST UPS\n")},
-			want:    []*channels.UPSInfo{{Name: "myups", Description: "description", Host: "localhost", Vars: map[string]string{}}},
+			want:    []*channels.UPSInfo{{Name: "myups", Description: "description", Host: "localhost", Port: 3493, Vars: map[string]string{}}},
 			wantErr: false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := GetUPSes(tt.args.upsd_c)
+			got, err := GetUPSes(context.Background(), tt.args.upsd_c)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetUPSes() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -271,7 +531,7 @@ func TestGetUpdatedVars(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := GetUpdatedVars(tt.args.upsd_c, tt.args.u)
+			got, err := GetUpdatedVars(context.Background(), tt.args.upsd_c, tt.args.u)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetUpdatedVars() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -317,3 +577,138 @@ func TestGetVarDiff(t *testing.T) {
 		})
 	}
 }
+
+func TestRawUpsdCommandTimeout(t *testing.T) {
+	// A upsd that accepts connections and then says nothing.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	upsd_c := NewUPSDClient("127.0.0.1", l.Addr().(*net.TCPAddr).Port)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = upsd_c.Request(ctx, "LIST UPS")
+	if !IsTimeout(err) {
+		t.Errorf("Request() error = %v, want timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Request() took %v, deadline not honoured", elapsed)
+	}
+}
+
+func TestGetVarMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		upsd_c  UPSDClientIf
+		varname string
+		want    *channels.VarMetadata
+		wantErr bool
+	}{
+		{
+			name: "Everything",
+			upsd_c: NewUPSDScriptedMockClient("localhost", 3493, map[string]string{
+				"GET DESC myups input.transfer.low": "DESC myups input.transfer.low \"Low voltage transfer point\"\n",
+				"GET TYPE myups input.transfer.low": "TYPE myups input.transfer.low RW NUMBER\n",
+			}),
+			varname: "input.transfer.low",
+			want:    &channels.VarMetadata{Description: "Low voltage transfer point", Type: "NUMBER", Writable: true, Unit: "V"},
+		},
+		{
+			name: "Unit",
+			upsd_c: NewUPSDScriptedMockClient("localhost", 3493, map[string]string{
+				"GET DESC myups battery.charge": "DESC myups battery.charge \"Battery charge (percent of full)\"\n",
+				"GET TYPE myups battery.charge": "TYPE myups battery.charge NUMBER\n",
+			}),
+			varname: "battery.charge",
+			want:    &channels.VarMetadata{Description: "Battery charge (percent of full)", Type: "NUMBER", Unit: "%"},
+		},
+		{
+			name: "NotDescribed",
+			upsd_c: NewUPSDScriptedMockClient("localhost", 3493, map[string]string{
+				"GET DESC myups ups.id": "ERR VAR-NOT-SUPPORTED\n",
+				"GET TYPE myups ups.id": "TYPE myups ups.id RW STRING:8\n",
+			}),
+			varname: "ups.id",
+			want:    &channels.VarMetadata{Type: "STRING", Writable: true, MaxLength: 8},
+		},
+		{
+			name:    "Garbage",
+			upsd_c:  NewUPSDMockClient("localhost", 3493, "TEAPOT\n"),
+			varname: "ups.id",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetVarMetadata(context.Background(), tt.upsd_c, "myups", tt.varname)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetVarMetadata() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetVarMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVarUnit(t *testing.T) {
+	tests := map[string]string{
+		"input.voltage":            "V",
+		"input.voltage.nominal":    "V",
+		"battery.charge.low":       "%",
+		"ups.realpower.nominal":    "W",
+		"ups.power":                "VA",
+		"battery.runtime":          "s",
+		"ups.status":               "",
+		"battery.charger.status":   "",
+		"input.transfer.high":      "V",
+		"input.transfer.low":       "V",
+		"input.transfer.boost.low": "V",
+		"input.transfer.delay":     "s",
+		"input.transfer.reason":    "",
+	}
+	for varname, want := range tests {
+		if got := VarUnit(varname); got != want {
+			t.Errorf("VarUnit(%v) = %v, want %v", varname, got, want)
+		}
+	}
+}
+
+// Mock that also records what UpsdCommand tells it about each request.
+type observedMockClient struct {
+	*UPSDMockClient
+	observed []string
+}
+
+func (o *observedMockClient) ObserveRequest(command string, took time.Duration, err_type string) {
+	o.observed = append(o.observed, command+"/"+err_type)
+}
+
+func TestUpsdCommandObserved(t *testing.T) {
+	upsd_c := &observedMockClient{UPSDMockClient: NewUPSDScriptedMockClient("localhost", 3493, map[string]string{
+		"LIST UPS":                  "BEGIN LIST UPS\nUPS myups \"description\"\nEND LIST UPS\n",
+		"GET VAR myups ups.status":  "ERR VAR-NOT-SUPPORTED\n",
+		"GET DESC myups ups.status": "TEAPOT\n",
+	})}
+	UpsdCommand(context.Background(), upsd_c, "LIST UPS")
+	UpsdCommand(context.Background(), upsd_c, "GET VAR myups ups.status")
+	UpsdCommand(context.Background(), upsd_c, "GET DESC myups ups.status")
+	want := []string{"LIST UPS/", "GET VAR/upsd", "GET DESC/protocol"}
+	if !reflect.DeepEqual(upsd_c.observed, want) {
+		t.Errorf("observed = %v, want %v", upsd_c.observed, want)
+	}
+}
@@ -3,77 +3,356 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
 	"time"
 
 	channels "github.com/gerrowadat/nut2mqtt/internal/channels"
+	config "github.com/gerrowadat/nut2mqtt/internal/config"
 	control "github.com/gerrowadat/nut2mqtt/internal/control"
 	http "github.com/gerrowadat/nut2mqtt/internal/http"
+	journal "github.com/gerrowadat/nut2mqtt/internal/journal"
+	logging "github.com/gerrowadat/nut2mqtt/internal/logging"
+	metrics "github.com/gerrowadat/nut2mqtt/internal/metrics"
 	mqtt "github.com/gerrowadat/nut2mqtt/internal/mqtt"
+	nutserver "github.com/gerrowadat/nut2mqtt/internal/nutserver"
 	upsc "github.com/gerrowadat/nut2mqtt/internal/upsc"
 )
 
+var logger = logging.Logger("main")
+
+// Log, then exit. For setup problems.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	upsd_hosts := flag.String("upsd-hosts", "localhost", "address of upsd host(s), comma-separated")
 	upsd_port := flag.Int("upsd-port", 3493, "port of upsd server")
 	mqtt_host := flag.String("mqtt-host", "localhost", "address of MQTT server")
 	mqtt_port := flag.Int("mqtt-port", 1883, "port of mqtt server")
+	mqtt_url_flag := flag.String("mqtt-url", "", "MQTT broker URL, e.g. ssl://host:8883 or wss://host/mqtt. Overrides --mqtt-host and --mqtt-port")
+	mqtt_ca_file := flag.String("mqtt-ca-file", "", "PEM file of CAs to trust for the MQTT broker's certificate (default the system ones)")
+	mqtt_cert_file := flag.String("mqtt-cert-file", "", "PEM client certificate for MQTT")
+	mqtt_key_file := flag.String("mqtt-key-file", "", "PEM client key for MQTT")
+	mqtt_insecure_skip_verify := flag.Bool("mqtt-insecure-skip-verify", false, "don't check the MQTT broker's certificate (testing only!)")
 	mqtt_user := flag.String("mqtt-user", "nut", "MQTT username")
-	mqtt_password := os.Getenv("MQTT_PASSWORD")
+	mqtt_client_id := flag.String("mqtt-client-id", "", "MQTT client ID, which has to be unique on the broker (default nut2mqtt-<instance id>)")
 
 	mqtt_topic_base := flag.String("mqtt-topic-base", "nut/", "base topic for MQTT messages")
+	mqtt_topic_template := flag.String("mqtt-topic-template", mqtt.DefaultTopicTemplate, "Go template for variable topics, under --mqtt-topic-base. Has .Host, .Ups (alias or name), .Alias (empty if unset), .Name, .ID and .Var, and slashes/underscores/lower functions")
+	mqtt_protocol := flag.Int("mqtt-protocol", 3, "MQTT protocol version, 3 or 5. 5 adds user properties, content types, message expiry, topic aliases and requests on <control-topic>/request")
+	mqtt_message_expiry := flag.String("mqtt-message-expiry", "0s", "(MQTT v5) how long variable readings live on the broker, at least 1s, or 0 for forever")
+	mqtt_topic_aliases := flag.Int("mqtt-topic-aliases", 100, "(MQTT v5) most topic aliases to use, if the broker allows. 0 turns them off")
+	mqtt_queue_size := flag.Int("mqtt-queue-size", 1000, "how many topics' worth of updates to hold on to while the MQTT broker's away (only the latest per topic is kept)")
+	mqtt_retain := flag.Bool("mqtt-retain", false, "publish variable values as retained messages")
+	mqtt_ha_discovery := flag.Bool("mqtt-ha-discovery", false, "publish Home Assistant discovery configs for the derived power and energy sensors")
+	mqtt_ha_discovery_prefix := flag.String("mqtt-ha-discovery-prefix", mqtt.DefaultHADiscoveryPrefix, "topic prefix Home Assistant looks for discovery configs under")
+	mqtt_clear_stale := flag.Bool("mqtt-clear-stale", false, "clear a UPS's retained topics when it drops out of the cache")
 	upsd_poll_interval := flag.Int("upsd-poll-interval", 30, "interval between upsd polls")
 	upsd_cache_lifetime := flag.String("upsd-cache-lifetime", "60s", "lifetime of upsd cache entries")
+	upsd_timeout := flag.String("upsd-timeout", "10s", "timeout for each request to upsd")
+	ups_identity := flag.String("ups-identity", "address", "how to tell UPSes apart: address (host:port/name) or serial (device.serial, where reported)")
 
 	control_topic := flag.String("control-topic", "bridge", "subtopic for control/alive messages")
+	ha_group := flag.String("ha-group", "", "run active/standby with other instances in this group, where only the leader publishes UPS data (default off)")
+	ha_lease := flag.String("ha-lease", "30s", "how long the HA leader's lease lasts, i.e. roughly how long before a standby takes over from a dead leader")
+	instance_id := flag.String("instance-id", "", "name for this bridge, to tell it apart from others on the same broker (default the hostname)")
 
 	http_listen := flag.String("http-listen", ":8080", "Where the http server should listen (default :8080)")
+	nut_listen := flag.String("nut-listen", "", "serve every UPS we know about to NUT clients (upsmon, NASes) here, read-only, as if we were upsd, e.g. :3493 (default off)")
+
+	log_level := flag.String("log-level", "info", "how much to log: debug (includes every MQTT update), info, warn or error, optionally per subsystem, e.g. info,mqtt=debug. Can be changed with the set-log-level command")
+	log_format := flag.String("log-format", "text", "log as text or json")
+	journal_file := flag.String("journal-file", "", "file to record power events, status changes, commands and so on in, as JSON lines (default memory only)")
+	journal_max_size := flag.Int("journal-max-size", 10, "rotate the journal file once it's this many MB")
+	journal_max_files := flag.Int("journal-max-files", 5, "how many rotated journal files to keep")
+	journal_variables := flag.String("journal-variables", "ups.test.result,ups.beeper.status,input.transfer.reason", "comma-separated globs of NUT variables to record every change of in the journal, on top of ups.status and ups.alarm")
+	mqtt_events := flag.Bool("mqtt-events", false, "publish journal entries on <control-topic>/events too")
+	energy_state_file := flag.String("energy-state-file", "", "file to keep per-UPS energy totals in, so they carry on across restarts (default memory only)")
+	config_file := flag.String("config", "", "path to a JSON config file (optional, re-read on SIGHUP)")
+
+	metrics_mode := flag.String("metrics-mode", "mapped", "which UPS metrics to export: mapped (built-in or from --config), generic (every variable) or both")
+	metrics_generic_naming := flag.String("metrics-generic-naming", "labels", "for generic metrics, put the variable name in a label (nut_variable{var=...}) or the metric name (nut_battery_charge)")
+	metrics_include := flag.String("metrics-include", "", "for generic metrics, comma-separated globs of NUT variables to export (default all)")
+	metrics_exclude := flag.String("metrics-exclude", "", "for generic metrics, comma-separated globs of NUT variables not to export")
 
 	flag.Parse()
 
+	if err := logging.Setup(*log_format, os.Stderr); err != nil {
+		fatal("Bad --log-format", "err", err)
+	}
+	if err := logging.SetLevel(*log_level); err != nil {
+		fatal("Bad --log-level", "err", err)
+	}
+
 	// Get the list of UPSes from upsd
 	ups_hosts := upsc.NewUPSHosts(*upsd_hosts, *upsd_port)
 
-	// Connect to mqtt
-	mqtt_url := fmt.Sprintf("tcp://%s:%d", *mqtt_host, *mqtt_port)
-	mqtt_client, err := mqtt.NewMQTTClient(mqtt_url, mqtt_user, &mqtt_password)
+	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatal("MQTT fatal error: ", err)
+		logger.Warn("Can't get hostname", "err", err)
+		hostname = "unknown"
 	}
-	defer mqtt_client.Disconnect(250)
-	mqtt_client.SetTopicBase(*mqtt_topic_base)
+	if *instance_id == "" {
+		*instance_id = hostname
+	}
+	*instance_id = mqtt.SanitiseClientID(*instance_id)
+	if *mqtt_client_id == "" {
+		*mqtt_client_id = "nut2mqtt-" + *instance_id
+	}
+
+	// Connect to mqtt. The flags give us one output, unless the config file has some.
+	mqtt_url := fmt.Sprintf("tcp://%s:%d", *mqtt_host, *mqtt_port)
+	if *mqtt_url_flag != "" {
+		mqtt_url = *mqtt_url_flag
+	}
+	default_output := config.OutputConfig{
+		Name:               "default",
+		URL:                mqtt_url,
+		User:               *mqtt_user,
+		ClientID:           *mqtt_client_id,
+		PasswordEnv:        "MQTT_PASSWORD",
+		CAFile:             *mqtt_ca_file,
+		CertFile:           *mqtt_cert_file,
+		KeyFile:            *mqtt_key_file,
+		InsecureSkipVerify: *mqtt_insecure_skip_verify,
+		Protocol:           *mqtt_protocol,
+		TopicBase:          *mqtt_topic_base,
+		TopicTemplate:      *mqtt_topic_template,
+		Retain:             *mqtt_retain,
+		QueueSize:          *mqtt_queue_size,
+		MessageExpiry:      *mqtt_message_expiry,
+		TopicAliases:       *mqtt_topic_aliases,
+		HADiscovery:        *mqtt_ha_discovery,
+		HADiscoveryPrefix:  *mqtt_ha_discovery_prefix,
+	}
+	output_cfgs := []config.OutputConfig{default_output}
+	var startup_cfg *config.Config
+	if *config_file != "" {
+		startup_cfg, err = config.Load(*config_file)
+		if err != nil {
+			fatal("Error loading --config", "file", *config_file, "err", err)
+		}
+		if len(startup_cfg.Outputs) > 0 {
+			output_cfgs = []config.OutputConfig{}
+			for _, o := range startup_cfg.Outputs {
+				output_cfgs = append(output_cfgs, mqtt.OutputWithDefaults(o, default_output))
+			}
+		}
+	}
+	mqtt_outputs := mqtt.Outputs{}
+	output_names := map[string]bool{}
+	client_ids := map[string]string{}
+	for _, o := range output_cfgs {
+		if output_names[o.Name] {
+			fatal("More than one output with the same name", "output", o.Name)
+		}
+		output_names[o.Name] = true
+		m, err := mqtt.NewOutput(o, control.StateTopic(*control_topic, *instance_id))
+		if err != nil {
+			fatal("MQTT fatal error", "output", o.Name, "err", err)
+		}
+		mqtt_outputs = append(mqtt_outputs, m)
+		client_ids[o.Name] = m.ClientID()
+	}
+	defer mqtt_outputs.Disconnect(250)
 
 	// Create the controller
 	upsd_cache_lifetime_duration, err := time.ParseDuration(*upsd_cache_lifetime)
 	if err != nil {
-		log.Fatal("Could not parse --upsd-cache-lifetime: ", err)
+		fatal("Could not parse --upsd-cache-lifetime", "err", err)
+	}
+	upsd_timeout_duration, err := time.ParseDuration(*upsd_timeout)
+	if err != nil {
+		fatal("Could not parse --upsd-timeout", "err", err)
 	}
 	controller := control.NewController(*control_topic, upsd_cache_lifetime_duration)
+	controller.SetClearStaleTopics(*mqtt_clear_stale)
+	events, err := journal.Open(journal.Options{Path: *journal_file, MaxSize: int64(*journal_max_size) * 1024 * 1024, MaxFiles: *journal_max_files})
+	if err != nil {
+		fatal("Error opening journal", "file", *journal_file, "err", err)
+	}
+	defer events.Close()
+	controller.SetJournal(events, *mqtt_events)
+	controller.SetJournalVariables(splitFlagList(*journal_variables))
+	if *energy_state_file != "" {
+		if err := controller.SetEnergyStateFile(*energy_state_file); err != nil {
+			fatal("Error loading energy totals", "file", *energy_state_file, "err", err)
+		}
+	}
+	polled_hosts := []string{}
+	for _, h := range ups_hosts.Hosts {
+		polled_hosts = append(polled_hosts, fmt.Sprintf("%v:%v", h.Host(), h.Port()))
+	}
+	controller.SetInstanceInfo(&control.InstanceInfo{
+		ID:        *instance_id,
+		Version:   version,
+		Hostname:  hostname,
+		Started:   time.Now(),
+		Hosts:     polled_hosts,
+		ClientIDs: client_ids,
+		HAGroup:   *ha_group,
+	})
+	var election *mqtt.LeaderElection
+	if *ha_group != "" {
+		ha_lease_duration, err := time.ParseDuration(*ha_lease)
+		if err != nil || ha_lease_duration < 3*time.Second {
+			fatal("--ha-lease must be a duration of at least 3s", "ha_lease", *ha_lease)
+		}
+		// The first output's broker decides who's leader.
+		election = mqtt.NewLeaderElection(mqtt_outputs[0], &controller, *ha_group, *instance_id, ha_lease_duration)
+		logger.Info("HA: on standby until we're leader", "group", *ha_group, "topic", mqtt_outputs[0].GetTopicBase()+election.Topic())
+	}
+	mqtt_outputs.SetRequestHandler(controller.ControlTopic()+"/request", controller.HandleRequest)
+	mqtt_outputs.Subscribe(controller.CommandTopic(), func(payload []byte) {
+		// Don't hold up the MQTT client while the controller gets round to it.
+		go controller.HandleCommand(payload)
+	})
+	switch *ups_identity {
+	case "address":
+	case "serial":
+		controller.SetIdentifyBySerial(true)
+	default:
+		fatal("--ups-identity must be address or serial", "ups_identity", *ups_identity)
+	}
+
+	// "fixed" is what mapped was called before the mappings could be configured.
+	if *metrics_mode == "fixed" {
+		logger.Warn("--metrics-mode=fixed is now called mapped")
+		*metrics_mode = "mapped"
+	}
+	switch *metrics_mode {
+	case "mapped":
+	case "generic", "both":
+		if *metrics_generic_naming != "labels" && *metrics_generic_naming != "names" {
+			fatal("--metrics-generic-naming must be labels or names", "metrics_generic_naming", *metrics_generic_naming)
+		}
+		controller.MetricRegistry().EnableGenericExporter(splitFlagList(*metrics_include), splitFlagList(*metrics_exclude), *metrics_generic_naming == "names")
+		if *metrics_mode == "generic" {
+			controller.MetricRegistry().DisableMappedMetrics()
+		}
+	default:
+		fatal("--metrics-mode must be mapped, generic or both", "metrics_mode", *metrics_mode)
+	}
+
+	if *config_file != "" {
+		apply_config := func() error {
+			cfg, err := config.Load(*config_file)
+			if err != nil {
+				return err
+			}
+			// Check everything before using any of it, so a mistake anywhere leaves the old config in place.
+			if err := control.ValidateUPSConfig(cfg.UPS); err != nil {
+				return err
+			}
+			for _, u := range cfg.UPS {
+				if u.TopicTemplate != "" {
+					if _, err := mqtt.ParseTopicTemplate(u.TopicTemplate); err != nil {
+						return fmt.Errorf("ups %v: %v", u.Match, err)
+					}
+				}
+			}
+			if err := control.ValidateFilters(cfg.Filters); err != nil {
+				return err
+			}
+			if err := control.ValidateDerivedVariables(cfg.Derived); err != nil {
+				return err
+			}
+			if *metrics_mode != "generic" {
+				if err := metrics.ValidateMappings(cfg.Metrics); err != nil {
+					return err
+				}
+			}
+			if !reflect.DeepEqual(cfg.Outputs, startup_cfg.Outputs) {
+				logger.Warn("MQTT outputs have changed, but that needs a restart", "file", *config_file)
+			}
+			if err := controller.SetFilters(cfg.Filters); err != nil {
+				return err
+			}
+			if err := controller.SetDerivedVariables(cfg.Derived); err != nil {
+				return err
+			}
+			controller.SetUPSConfig(cfg.UPS)
+			if *metrics_mode != "generic" {
+				if err := controller.MetricRegistry().SetMetricMappings(cfg.Metrics); err != nil {
+					return err
+				}
+			}
+			logger.Info("Loaded config", "file", *config_file)
+			return nil
+		}
+		if err := apply_config(); err != nil {
+			fatal("Error loading --config", "file", *config_file, "err", err)
+		}
+		controller.SetReloader(apply_config)
+	}
 
 	// Consume control messages, startup, shutdown, etc.
 	go controller.ControlMessageConsumer()
 
 	// Produce UPS info by talking to nut instances.
-	go ups_hosts.UPSInfoProducer(&controller, time.Duration(*upsd_poll_interval))
+	go ups_hosts.UPSInfoProducer(&controller, time.Duration(*upsd_poll_interval), upsd_timeout_duration)
 
 	// Multiplex these UPS changes into UPSVariableUpdate messages
 	go controller.UPSVariableUpdateMultiplexer()
 
 	// Produce MQTT updates from UPSVariableUpdate messages
-	go mqtt_client.UpdateProducer(&controller)
+	mqtt_outputs.Run(&controller)
+	go mqtt_outputs.UpdateProducer(&controller)
 
 	// Consume UPS changes and Do the Needful
-	go mqtt_client.UpdateConsumer(&controller)
+	go mqtt_outputs.UpdateConsumer(&controller)
 	go controller.MetricsUpdateConsumer()
 
+	if election != nil {
+		go election.Run()
+	}
+
 	// Start the http server
 	go http.HTTPServer(&controller, http_listen)
+	if *nut_listen != "" {
+		go nutserver.NUTServer(&controller, *nut_listen, nutserver.StaleAfter(time.Duration(*upsd_poll_interval)*time.Second, upsd_cache_lifetime_duration))
+	}
 
 	controller.Startup("Online at %v", time.Now().String())
 
+	// Re-read the config file on SIGHUP.
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			controller.Reload("SIGHUP")
+		}
+	}()
+
 	controller.Wait()
 
 	// One of our goroutines has died, send our offline message and exit.
-	mqtt_client.PublishMessage(&channels.MQTTUpdate{Topic: *control_topic, Content: "offline"})
+	if err := controller.SaveEnergy(); err != nil {
+		logger.Error("Error saving energy totals", "file", *energy_state_file, "err", err)
+	}
+	if election != nil {
+		election.Release()
+	}
+	mqtt_outputs.PublishMessage(&channels.MQTTUpdate{Topic: controller.StateTopic(), Content: "offline", Retain: true})
+	mqtt_outputs.PublishMessage(&channels.MQTTUpdate{Topic: controller.InstanceTopic(), Content: "", Retain: true})
+}
+
+// Split a comma-separated flag into its (non-empty) parts.
+func splitFlagList(f string) []string {
+	ret := []string{}
+	for _, s := range strings.Split(f, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
 }